@@ -21,16 +21,34 @@ package main
 import (
 	"context"
 	"flag"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
 	"github.com/IntelAI/vck/pkg/resource/reify"
 
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+
 	apiv1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/client-go/tools/record"
 
+	vckv1alpha1 "github.com/IntelAI/vck/pkg/apis/vck/v1alpha1"
 	vckv1_client "github.com/IntelAI/vck/pkg/client/clientset/versioned"
 	"github.com/IntelAI/vck/pkg/controller"
 	"github.com/IntelAI/vck/pkg/handlers"
+	"github.com/IntelAI/vck/pkg/health"
 	"github.com/IntelAI/vck/pkg/hooks"
+	"github.com/IntelAI/vck/pkg/metrics"
 	"github.com/IntelAI/vck/pkg/resource"
 	"github.com/IntelAI/vck/pkg/util"
 	corev1 "k8s.io/api/core/v1"
@@ -38,6 +56,12 @@ import (
 	"k8s.io/client-go/dynamic"
 )
 
+const (
+	// The name of the controller. It is the source of the recorded events
+	// and the name of the config map used as the leader election lock.
+	controllerName = "vck-controller"
+)
+
 func main() {
 	kubeconfig := flag.String("kubeconfig", "", "Path to a kubeconfig file")
 	namespace := flag.String("namespace", apiv1.NamespaceAll, "Namespace to monitor (Default all)")
@@ -45,6 +69,20 @@ func main() {
 	pachydermPodTemplateFile := flag.String("pachydermPodFile", "/etc/volumemanagers/pod_pachyderm.tmpl", "Path to a job template file for the pachyderm client")
 	pvTemplateFile := flag.String("pvFile", "/etc/volumemangers/pv.tmpl", "Path to a job template file")
 	pvcTemplateFile := flag.String("pvcFile", "/etc/volumemangers/pvc.tmpl", "Path to a job template file")
+	workers := flag.Int("workers", 4, "Number of volume managers reconciled concurrently")
+	resyncPeriod := flag.Duration("resyncPeriod", 10*time.Minute, "Period at which all volume managers are checked for drift in their sub-resources")
+	leaderElect := flag.Bool("leaderElect", false, "Elect a leader among the replicas of the controller before reconciling volume managers")
+	leaderElectNamespace := flag.String("leaderElectNamespace", "", "Namespace of the leader election lock (Default the monitored namespace)")
+	leaderElectIdentity := flag.String("leaderElectIdentity", "", "Identity of this replica in the leader election (Default the hostname)")
+	leaseDuration := flag.Duration("leaseDuration", 15*time.Second, "Duration that standby replicas wait before taking over the leadership")
+	renewDeadline := flag.Duration("renewDeadline", 10*time.Second, "Duration that the leader retries renewing its leadership before giving it up")
+	retryPeriod := flag.Duration("retryPeriod", 2*time.Second, "Duration between leader election attempts")
+	metricsAddress := flag.String("metricsAddress", "", "Address to serve Prometheus metrics on at /metrics, e.g. :9090 (Default disabled)")
+	healthAddress := flag.String("healthAddress", ":8080", "Address to serve the /healthz and /readyz endpoints on")
+	shutdownGracePeriod := flag.Duration("shutdownGracePeriod", 30*time.Second, "Duration that the reconciles in flight are given to finish on shutdown before they are recorded as interrupted")
+	maxDownloads := flag.Int("maxDownloads", 0, "Maximum number of download pods running at the same time in the cluster (Default unlimited)")
+	maxDownloadsPerNode := flag.Int("maxDownloadsPerNode", 0, "Maximum number of download pods running at the same time on a node (Default unlimited)")
+	livenessTimeout := flag.Duration("livenessTimeout", 1*time.Hour, "Duration after which the controller is reported as not live if no reconcile completed or reported progress while there is work queued")
 	flag.Set("logtostderr", "true")
 	flag.Parse()
 
@@ -105,30 +143,184 @@ func main() {
 	corev1Scheme := runtime.NewScheme()
 	corev1Scheme.AddKnownTypes(corev1.SchemeGroupVersion, &corev1.PersistentVolume{}, &corev1.Pod{}, &corev1.Node{}, &corev1.PersistentVolumeClaim{})
 
+	// The templates are validated before reify is shadowed below.
+	validateTemplates := func() error {
+		return reify.Validate(*podTemplateFile, *pachydermPodTemplateFile, *pvTemplateFile, *pvcTemplateFile)
+	}
+
 	reify := &reify.Reify{}
+	// The data handlers read the nodes and the sub-resources they created
+	// from a shared cache rather than from the API server.
+	resourceCache := resource.NewCache(k8sClientset, *namespace, *resyncPeriod)
+	newClient := func(apiResource *metav1.APIResource, templateFileName string) resource.Client {
+		return resource.NewCachedClient(resource.NewGenericClient(dynClient, apiResource, templateFileName, corev1Scheme, corev1.SchemeGroupVersion, reify), resourceCache)
+	}
 	// The ordering of these resource clients matters. We want the pod to be
 	// deployed last as it will use the PVC created before it.
-	nodeClient := resource.NewGenericClient(dynClient.Resource(nodeAPIResource, *namespace), "", nodeAPIResource.Name, corev1Scheme, corev1.SchemeGroupVersion, reify)
-	pvClient := resource.NewGenericClient(dynClient.Resource(pvAPIResource, *namespace), *pvTemplateFile, pvAPIResource.Name, corev1Scheme, corev1.SchemeGroupVersion, reify)
-	pvcClient := resource.NewGenericClient(dynClient.Resource(pvcAPIResource, *namespace), *pvcTemplateFile, pvcAPIResource.Name, corev1Scheme, corev1.SchemeGroupVersion, reify)
-	podClient := resource.NewGenericClient(dynClient.Resource(podAPIResource, *namespace), *podTemplateFile, podAPIResource.Name, corev1Scheme, corev1.SchemeGroupVersion, reify)
-	pachydermPodClient := resource.NewGenericClient(dynClient.Resource(podAPIResource, *namespace), *pachydermPodTemplateFile, podAPIResource.Name, corev1Scheme, corev1.SchemeGroupVersion, reify)
+	nodeClient := newClient(nodeAPIResource, "")
+	pvClient := newClient(pvAPIResource, *pvTemplateFile)
+	pvcClient := newClient(pvcAPIResource, *pvcTemplateFile)
+	podClient := newClient(podAPIResource, *podTemplateFile)
+	pachydermPodClient := newClient(podAPIResource, *pachydermPodTemplateFile)
+
+	// Record events on the volume managers so that their provisioning can be
+	// followed using kubectl describe.
+	if err := vckv1alpha1.AddToScheme(scheme.Scheme); err != nil {
+		panic(err)
+	}
+	eventBroadcaster := record.NewBroadcaster()
+	eventBroadcaster.StartLogging(glog.Infof)
+	eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: k8sClientset.CoreV1().Events("")})
+	recorder := eventBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: controllerName})
 
-	dataHandlers := []handlers.DataHandler{
-		handlers.NewS3Handler(k8sClientset, []resource.Client{nodeClient, pvClient, pvcClient, podClient, podClient}),
-		handlers.NewNFSHandler(k8sClientset, []resource.Client{nodeClient, pvClient, pvcClient, podClient, podClient}),
-		handlers.NewPachydermHandler(k8sClientset, []resource.Client{nodeClient, pvClient, pvcClient, pachydermPodClient}),
+	// S3-Dev is the S3 source type pointed at an S3 compatible service such as
+	// minio using the endpointURL option.
+	// The download pods of all the data handlers share the same limits.
+	limiter := handlers.NewDownloadLimiter(*maxDownloads, *maxDownloadsPerNode)
+	registry := handlers.NewRegistry()
+	for _, err := range []error{
+		registry.Register(handlers.NewS3Handler(k8sClientset, []resource.Client{nodeClient, pvClient, pvcClient, podClient, podClient}, recorder, limiter), "S3-Dev"),
+		registry.Register(handlers.NewNFSHandler(k8sClientset, []resource.Client{nodeClient, pvClient, pvcClient, podClient, podClient}, recorder)),
+		registry.Register(handlers.NewPachydermHandler(k8sClientset, []resource.Client{nodeClient, pvClient, pvcClient, pachydermPodClient}, recorder, limiter)),
+	} {
+		if err != nil {
+			glog.Fatalf("error registering data handlers: %v", err)
+		}
 	}
+	glog.Infof("supported source types: %s", strings.Join(registry.SourceTypes(), ", "))
 
 	// Create hooks
-	hooks := hooks.NewVolumeManagerHooks(crdClient.VckV1alpha1().VolumeManagers(*namespace), dataHandlers)
+	hooks := hooks.NewVolumeManagerHooks(crdClient.VckV1alpha1(), registry, limiter, recorder, *resyncPeriod)
 
 	ctx, cancelFunc := context.WithCancel(context.Background())
 	defer cancelFunc()
 
+	// The cache is kept warm on the standby replicas as well. It has its own
+	// stop channel as the reconciles draining after SIGTERM still watch
+	// their pods through it.
+	cacheStop := make(chan struct{})
+	resourceCache.Start(cacheStop)
+
+	// Stop the intake of new work on SIGTERM, e.g. when the pod is evicted,
+	// and give the reconciles in flight the grace period to finish. A second
+	// signal exits immediately.
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		glog.Infof("received %v, shutting down", <-signals)
+		cancelFunc()
+		glog.Fatalf("received %v, exiting", <-signals)
+	}()
+
 	// Start a controller for instances of our custom resource.
-	controller := controller.New(hooks, crdClient)
-	go controller.Run(ctx, *namespace)
+	controller := controller.New(hooks, crdClient, *workers, *resyncPeriod, *shutdownGracePeriod)
+
+	// The endpoints are served on one listener per address, so that the
+	// metrics can share the listener of the health endpoints.
+	muxes := map[string]*http.ServeMux{*healthAddress: http.NewServeMux()}
+	muxes[*healthAddress].Handle("/healthz", health.Handler(map[string]health.Check{
+		"workers": func() error {
+			return controller.Live(*livenessTimeout)
+		},
+	}))
+	muxes[*healthAddress].Handle("/readyz", health.Handler(map[string]health.Check{
+		"informer":  controller.Ready,
+		"cache":     resourceCache.Synced,
+		"templates": validateTemplates,
+		"api": func() error {
+			_, err := k8sClientset.Discovery().ServerVersion()
+			return err
+		},
+	}))
+
+	if *metricsAddress != "" {
+		prometheus.MustRegister(metrics.NewClusterCollector(controller.Informer(*namespace), resourceCache.Informer("nodes")))
+		if muxes[*metricsAddress] == nil {
+			muxes[*metricsAddress] = http.NewServeMux()
+		}
+		muxes[*metricsAddress].Handle("/metrics", metrics.Handler())
+	}
+
+	for address, mux := range muxes {
+		go func(address string, mux *http.ServeMux) {
+			glog.Fatalf("error serving on %s: %v", address, http.ListenAndServe(address, mux))
+		}(address, mux)
+	}
+
+	run := func(<-chan struct{}) {
+		if !resourceCache.WaitForSync(ctx.Done()) {
+			glog.Errorf("timed out waiting for the resource cache to sync")
+		} else if err := controller.Run(ctx, *namespace); err != nil {
+			glog.Errorf("error stopping the controller: %v", err)
+		}
+		// The reconciles which did not finish within the grace period are
+		// recorded in the status of their volume managers so that the next
+		// leader resumes them.
+		if err := hooks.Interrupt(); err != nil {
+			glog.Errorf("error recording the interrupted reconciles: %v", err)
+		}
+		close(cacheStop)
+		glog.Flush()
+		os.Exit(0)
+	}
+
+	if !*leaderElect {
+		run(nil)
+		return
+	}
+
+	if *leaderElectNamespace == "" {
+		*leaderElectNamespace = *namespace
+	}
+	if *leaderElectNamespace == apiv1.NamespaceAll {
+		glog.Fatalf("leaderElectNamespace has to be set when all namespaces are monitored")
+	}
+
+	if *leaderElectIdentity == "" {
+		*leaderElectIdentity, err = os.Hostname()
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	lock, err := resourcelock.New(resourcelock.ConfigMapsResourceLock, *leaderElectNamespace, controllerName, k8sClientset.CoreV1(),
+		resourcelock.ResourceLockConfig{
+			Identity:      *leaderElectIdentity,
+			EventRecorder: recorder,
+		})
+	if err != nil {
+		panic(err)
+	}
+
+	// A standby replica has nothing to drain and exits right away on
+	// shutdown, the leader exits once run returns.
+	leading := make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		select {
+		case <-leading:
+		default:
+			glog.Flush()
+			os.Exit(0)
+		}
+	}()
 
-	<-ctx.Done()
+	// Volume managers which were being provisioned by the previous leader
+	// are picked up again by the new leader as they are still pending.
+	leaderelection.RunOrDie(leaderelection.LeaderElectionConfig{
+		Lock:          lock,
+		LeaseDuration: *leaseDuration,
+		RenewDeadline: *renewDeadline,
+		RetryPeriod:   *retryPeriod,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(stop <-chan struct{}) {
+				close(leading)
+				run(stop)
+			},
+			OnStoppedLeading: func() {
+				// Exit rather than risk reconciling along with the new leader.
+				glog.Fatalf("%s lost the leader election lease", *leaderElectIdentity)
+			},
+		},
+	})
 }
@@ -42,8 +42,13 @@ const (
 	// The plural form of the crd.
 	VolumeManagerResourcePlural string = "volumemanagers"
 
-	// The message for a successful volumemanager status.
-	SuccessfulVolumeStatusMessage string = "success"
+	// The finalizer which holds back the deletion of a volumemanager until
+	// all of its sub-resources are cleaned up.
+	CleanupFinalizer string = GroupName + "/cleanup"
+
+	// The annotation setting the download priority of the volume configs of
+	// a volumemanager which do not set their own.
+	PriorityAnnotation string = GroupName + "/priority"
 )
 
 var (
@@ -56,7 +61,6 @@ var (
 )
 
 // +genclient
-// +genclient:noStatus
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
 
 // Volumemanager is the spec for a VolumeManager CR
@@ -103,20 +107,117 @@ type VolumeConfig struct {
 	Tolerations  []corev1.Toleration `json:"tolerations"`
 	Labels       map[string]string   `json:"labels"`
 	Options      map[string]string   `json:"options"`
+	// Priority orders the downloads waiting for a free slot when the number
+	// of download pods is capped. Higher priorities are downloaded first.
+	Priority int `json:"priority,omitempty"`
 }
 
+// ProvisioningPolicy tells what happens to the volumes which were provisioned
+// when others of the same volume manager failed.
+type ProvisioningPolicy string
+
+const (
+	// ProvisioningPolicyAllOrNothing rolls back the volumes which were
+	// provisioned as soon as any other volume fails. It is the default.
+	ProvisioningPolicyAllOrNothing ProvisioningPolicy = "AllOrNothing"
+	// ProvisioningPolicyPartialSuccess keeps the volumes which were
+	// provisioned and leaves the volume manager running.
+	ProvisioningPolicyPartialSuccess ProvisioningPolicy = "PartialSuccess"
+)
+
 // VolumeManagerSpec is the spec for the crd.
 type VolumeManagerSpec struct {
-	VolumeConfigs []VolumeConfig `json:"volumeConfigs"`
-	State         states.State   `json:"state"`
+	VolumeConfigs      []VolumeConfig     `json:"volumeConfigs"`
+	State              states.State       `json:"state"`
+	ProvisioningPolicy ProvisioningPolicy `json:"provisioningPolicy,omitempty"`
 }
 
+// VolumePhase is the phase of a volume in its lifecycle.
+type VolumePhase string
+
+const (
+	// VolumeValidating means that the volume config is being validated.
+	VolumeValidating VolumePhase = "Validating"
+	// VolumeDownloading means that the data is being downloaded.
+	VolumeDownloading VolumePhase = "Downloading"
+	// VolumeLabeling means that the nodes holding the data are being
+	// labeled.
+	VolumeLabeling VolumePhase = "Labeling"
+	// VolumeReady means that the volume can be used.
+	VolumeReady VolumePhase = "Ready"
+	// VolumeFailed means that the volume could not be provisioned. The reason
+	// tells why.
+	VolumeFailed VolumePhase = "Failed"
+	// VolumeDeleting means that the sub-resources of the volume are being
+	// cleaned up.
+	VolumeDeleting VolumePhase = "Deleting"
+)
+
+// VolumeReason is a machine readable reason for the phase of a volume.
+type VolumeReason string
+
+const (
+	VolumeReasonProvisioned            VolumeReason = "Provisioned"
+	VolumeReasonInvalidOptions         VolumeReason = "InvalidOptions"
+	VolumeReasonCredentialsMissing     VolumeReason = "CredentialsMissing"
+	VolumeReasonInsufficientNodes      VolumeReason = "InsufficientNodes"
+	VolumeReasonNodeListFailed         VolumeReason = "NodeListFailed"
+	VolumeReasonResourceCreationFailed VolumeReason = "ResourceCreationFailed"
+	VolumeReasonDownloadFailed         VolumeReason = "DownloadFailed"
+	VolumeReasonDownloadTimeout        VolumeReason = "DownloadTimeout"
+	VolumeReasonPodLookupFailed        VolumeReason = "PodLookupFailed"
+	VolumeReasonNodeLabelingFailed     VolumeReason = "NodeLabelingFailed"
+	VolumeReasonCleanupFailed          VolumeReason = "CleanupFailed"
+	VolumeReasonAborted                VolumeReason = "Aborted"
+	VolumeReasonUnsupportedSourceType  VolumeReason = "UnsupportedSourceType"
+	VolumeReasonRolledBack             VolumeReason = "RolledBack"
+	VolumeReasonUnschedulable          VolumeReason = "Unschedulable"
+	VolumeReasonImagePullFailed        VolumeReason = "ImagePullFailed"
+	VolumeReasonCrashLoop              VolumeReason = "CrashLoop"
+	VolumeReasonPodFailed              VolumeReason = "PodFailed"
+)
+
 // Volume provides the details on volume source and node affinity.
 type Volume struct {
 	ID           string              `json:"id"`
 	VolumeSource corev1.VolumeSource `json:"volumeSource"`
 	NodeAffinity corev1.NodeAffinity `json:"nodeAffinity"`
+	Phase        VolumePhase         `json:"phase,omitempty"`
+	Reason       VolumeReason        `json:"reason,omitempty"`
 	Message      string              `json:"message,omitempty"`
+	// Config is the volume config the volume was provisioned from. The
+	// volume is compared with the spec and cleaned up using it, so that
+	// changes made to the spec while the controller is down are handled.
+	Config *VolumeConfig `json:"config,omitempty"`
+}
+
+// VolumeManagerConditionType is the type of a volume manager condition.
+type VolumeManagerConditionType string
+
+const (
+	// VolumeManagerValidated means that the spec has been validated.
+	VolumeManagerValidated VolumeManagerConditionType = "Validated"
+	// VolumeManagerProvisioning means that the sub-resources are being
+	// provisioned.
+	VolumeManagerProvisioning VolumeManagerConditionType = "Provisioning"
+	// VolumeManagerReady means that all the volumes can be used.
+	VolumeManagerReady VolumeManagerConditionType = "Ready"
+	// VolumeManagerDegraded means that the sub-resources of some volumes
+	// have drifted from the status and could not be repaired.
+	VolumeManagerDegraded VolumeManagerConditionType = "Degraded"
+	// VolumeManagerCleanupFailed means that the sub-resources of some
+	// volumes could not be cleaned up.
+	VolumeManagerCleanupFailed VolumeManagerConditionType = "CleanupFailed"
+)
+
+// VolumeManagerCondition describes the state of a volume manager at a certain
+// point.
+type VolumeManagerCondition struct {
+	Type               VolumeManagerConditionType `json:"type"`
+	Status             corev1.ConditionStatus     `json:"status"`
+	LastTransitionTime metav1.Time                `json:"lastTransitionTime,omitempty"`
+	Reason             string                     `json:"reason,omitempty"`
+	Message            string                     `json:"message,omitempty"`
 }
 
 // VolumeManagerStatus is the status for the crd.
@@ -124,6 +225,49 @@ type VolumeManagerStatus struct {
 	Volumes []Volume     `json:"volumes"`
 	State   states.State `json:"state,omitempty"`
 	Message string       `json:"message,omitempty"`
+	// ObservedGeneration is the generation of the spec the status was last
+	// computed for.
+	ObservedGeneration int64                    `json:"observedGeneration,omitempty"`
+	Conditions         []VolumeManagerCondition `json:"conditions,omitempty"`
+	// QueuePosition is the position of the first download of the volume
+	// manager waiting for a free slot, starting at 1. It is 0 when none of
+	// its downloads is waiting.
+	QueuePosition int `json:"queuePosition,omitempty"`
+}
+
+// GetCondition returns the condition with the supplied type or nil if it is
+// not set.
+func (s *VolumeManagerStatus) GetCondition(condType VolumeManagerConditionType) *VolumeManagerCondition {
+	for i := range s.Conditions {
+		if s.Conditions[i].Type == condType {
+			return &s.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// SetCondition adds or updates the condition with the supplied type. The
+// transition time is only changed if the status of the condition changes.
+func (s *VolumeManagerStatus) SetCondition(condType VolumeManagerConditionType, status corev1.ConditionStatus, reason, message string) {
+	condition := s.GetCondition(condType)
+	if condition == nil {
+		s.Conditions = append(s.Conditions, VolumeManagerCondition{Type: condType})
+		condition = &s.Conditions[len(s.Conditions)-1]
+	}
+
+	if condition.Status != status {
+		condition.Status = status
+		condition.LastTransitionTime = metav1.Now()
+	}
+	condition.Reason = reason
+	condition.Message = message
+}
+
+// IsConditionTrue returns true if the condition with the supplied type is set
+// and its status is true.
+func (s *VolumeManagerStatus) IsConditionTrue(condType VolumeManagerConditionType) bool {
+	condition := s.GetCondition(condType)
+	return condition != nil && condition.Status == corev1.ConditionTrue
 }
 
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
@@ -21,64 +21,372 @@ package controller
 import (
 	"context"
 	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
 
 	vckv1alpha1_client "github.com/IntelAI/vck/pkg/client/clientset/versioned"
 	vckv1alpha1_informer "github.com/IntelAI/vck/pkg/client/informers/externalversions"
-	"k8s.io/client-go/tools/cache"
+	"github.com/IntelAI/vck/pkg/metrics"
+)
+
+const (
+	// maxRetries is the number of times a key is retried with rate limited
+	// backoff before it is dropped out of the queue.
+	maxRetries = 5
+
+	// abortTimeout is the time given to the reconciles cancelled at the end
+	// of the shutdown grace period to return.
+	abortTimeout = 10 * time.Second
 )
 
-// Hooks is the callback interface that defines controller behavior.
-type Hooks interface {
-	Add(obj interface{})
-	Update(oldObj, newObj interface{})
-	Delete(obj interface{})
+// Reconciler is the callback interface that defines controller behavior.
+type Reconciler interface {
+	// Reconcile drives the object identified by the namespace/name key
+	// towards its desired state. Returning an error requeues the key. The
+	// context is cancelled when the object is deleted during the reconcile,
+	// and when the reconcile is still in flight once the shutdown grace
+	// period has passed.
+	Reconcile(ctx context.Context, key string) error
+}
+
+// heartbeatKey is the key of the heartbeat function in the context of a
+// reconcile.
+type heartbeatKey struct{}
+
+// WithHeartbeat returns a copy of the supplied context carrying the function
+// called by Heartbeat.
+func WithHeartbeat(ctx context.Context, heartbeat func()) context.Context {
+	return context.WithValue(ctx, heartbeatKey{}, heartbeat)
+}
+
+// Heartbeat records that the reconcile running with the supplied context is
+// still making progress, e.g. while it waits for a long data download, so that
+// the controller is not reported as not live meanwhile. It does nothing once
+// the context is done, or if the context carries no heartbeat function.
+func Heartbeat(ctx context.Context) {
+	if ctx.Err() != nil {
+		return
+	}
+	if heartbeat, ok := ctx.Value(heartbeatKey{}).(func()); ok {
+		heartbeat()
+	}
 }
 
 // handlerFuncs returns an instance of the handler functions type
-// needed to create an informer based on the supplied controller hooks.
-func handlerFuncs(h Hooks) cache.ResourceEventHandlerFuncs {
+// needed to create an informer. Every event only enqueues the key of the
+// object so that the work is done by the controller workers.
+func handlerFuncs(c *Controller) cache.ResourceEventHandlerFuncs {
 	return cache.ResourceEventHandlerFuncs{
-		AddFunc:    h.Add,
-		UpdateFunc: h.Update,
-		DeleteFunc: h.Delete,
+		AddFunc: c.enqueue,
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			if isBeingDeleted(newObj) && !isBeingDeleted(oldObj) {
+				c.cancel(newObj)
+			}
+			c.enqueue(newObj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			c.cancel(obj)
+			c.enqueue(obj)
+		},
 	}
 }
 
-// Controller watches a resource and delegates create/update/delete events
-// to a set of supplied callback functions.
+// isBeingDeleted returns true if the deletion timestamp of the supplied object
+// is set.
+func isBeingDeleted(obj interface{}) bool {
+	accessor, err := meta.Accessor(obj)
+	return err == nil && accessor.GetDeletionTimestamp() != nil
+}
+
+// Controller watches a resource and feeds create/update/delete events into
+// a rate limited workqueue which is drained by a fixed number of workers.
+// Every object is also requeued once per resync period so that drift from
+// the desired state is detected even when no event is received. When the
+// controller is stopped, the reconciles in flight are given the shutdown grace
+// period to finish.
 type Controller struct {
-	Hooks  Hooks
-	Client vckv1alpha1_client.Interface
+	Reconciler          Reconciler
+	Client              vckv1alpha1_client.Interface
+	Workers             int
+	ResyncPeriod        time.Duration
+	ShutdownGracePeriod time.Duration
+	queue               workqueue.RateLimitingInterface
+
+	// progressLock guards the fields below, which track whether the
+	// controller is running and whether the workers make progress.
+	progressLock sync.Mutex
+	running      bool
+	synced       bool
+	inFlight     int
+	lastProgress time.Time
+
+	// cancels holds the functions cancelling the contexts of the reconciles
+	// in flight, keyed by namespace/name.
+	cancels map[string]context.CancelFunc
+
+	// informerLock guards the informer of the volume managers, which is
+	// created by the first call to Informer.
+	informerLock sync.Mutex
+	factory      vckv1alpha1_informer.SharedInformerFactory
+	informer     cache.SharedIndexInformer
 }
 
 // New returns a new Controller.
-func New(hooks Hooks, client vckv1alpha1_client.Interface) *Controller {
+func New(reconciler Reconciler, client vckv1alpha1_client.Interface, workers int, resyncPeriod, shutdownGracePeriod time.Duration) *Controller {
 	return &Controller{
-		Hooks:  hooks,
-		Client: client,
+		Reconciler:          reconciler,
+		Client:              client,
+		Workers:             workers,
+		ResyncPeriod:        resyncPeriod,
+		ShutdownGracePeriod: shutdownGracePeriod,
+		queue:               workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "volumemanagers"),
+		lastProgress:        time.Now(),
+		cancels:             map[string]context.CancelFunc{},
 	}
 }
 
-// Run starts a resource controller
+// Ready returns an error if the controller is running but the cache of
+// volume managers has not been synced yet. A controller which has not been
+// started, e.g. a standby replica, is ready to take over.
+func (c *Controller) Ready() error {
+	c.progressLock.Lock()
+	defer c.progressLock.Unlock()
+
+	if c.running && !c.synced {
+		return fmt.Errorf("the VolumeManager cache has not been synced")
+	}
+	return nil
+}
+
+// Live returns an error if there is work for the workers but none of them
+// completed a reconcile or reported a heartbeat from a reconcile in flight
+// within the supplied timeout.
+func (c *Controller) Live(timeout time.Duration) error {
+	c.progressLock.Lock()
+	defer c.progressLock.Unlock()
+
+	if c.inFlight == 0 && c.queue.Len() == 0 {
+		return nil
+	}
+
+	if sinceProgress := time.Since(c.lastProgress); sinceProgress > timeout {
+		return fmt.Errorf("no reconcile made progress for %v with %d in flight and %d queued", sinceProgress, c.inFlight, c.queue.Len())
+	}
+	return nil
+}
+
+// Run starts a resource controller. Once the context is cancelled, no new
+// reconciles are started and Run returns when the reconciles in flight have
+// finished or the shutdown grace period has passed, whichever comes first.
 func (c *Controller) Run(ctx context.Context, namespace string) error {
-	/**
-	TODO: We spawn a goroutine with each onAdd hook. Investigate if that can be avoided by using something like:
-	https://github.com/kubernetes/sample-controller/blob/master/controller.go#L169-L173.
-	*/
 	fmt.Print("Started watching for VolumeManager CR objects.\n")
 
+	c.progressLock.Lock()
+	c.running = true
+	c.progressLock.Unlock()
+
 	// Watch objects
-	c.watch(ctx, namespace)
+	informer := c.watch(ctx, namespace)
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		c.queue.ShutDown()
+		return fmt.Errorf("timed out waiting for the VolumeManager cache to sync")
+	}
+
+	c.progressLock.Lock()
+	c.synced = true
+	c.progressLock.Unlock()
+
+	glog.Infof("starting %d VolumeManager workers", c.Workers)
+	var workers sync.WaitGroup
+	for i := 0; i < c.Workers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			wait.Until(func() { c.runWorker(ctx) }, time.Second, ctx.Done())
+		}()
+	}
 
 	<-ctx.Done()
-	return ctx.Err()
+	return c.drain(&workers)
 }
 
-func (c *Controller) watch(ctx context.Context, namespace string) {
+// drain stops the intake of new work and waits for the supplied workers to
+// finish their reconciles in flight for at most the shutdown grace period.
+// The reconciles still in flight after the grace period are cancelled, and
+// drain waits for them to return for at most abortTimeout, so that their
+// interruption can be recorded without racing with them.
+func (c *Controller) drain(workers *sync.WaitGroup) error {
+	c.progressLock.Lock()
+	inFlight := c.inFlight
+	c.progressLock.Unlock()
 
-	informer := vckv1alpha1_informer.NewFilteredSharedInformerFactory(c.Client, 0, namespace, nil)
-	informer.Vck().V1alpha1().VolumeManagers().Informer().AddEventHandler(handlerFuncs(c.Hooks))
+	glog.Infof("stopping the VolumeManager workers, waiting up to %v for %d reconciles in flight", c.ShutdownGracePeriod, inFlight)
+	c.queue.ShutDown()
 
-	go informer.Start(ctx.Done())
+	done := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		glog.Infof("all VolumeManager workers stopped")
+		return nil
+	case <-time.After(c.ShutdownGracePeriod):
+	}
+
+	c.progressLock.Lock()
+	inFlight = c.inFlight
+	for key, cancelFunc := range c.cancels {
+		glog.Infof("cancelling the reconcile of volume manager %s", key)
+		cancelFunc()
+	}
+	c.progressLock.Unlock()
+
+	select {
+	case <-done:
+		return fmt.Errorf("cancelled %d reconciles still in flight after the shutdown grace period of %v", inFlight, c.ShutdownGracePeriod)
+	case <-time.After(abortTimeout):
+		c.progressLock.Lock()
+		defer c.progressLock.Unlock()
+		return fmt.Errorf("%d reconciles still in flight %v after being cancelled", c.inFlight, abortTimeout)
+	}
+}
+
+// Informer returns the informer of the volume managers in the namespace, or
+// in all the namespaces if it is empty, which feeds the queue once Run has
+// started it. It can be shared with other readers of the volume managers,
+// e.g. the metrics, and has to be called with the namespace passed to Run.
+func (c *Controller) Informer(namespace string) cache.SharedIndexInformer {
+	c.informerLock.Lock()
+	defer c.informerLock.Unlock()
+
+	if c.informer == nil {
+		c.factory = vckv1alpha1_informer.NewFilteredSharedInformerFactory(c.Client, c.ResyncPeriod, namespace, nil)
+		c.informer = c.factory.Vck().V1alpha1().VolumeManagers().Informer()
+		c.informer.AddEventHandler(handlerFuncs(c))
+	}
+	return c.informer
+}
+
+func (c *Controller) watch(ctx context.Context, namespace string) cache.SharedIndexInformer {
+	informer := c.Informer(namespace)
+
+	c.informerLock.Lock()
+	factory := c.factory
+	c.informerLock.Unlock()
+	go factory.Start(ctx.Done())
+
+	return informer
+}
+
+// enqueue adds the namespace/name key of the supplied object to the queue.
+func (c *Controller) enqueue(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		glog.Errorf("could not get key for object %v: %v", obj, err)
+		return
+	}
+
+	c.progressLock.Lock()
+	if c.inFlight == 0 && c.queue.Len() == 0 {
+		// The workers were idle until now, which is not a lack of progress.
+		c.lastProgress = time.Now()
+	}
+	c.progressLock.Unlock()
+
+	c.queue.Add(key)
+}
+
+// cancel cancels the context of the reconcile in flight for the supplied
+// object, if any.
+func (c *Controller) cancel(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		return
+	}
+
+	c.progressLock.Lock()
+	defer c.progressLock.Unlock()
+	if cancelFunc, ok := c.cancels[key]; ok {
+		glog.Infof("cancelling the reconcile of volume manager %s", key)
+		cancelFunc()
+	}
+}
+
+// heartbeat records the progress reported by a reconcile in flight.
+func (c *Controller) heartbeat() {
+	c.progressLock.Lock()
+	c.lastProgress = time.Now()
+	c.progressLock.Unlock()
+}
+
+func (c *Controller) runWorker(ctx context.Context) {
+	for c.processNextItem(ctx) {
+	}
+}
+
+// processNextItem reconciles a single key from the queue. It returns false
+// only when the queue has been shut down or the context has been cancelled.
+func (c *Controller) processNextItem(ctx context.Context) bool {
+	key, quit := c.queue.Get()
+	if quit {
+		return false
+	}
+	// The queue guarantees that a key is never processed by two workers at
+	// the same time until Done is called.
+	defer c.queue.Done(key)
+
+	if ctx.Err() != nil {
+		// The queue still hands out the keys queued before it was shut
+		// down. They are left to the next leader, which lists all the
+		// volume managers when it starts.
+		return false
+	}
+
+	c.progressLock.Lock()
+	if c.inFlight == 0 {
+		// The workers were idle until now, which is not a lack of progress.
+		c.lastProgress = time.Now()
+	}
+	c.inFlight++
+	// The reconcile is not cancelled on shutdown right away, only once the
+	// grace period has passed.
+	reconcileCtx, cancelFunc := context.WithCancel(WithHeartbeat(context.Background(), c.heartbeat))
+	c.cancels[key.(string)] = cancelFunc
+	c.progressLock.Unlock()
+	defer func() {
+		c.progressLock.Lock()
+		c.inFlight--
+		c.lastProgress = time.Now()
+		delete(c.cancels, key.(string))
+		c.progressLock.Unlock()
+		cancelFunc()
+	}()
+
+	start := time.Now()
+	err := c.Reconciler.Reconcile(reconcileCtx, key.(string))
+	metrics.ObserveReconcile(start, err)
+	if err == nil {
+		c.queue.Forget(key)
+		return true
+	}
+
+	if c.queue.NumRequeues(key) < maxRetries {
+		glog.Warningf("error reconciling volume manager %v, retrying: %v", key, err)
+		c.queue.AddRateLimited(key)
+		return true
+	}
 
+	glog.Errorf("dropping volume manager %v out of the queue: %v", key, err)
+	c.queue.Forget(key)
+	return true
 }
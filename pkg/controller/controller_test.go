@@ -21,6 +21,7 @@ package controller
 import (
 	"context"
 	"testing"
+	"time"
 
 	vckv1alpha1 "github.com/IntelAI/vck/pkg/apis/vck/v1alpha1"
 	"github.com/IntelAI/vck/pkg/client/clientset/versioned/fake"
@@ -28,70 +29,234 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
-type FakeHook struct {
-	addCalled    bool
-	deleteCalled bool
-	updateCalled bool
-	counter      chan string
+type FakeReconciler struct {
+	keys chan string
 }
 
-func (f *FakeHook) Add(obj interface{}) {
-	f.counter <- "Add"
-	f.addCalled = true
-}
-
-func (f *FakeHook) Update(oldObj, newObj interface{}) {
-	f.counter <- "Update"
-	f.updateCalled = true
-}
-
-func (f *FakeHook) Delete(obj interface{}) {
-	f.counter <- "Delete"
-	f.deleteCalled = true
+func (f *FakeReconciler) Reconcile(ctx context.Context, key string) error {
+	f.keys <- key
+	return nil
 }
 
 func TestController(t *testing.T) {
 
-	// TODO: Add update and delete tests. They are for some reason not getting called.
+	// Create a channel to track the reconciled keys
+	keys := make(chan string, 3)
 
-	// Create a counter to track the calls
-	counter := make(chan string, 3)
-
-	// Fake hook to verify the calls
-	hook := FakeHook{counter: counter}
+	// Fake reconciler to verify the calls
+	reconciler := FakeReconciler{keys: keys}
 
 	// Get a context
 	ctx, cancelFunc := context.WithCancel(context.Background())
 	defer cancelFunc()
 
-	// Create a fake client to pass in to the informers
+	// Create a fake client with an existing CR to pass in to the informers
 	namespace := "test"
-	fakeClient := fake.NewSimpleClientset()
+	fakeClient := fake.NewSimpleClientset(&vckv1alpha1.VolumeManager{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "volume1",
+			Namespace: namespace,
+		},
+	})
 
-	volumeManagerClient := fakeClient.Vck().VolumeManagers(namespace)
-	controller := New(&hook, fakeClient)
+	controller := New(&reconciler, fakeClient, 2, 0, 0)
 
 	// Start the controller
 	go controller.Run(ctx, namespace)
 
-	// Create the CR using the fake client
-	volume, err := volumeManagerClient.Create(&vckv1alpha1.VolumeManager{
-		ObjectMeta: metav1.ObjectMeta{
-			Name: "volume1",
-		},
-	})
-	require.NotNil(t, volume)
-	require.Nil(t, err)
+	// The initial list of the informer should feed the queue.
+	require.Equal(t, "test/volume1", <-keys)
 
-	<-counter
-
-	volumeList, err := volumeManagerClient.List(metav1.ListOptions{})
+	volumeList, err := fakeClient.Vck().VolumeManagers(namespace).List(metav1.ListOptions{})
 	require.NotNil(t, volumeList)
 	require.Nil(t, err)
 
 	// Verify there's just 1 object.
 	require.Equal(t, 1, len(volumeList.Items))
+}
+
+func TestControllerEventsFeedQueue(t *testing.T) {
+	controller := New(&FakeReconciler{}, fake.NewSimpleClientset(), 1, 0, 0)
+	defer controller.queue.ShutDown()
+
+	volumeManager := &vckv1alpha1.VolumeManager{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "volume1",
+			Namespace: "test",
+		},
+	}
+	funcs := handlerFuncs(controller)
+
+	// Add, update and delete events for the same CR collapse into one key.
+	funcs.AddFunc(volumeManager)
+	funcs.UpdateFunc(volumeManager, volumeManager)
+	funcs.DeleteFunc(volumeManager)
+	require.Equal(t, 1, controller.queue.Len())
+
+	key, _ := controller.queue.Get()
+	require.Equal(t, "test/volume1", key)
+}
+
+func TestControllerHealth(t *testing.T) {
+	keys := make(chan string, 1)
+	controller := New(&FakeReconciler{keys: keys}, fake.NewSimpleClientset(), 1, 0, 0)
+	defer controller.queue.ShutDown()
+
+	// A controller which has not been started is ready and live.
+	require.Nil(t, controller.Ready())
+	require.Nil(t, controller.Live(time.Minute))
+
+	// A started controller is not ready until the cache has been synced.
+	controller.running = true
+	require.NotNil(t, controller.Ready())
+	controller.synced = true
+	require.Nil(t, controller.Ready())
+
+	// Queued work without progress within the timeout is not live.
+	controller.enqueue(&vckv1alpha1.VolumeManager{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "volume1",
+			Namespace: "test",
+		},
+	})
+	require.Nil(t, controller.Live(time.Minute))
+	controller.lastProgress = time.Now().Add(-2 * time.Minute)
+	require.NotNil(t, controller.Live(time.Minute))
+
+	// Completing a reconcile is progress.
+	require.True(t, controller.processNextItem(context.Background()))
+	require.Equal(t, "test/volume1", <-keys)
+	require.Nil(t, controller.Live(time.Minute))
+}
+
+// reconcilerFunc is a reconciler calling the function.
+type reconcilerFunc func(ctx context.Context, key string) error
+
+func (f reconcilerFunc) Reconcile(ctx context.Context, key string) error {
+	return f(ctx, key)
+}
+
+func TestControllerHeartbeat(t *testing.T) {
+	live := make(chan error, 2)
+	var controller *Controller
+	controller = New(reconcilerFunc(func(ctx context.Context, key string) error {
+		// A reconcile in flight without progress within the timeout is not
+		// live until it reports a heartbeat.
+		controller.progressLock.Lock()
+		controller.lastProgress = time.Now().Add(-2 * time.Minute)
+		controller.progressLock.Unlock()
+		live <- controller.Live(time.Minute)
+		Heartbeat(ctx)
+		live <- controller.Live(time.Minute)
+		return nil
+	}), fake.NewSimpleClientset(), 1, 0, 0)
+	defer controller.queue.ShutDown()
+
+	controller.enqueue(&vckv1alpha1.VolumeManager{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "volume1",
+			Namespace: "test",
+		},
+	})
+	require.True(t, controller.processNextItem(context.Background()))
+	require.NotNil(t, <-live)
+	require.Nil(t, <-live)
+
+	// Heartbeats are ignored once the context is done, and without a
+	// heartbeat function.
+	beats := 0
+	ctx, cancelFunc := context.WithCancel(WithHeartbeat(context.Background(), func() { beats++ }))
+	Heartbeat(ctx)
+	cancelFunc()
+	Heartbeat(ctx)
+	Heartbeat(context.Background())
+	require.Equal(t, 1, beats)
+}
+
+// blockingReconciler reports the reconciled keys and blocks until it is
+// released or its context is cancelled.
+type blockingReconciler struct {
+	keys      chan string
+	release   chan struct{}
+	cancelled chan string
+}
+
+func (b *blockingReconciler) Reconcile(ctx context.Context, key string) error {
+	b.keys <- key
+	select {
+	case <-b.release:
+	case <-ctx.Done():
+		b.cancelled <- key
+	}
+	return nil
+}
+
+func TestControllerDrain(t *testing.T) {
+	namespace := "test"
+	for _, finish := range []bool{true, false} {
+		t.Logf("Testing for reconcile finishing within the grace period: %v", finish)
+		reconciler := &blockingReconciler{keys: make(chan string, 2), release: make(chan struct{}), cancelled: make(chan string, 1)}
+		fakeClient := fake.NewSimpleClientset(
+			&vckv1alpha1.VolumeManager{ObjectMeta: metav1.ObjectMeta{Name: "volume1", Namespace: namespace}},
+			&vckv1alpha1.VolumeManager{ObjectMeta: metav1.ObjectMeta{Name: "volume2", Namespace: namespace}},
+		)
+		controller := New(reconciler, fakeClient, 1, 0, 100*time.Millisecond)
+
+		ctx, cancelFunc := context.WithCancel(context.Background())
+		errs := make(chan error)
+		go func() {
+			errs <- controller.Run(ctx, namespace)
+		}()
+
+		// The single worker is busy with the first key when the controller
+		// is stopped.
+		key := <-reconciler.keys
+		cancelFunc()
+		if finish {
+			close(reconciler.release)
+			require.Nil(t, <-errs)
+			require.Len(t, reconciler.cancelled, 0)
+		} else {
+			// The reconcile is cancelled after the grace period and Run
+			// returns once it has returned.
+			require.NotNil(t, <-errs)
+			require.Equal(t, key, <-reconciler.cancelled)
+		}
+
+		// The second key is never picked up.
+		require.Len(t, reconciler.keys, 0)
+	}
+}
+
+func TestControllerCancelsDeletedReconciles(t *testing.T) {
+	controller := New(&FakeReconciler{}, fake.NewSimpleClientset(), 1, 0, 0)
+	defer controller.queue.ShutDown()
+	funcs := handlerFuncs(controller)
+
+	volumeManager := &vckv1alpha1.VolumeManager{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "volume1",
+			Namespace: "test",
+		},
+	}
+	deletedVolumeManager := volumeManager.DeepCopy()
+	now := metav1.Now()
+	deletedVolumeManager.DeletionTimestamp = &now
+
+	// A reconcile in flight for the volume manager.
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	controller.cancels["test/volume1"] = cancelFunc
+
+	// Updates which do not delete the volume manager leave it running.
+	funcs.UpdateFunc(volumeManager, volumeManager)
+	funcs.UpdateFunc(deletedVolumeManager, deletedVolumeManager)
+	require.Nil(t, ctx.Err())
+
+	funcs.UpdateFunc(volumeManager, deletedVolumeManager)
+	require.Equal(t, context.Canceled, ctx.Err())
 
-	// Assert all of them were called.
-	require.True(t, hook.addCalled)
+	ctx, cancelFunc = context.WithCancel(context.Background())
+	controller.cancels["test/volume1"] = cancelFunc
+	funcs.DeleteFunc(volumeManager)
+	require.Equal(t, context.Canceled, ctx.Err())
 }
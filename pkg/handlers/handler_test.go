@@ -19,39 +19,85 @@
 package handlers
 
 import (
+	"context"
 	"fmt"
 	vckv1alpha1 "github.com/IntelAI/vck/pkg/apis/vck/v1alpha1"
 	"github.com/IntelAI/vck/pkg/resource"
 	"github.com/stretchr/testify/require"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 type testClient struct {
 	plural           string
 	listShouldFail   bool
 	createShouldFail bool
+	getNotFound      bool
+	deleted          []string
+	updated          int
+	listed           []resource.ListOptions
+	// The patches applied, prefixed with the name of the object.
+	patches []string
+	// pod is returned by Get instead of a node if set.
+	pod *corev1.Pod
+	// objects are returned by Get by name if set, until they are deleted.
+	objects map[string]runtime.Object
+	// nodeLabels are the labels of the node returned by List.
+	nodeLabels map[string]string
+	// lock guards the records of the calls made concurrently.
+	lock sync.Mutex
 }
 
 func (tc *testClient) Reify(templateValues interface{}) ([]byte, error) {
 	return []byte{}, nil
 }
 
-func (tc *testClient) Create(namespace string, templateValues interface{}) error {
+func (tc *testClient) Create(ctx context.Context, namespace string, templateValues interface{}) error {
 	if tc.createShouldFail {
 		return fmt.Errorf("create failed")
 	}
 	return nil
 }
 
-func (tc *testClient) Delete(namespace string, name string) error {
+func (tc *testClient) Delete(ctx context.Context, namespace string, name string) error {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	tc.deleted = append(tc.deleted, name)
 	return nil
 }
 
-func (tc *testClient) Get(namespace, name string) (runtime.Object, error) {
+func (tc *testClient) Get(ctx context.Context, namespace, name string) (runtime.Object, error) {
+	if tc.getNotFound {
+		return nil, errors.NewNotFound(schema.GroupResource{Resource: tc.plural}, name)
+	}
+	if tc.objects != nil {
+		tc.lock.Lock()
+		defer tc.lock.Unlock()
+		for _, deleted := range tc.deleted {
+			if deleted == name {
+				return nil, errors.NewNotFound(schema.GroupResource{Resource: tc.plural}, name)
+			}
+		}
+		if obj, ok := tc.objects[name]; ok {
+			return obj.DeepCopyObject(), nil
+		}
+		return nil, errors.NewNotFound(schema.GroupResource{Resource: tc.plural}, name)
+	}
+	if tc.pod != nil {
+		return tc.pod.DeepCopy(), nil
+	}
 	return &corev1.Node{
 		ObjectMeta: metav1.ObjectMeta{
 			Labels: map[string]string{},
@@ -59,25 +105,69 @@ func (tc *testClient) Get(namespace, name string) (runtime.Object, error) {
 	}, nil
 }
 
-func (tc *testClient) List(namespace string, labels map[string]string) ([]metav1.Object, error) {
+func (tc *testClient) List(ctx context.Context, namespace string, options resource.ListOptions) ([]metav1.Object, error) {
+	tc.listed = append(tc.listed, options)
 	if tc.listShouldFail {
 		return nil, fmt.Errorf("list failed")
 	}
-	return []metav1.Object{&corev1.Node{
+
+	// Apply the label selector as the API server would.
+	node := &corev1.Node{
 		ObjectMeta: metav1.ObjectMeta{
-			Name: "foo",
+			Name:   "foo",
+			Labels: tc.nodeLabels,
 		},
-	}}, nil
+	}
+	if !labels.SelectorFromSet(options.Labels).Matches(labels.Set(node.Labels)) {
+		return []metav1.Object{}, nil
+	}
+	return []metav1.Object{node}, nil
 }
 
-func (tc *testClient) Update(object runtime.Object) (runtime.Object, error) {
+func (tc *testClient) Update(ctx context.Context, object runtime.Object) (runtime.Object, error) {
+	tc.updated++
 	return nil, nil
 }
 
+func (tc *testClient) Patch(ctx context.Context, namespace, name string, patchType types.PatchType, data []byte) (runtime.Object, error) {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	tc.patches = append(tc.patches, name+" "+string(data))
+	return nil, nil
+}
+
+// Watch calls changed with the object returned by Get, which never changes.
+func (tc *testClient) Watch(ctx context.Context, namespace, name string, changed func(runtime.Object) (bool, error)) error {
+	obj, err := tc.Get(ctx, namespace, name)
+	if errors.IsNotFound(err) {
+		obj = nil
+	} else if err != nil {
+		return err
+	}
+
+	if done, err := changed(obj); done || err != nil {
+		return err
+	}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
 func (tc *testClient) Plural() string {
 	return tc.plural
 }
 
+// ignorePhase discards the phases reported by a data handler.
+func ignorePhase(phase vckv1alpha1.VolumePhase) {}
+
+// phaseRecorder records the phases reported by a data handler.
+type phaseRecorder struct {
+	phases []vckv1alpha1.VolumePhase
+}
+
+func (r *phaseRecorder) setPhase(phase vckv1alpha1.VolumePhase) {
+	r.phases = append(r.phases, phase)
+}
+
 func TestHandler(t *testing.T) {
 
 	namespace := "test"
@@ -95,19 +185,30 @@ func TestHandler(t *testing.T) {
 		volumeConfig  vckv1alpha1.VolumeConfig
 		handler       DataHandler
 		failedMessage string
+		failedReason  vckv1alpha1.VolumeReason
 	}{
 		// S3 handler
 		"[s3_handler] labels not set": {
 			volumeConfig:  vckv1alpha1.VolumeConfig{},
-			handler:       NewS3Handler(fakek8sClient, []resource.Client{fakePodClient, fakeNodeClient, fakePVClient, fakePVlient}),
+			handler:       NewS3Handler(fakek8sClient, []resource.Client{fakePodClient, fakeNodeClient, fakePVClient, fakePVlient}, &record.FakeRecorder{}, nil),
 			failedMessage: "labels cannot be empty",
+			failedReason:  vckv1alpha1.VolumeReasonInvalidOptions,
+		},
+		"[s3_handler] reserved label set": {
+			volumeConfig: vckv1alpha1.VolumeConfig{
+				Labels: map[string]string{resource.VolumeManagerUIDLabel: "uid"},
+			},
+			handler:       NewS3Handler(fakek8sClient, []resource.Client{fakePodClient, fakeNodeClient, fakePVClient, fakePVlient}, &record.FakeRecorder{}, nil),
+			failedMessage: "label vck.intelai.org/volume-manager-uid is reserved for the controller",
+			failedReason:  vckv1alpha1.VolumeReasonInvalidOptions,
 		},
 		"[s3_handler] awsCredentialsSecretName not set": {
 			volumeConfig: vckv1alpha1.VolumeConfig{
 				Labels: map[string]string{"foo": "bar"},
 			},
-			handler:       NewS3Handler(fakek8sClient, []resource.Client{fakePodClient, fakeNodeClient, fakePVClient, fakePVlient}),
+			handler:       NewS3Handler(fakek8sClient, []resource.Client{fakePodClient, fakeNodeClient, fakePVClient, fakePVlient}, &record.FakeRecorder{}, nil),
 			failedMessage: "awsCredentialsSecretName key has to be set in options",
+			failedReason:  vckv1alpha1.VolumeReasonCredentialsMissing,
 		},
 		"[s3_handler] Wrong access mode": {
 			volumeConfig: vckv1alpha1.VolumeConfig{
@@ -117,8 +218,9 @@ func TestHandler(t *testing.T) {
 				},
 				AccessMode: "ReadWriteMany",
 			},
-			handler:       NewS3Handler(fakek8sClient, []resource.Client{fakePodClient, fakeNodeClient, fakePVClient, fakePVlient}),
+			handler:       NewS3Handler(fakek8sClient, []resource.Client{fakePodClient, fakeNodeClient, fakePVClient, fakePVlient}, &record.FakeRecorder{}, nil),
 			failedMessage: "access mode has to be ReadWriteOnce",
+			failedReason:  vckv1alpha1.VolumeReasonInvalidOptions,
 		},
 		"[s3_handler] sourceURL not set": {
 			volumeConfig: vckv1alpha1.VolumeConfig{
@@ -128,8 +230,9 @@ func TestHandler(t *testing.T) {
 				},
 				AccessMode: "ReadWriteOnce",
 			},
-			handler:       NewS3Handler(fakek8sClient, []resource.Client{fakePodClient, fakeNodeClient, fakePVClient, fakePVlient}),
+			handler:       NewS3Handler(fakek8sClient, []resource.Client{fakePodClient, fakeNodeClient, fakePVClient, fakePVlient}, &record.FakeRecorder{}, nil),
 			failedMessage: "sourceURL has to be set in options",
+			failedReason:  vckv1alpha1.VolumeReasonInvalidOptions,
 		},
 		"[s3_handler] Wrong timeoutForDataDownload format": {
 			volumeConfig: vckv1alpha1.VolumeConfig{
@@ -141,8 +244,23 @@ func TestHandler(t *testing.T) {
 				},
 				AccessMode: "ReadWriteOnce",
 			},
-			handler:       NewS3Handler(fakek8sClient, []resource.Client{fakePodClient, fakeNodeClient, fakePVClient, fakePVlient}),
+			handler:       NewS3Handler(fakek8sClient, []resource.Client{fakePodClient, fakeNodeClient, fakePVClient, fakePVlient}, &record.FakeRecorder{}, nil),
 			failedMessage: "error while parsing timeout for data download",
+			failedReason:  vckv1alpha1.VolumeReasonInvalidOptions,
+		},
+		"[s3_handler] Wrong timeoutForScheduling format": {
+			volumeConfig: vckv1alpha1.VolumeConfig{
+				Labels: map[string]string{"foo": "bar"},
+				Options: map[string]string{
+					"awsCredentialsSecretName": "foobar",
+					"timeoutForScheduling":     "someunkownformat",
+					"sourceURL":                "s3://foo",
+				},
+				AccessMode: "ReadWriteOnce",
+			},
+			handler:       NewS3Handler(fakek8sClient, []resource.Client{fakePodClient, fakeNodeClient, fakePVClient, fakePVlient}, &record.FakeRecorder{}, nil),
+			failedMessage: "error while parsing timeout for scheduling",
+			failedReason:  vckv1alpha1.VolumeReasonInvalidOptions,
 		},
 		"[s3_handler] Node List Failing": {
 			volumeConfig: vckv1alpha1.VolumeConfig{
@@ -153,8 +271,9 @@ func TestHandler(t *testing.T) {
 				},
 				AccessMode: "ReadWriteOnce",
 			},
-			handler:       NewS3Handler(fakek8sClient, []resource.Client{fakePodClient, &testClient{plural: "nodes", listShouldFail: true}, fakePVClient, fakePVlient}),
+			handler:       NewS3Handler(fakek8sClient, []resource.Client{fakePodClient, &testClient{plural: "nodes", listShouldFail: true}, fakePVClient, fakePVlient}, &record.FakeRecorder{}, nil),
 			failedMessage: "error getting node list",
+			failedReason:  vckv1alpha1.VolumeReasonNodeListFailed,
 		},
 		"[s3_handler] replicas > Num nodes": {
 			volumeConfig: vckv1alpha1.VolumeConfig{
@@ -166,8 +285,9 @@ func TestHandler(t *testing.T) {
 				AccessMode: "ReadWriteOnce",
 				Replicas:   2,
 			},
-			handler:       NewS3Handler(fakek8sClient, []resource.Client{fakePodClient, fakeNodeClient, fakePVClient, fakePVlient}),
+			handler:       NewS3Handler(fakek8sClient, []resource.Client{fakePodClient, fakeNodeClient, fakePVClient, fakePVlient}, &record.FakeRecorder{}, nil),
 			failedMessage: "replicas [2] greater than number of nodes [1]",
+			failedReason:  vckv1alpha1.VolumeReasonInsufficientNodes,
 		},
 		"[s3_handler] Invalid distribution strategy": {
 			volumeConfig: vckv1alpha1.VolumeConfig{
@@ -180,8 +300,9 @@ func TestHandler(t *testing.T) {
 				AccessMode: "ReadWriteOnce",
 				Replicas:   1,
 			},
-			handler:       NewS3Handler(fakek8sClient, []resource.Client{fakePodClient, fakeNodeClient, fakePVClient, fakePVlient}),
+			handler:       NewS3Handler(fakek8sClient, []resource.Client{fakePodClient, fakeNodeClient, fakePVClient, fakePVlient}, &record.FakeRecorder{}, nil),
 			failedMessage: "invalid distributionStrategy",
+			failedReason:  vckv1alpha1.VolumeReasonInvalidOptions,
 		},
 		"[s3_handler] # replicas in distribution strategy != # replicas": {
 			volumeConfig: vckv1alpha1.VolumeConfig{
@@ -194,8 +315,9 @@ func TestHandler(t *testing.T) {
 				AccessMode: "ReadWriteOnce",
 				Replicas:   1,
 			},
-			handler:       NewS3Handler(fakek8sClient, []resource.Client{fakePodClient, fakeNodeClient, fakePVClient, fakePVlient}),
+			handler:       NewS3Handler(fakek8sClient, []resource.Client{fakePodClient, fakeNodeClient, fakePVClient, fakePVlient}, &record.FakeRecorder{}, nil),
 			failedMessage: "does not match number of replicas provided",
+			failedReason:  vckv1alpha1.VolumeReasonInvalidOptions,
 		},
 		"[s3_handler] Any create failed": {
 			volumeConfig: vckv1alpha1.VolumeConfig{
@@ -207,8 +329,9 @@ func TestHandler(t *testing.T) {
 				AccessMode: "ReadWriteOnce",
 				Replicas:   1,
 			},
-			handler:       NewS3Handler(fakek8sClient, []resource.Client{&testClient{plural: "pods", createShouldFail: true}, fakeNodeClient, fakePVClient, fakePVlient}),
+			handler:       NewS3Handler(fakek8sClient, []resource.Client{&testClient{plural: "pods", createShouldFail: true}, fakeNodeClient, fakePVClient, fakePVlient}, &record.FakeRecorder{}, nil),
 			failedMessage: "error during sub-resource",
+			failedReason:  vckv1alpha1.VolumeReasonResourceCreationFailed,
 		},
 		"[s3_handler] resync set and replicas > 1": {
 			volumeConfig: vckv1alpha1.VolumeConfig{
@@ -221,30 +344,34 @@ func TestHandler(t *testing.T) {
 				AccessMode: "ReadWriteOnce",
 				Replicas:   3,
 			},
-			handler:       NewS3Handler(fakek8sClient, []resource.Client{fakePodClient, fakeNodeClient, fakePVClient, fakePVlient}),
+			handler:       NewS3Handler(fakek8sClient, []resource.Client{fakePodClient, fakeNodeClient, fakePVClient, fakePVlient}, &record.FakeRecorder{}, nil),
 			failedMessage: "replicas cannot be > 1 when resync is set",
+			failedReason:  vckv1alpha1.VolumeReasonInvalidOptions,
 		},
 
 		// NFS handler
 		"[nfs_handler] labels not set": {
 			volumeConfig:  vckv1alpha1.VolumeConfig{},
-			handler:       NewNFSHandler(fakek8sClient, []resource.Client{fakePodClient, fakeNodeClient, fakePVClient, fakePVlient}),
+			handler:       NewNFSHandler(fakek8sClient, []resource.Client{fakePodClient, fakeNodeClient, fakePVClient, fakePVlient}, &record.FakeRecorder{}),
 			failedMessage: "labels cannot be empty",
+			failedReason:  vckv1alpha1.VolumeReasonInvalidOptions,
 		},
 		"[nfs_handler] server not set": {
 			volumeConfig: vckv1alpha1.VolumeConfig{
 				Labels: map[string]string{"foo": "bar"},
 			},
-			handler:       NewNFSHandler(fakek8sClient, []resource.Client{fakePodClient, fakeNodeClient, fakePVClient, fakePVlient}),
+			handler:       NewNFSHandler(fakek8sClient, []resource.Client{fakePodClient, fakeNodeClient, fakePVClient, fakePVlient}, &record.FakeRecorder{}),
 			failedMessage: "server has to be set in options",
+			failedReason:  vckv1alpha1.VolumeReasonInvalidOptions,
 		},
 		"[nfs_handler] path not set": {
 			volumeConfig: vckv1alpha1.VolumeConfig{
 				Labels:  map[string]string{"foo": "bar"},
 				Options: map[string]string{"server": "foo"},
 			},
-			handler:       NewNFSHandler(fakek8sClient, []resource.Client{fakePodClient, fakeNodeClient, fakePVClient, fakePVlient}),
+			handler:       NewNFSHandler(fakek8sClient, []resource.Client{fakePodClient, fakeNodeClient, fakePVClient, fakePVlient}, &record.FakeRecorder{}),
 			failedMessage: "path has to be set in options",
+			failedReason:  vckv1alpha1.VolumeReasonInvalidOptions,
 		},
 		"[nfs_handler] Wrong access mode": {
 			volumeConfig: vckv1alpha1.VolumeConfig{
@@ -255,8 +382,9 @@ func TestHandler(t *testing.T) {
 				},
 				AccessMode: "ReadWriteOnce",
 			},
-			handler:       NewNFSHandler(fakek8sClient, []resource.Client{fakePodClient, fakeNodeClient, fakePVClient, fakePVlient}),
+			handler:       NewNFSHandler(fakek8sClient, []resource.Client{fakePodClient, fakeNodeClient, fakePVClient, fakePVlient}, &record.FakeRecorder{}),
 			failedMessage: "access mode has to be either ReadWriteMany or ReadOnlyMany",
+			failedReason:  vckv1alpha1.VolumeReasonInvalidOptions,
 		},
 		"[nfs_handler] Any create failed": {
 			volumeConfig: vckv1alpha1.VolumeConfig{
@@ -267,30 +395,34 @@ func TestHandler(t *testing.T) {
 				},
 				AccessMode: "ReadWriteMany",
 			},
-			handler:       NewNFSHandler(fakek8sClient, []resource.Client{fakePodClient, fakeNodeClient, &testClient{plural: "persistentvolumeclaims", createShouldFail: true}, fakePVlient}),
+			handler:       NewNFSHandler(fakek8sClient, []resource.Client{fakePodClient, fakeNodeClient, &testClient{plural: "persistentvolumeclaims", createShouldFail: true}, fakePVlient}, &record.FakeRecorder{}),
 			failedMessage: "error during sub-resource",
+			failedReason:  vckv1alpha1.VolumeReasonResourceCreationFailed,
 		},
 
 		// Pachyderm handler
 		"[pachyderm_handler] labels not set": {
 			volumeConfig:  vckv1alpha1.VolumeConfig{},
-			handler:       NewPachydermHandler(fakek8sClient, []resource.Client{fakePodClient, fakeNodeClient, fakePVClient, fakePVlient}),
+			handler:       NewPachydermHandler(fakek8sClient, []resource.Client{fakePodClient, fakeNodeClient, fakePVClient, fakePVlient}, &record.FakeRecorder{}, nil),
 			failedMessage: "labels cannot be empty",
+			failedReason:  vckv1alpha1.VolumeReasonInvalidOptions,
 		},
 		"[pachyderm_handler] repo not set": {
 			volumeConfig: vckv1alpha1.VolumeConfig{
 				Labels: map[string]string{"foo": "bar"},
 			},
-			handler:       NewPachydermHandler(fakek8sClient, []resource.Client{fakePodClient, fakeNodeClient, fakePVClient, fakePVlient}),
+			handler:       NewPachydermHandler(fakek8sClient, []resource.Client{fakePodClient, fakeNodeClient, fakePVClient, fakePVlient}, &record.FakeRecorder{}, nil),
 			failedMessage: "repo has to be set in options",
+			failedReason:  vckv1alpha1.VolumeReasonInvalidOptions,
 		},
 		"[pachyderm_handler] branch not set": {
 			volumeConfig: vckv1alpha1.VolumeConfig{
 				Labels:  map[string]string{"foo": "bar"},
 				Options: map[string]string{"repo": "foo"},
 			},
-			handler:       NewPachydermHandler(fakek8sClient, []resource.Client{fakePodClient, fakeNodeClient, fakePVClient, fakePVlient}),
+			handler:       NewPachydermHandler(fakek8sClient, []resource.Client{fakePodClient, fakeNodeClient, fakePVClient, fakePVlient}, &record.FakeRecorder{}, nil),
 			failedMessage: "branch has to be set in options",
+			failedReason:  vckv1alpha1.VolumeReasonInvalidOptions,
 		},
 		"[pachyderm_handler] inputPathnot set": {
 			volumeConfig: vckv1alpha1.VolumeConfig{
@@ -300,8 +432,9 @@ func TestHandler(t *testing.T) {
 					"branch": "master",
 				},
 			},
-			handler:       NewPachydermHandler(fakek8sClient, []resource.Client{fakePodClient, fakeNodeClient, fakePVClient, fakePVlient}),
+			handler:       NewPachydermHandler(fakek8sClient, []resource.Client{fakePodClient, fakeNodeClient, fakePVClient, fakePVlient}, &record.FakeRecorder{}, nil),
 			failedMessage: "inputPath has to be set in options",
+			failedReason:  vckv1alpha1.VolumeReasonInvalidOptions,
 		},
 		"[pachyderm_handler] outputPath not set": {
 			volumeConfig: vckv1alpha1.VolumeConfig{
@@ -312,8 +445,9 @@ func TestHandler(t *testing.T) {
 					"inputPath": "s3/",
 				},
 			},
-			handler:       NewPachydermHandler(fakek8sClient, []resource.Client{fakePodClient, fakeNodeClient, fakePVClient, fakePVlient}),
+			handler:       NewPachydermHandler(fakek8sClient, []resource.Client{fakePodClient, fakeNodeClient, fakePVClient, fakePVlient}, &record.FakeRecorder{}, nil),
 			failedMessage: "outputPath has to be set in options",
+			failedReason:  vckv1alpha1.VolumeReasonInvalidOptions,
 		},
 		"[pachyderm_handler] Wrong access mode": {
 			volumeConfig: vckv1alpha1.VolumeConfig{
@@ -326,8 +460,9 @@ func TestHandler(t *testing.T) {
 				},
 				AccessMode: "ReadWriteMany",
 			},
-			handler:       NewPachydermHandler(fakek8sClient, []resource.Client{fakePodClient, fakeNodeClient, fakePVClient, fakePVlient}),
+			handler:       NewPachydermHandler(fakek8sClient, []resource.Client{fakePodClient, fakeNodeClient, fakePVClient, fakePVlient}, &record.FakeRecorder{}, nil),
 			failedMessage: "access mode has to be ReadWriteOnce",
+			failedReason:  vckv1alpha1.VolumeReasonInvalidOptions,
 		},
 		"[pachyderm_handler] replicas > Num nodes": {
 			volumeConfig: vckv1alpha1.VolumeConfig{
@@ -341,8 +476,9 @@ func TestHandler(t *testing.T) {
 				AccessMode: "ReadWriteOnce",
 				Replicas:   2,
 			},
-			handler:       NewPachydermHandler(fakek8sClient, []resource.Client{fakePodClient, fakeNodeClient, fakePVClient, fakePVlient}),
+			handler:       NewPachydermHandler(fakek8sClient, []resource.Client{fakePodClient, fakeNodeClient, fakePVClient, fakePVlient}, &record.FakeRecorder{}, nil),
 			failedMessage: "replicas [2] greater than number of nodes [1]",
+			failedReason:  vckv1alpha1.VolumeReasonInsufficientNodes,
 		},
 		"[pachyderm_handler] Any create failed": {
 			volumeConfig: vckv1alpha1.VolumeConfig{
@@ -356,18 +492,1052 @@ func TestHandler(t *testing.T) {
 				AccessMode: "ReadWriteOnce",
 				Replicas:   1,
 			},
-			handler:       NewPachydermHandler(fakek8sClient, []resource.Client{&testClient{plural: "pods", createShouldFail: true}, fakeNodeClient, fakePVClient, fakePVlient}),
+			handler:       NewPachydermHandler(fakek8sClient, []resource.Client{&testClient{plural: "pods", createShouldFail: true}, fakeNodeClient, fakePVClient, fakePVlient}, &record.FakeRecorder{}, nil),
 			failedMessage: "error during sub-resource",
+			failedReason:  vckv1alpha1.VolumeReasonResourceCreationFailed,
 		},
 	}
 
 	for key, tc := range testCases {
 		t.Logf("Testing for: %v", key)
-		volume := tc.handler.OnAdd(namespace, tc.volumeConfig, ownerRef)
+		volume := tc.handler.OnAdd(context.Background(), namespace, tc.volumeConfig, ownerRef, ignorePhase)
 
 		// Assert stuff
 		require.NotNil(t, volume)
-		require.NotEqual(t, volume.Message, vckv1alpha1.SuccessfulVolumeStatusMessage)
 		require.Contains(t, volume.Message, tc.failedMessage)
+		require.Equal(t, vckv1alpha1.VolumeFailed, volume.Phase)
+		require.Equal(t, tc.failedReason, volume.Reason)
+
+		// Validate rejects the same volume configs as OnAdd up front.
+		err := tc.handler.Validate(namespace, tc.volumeConfig)
+		if tc.failedReason == vckv1alpha1.VolumeReasonInvalidOptions || tc.failedReason == vckv1alpha1.VolumeReasonCredentialsMissing {
+			require.NotNil(t, err)
+			require.Equal(t, volume, InvalidVolume(tc.volumeConfig.ID, err))
+		} else {
+			require.Nil(t, err)
+		}
+	}
+}
+
+// replicaPods returns the download pod of replica 0 of volume vol1 of the
+// volume manager vm, scheduled on node foo, along with its check pod which
+// terminated with the supplied phase and exit code.
+func replicaPods(checkPhase corev1.PodPhase, checkExitCode int32) map[string]runtime.Object {
+	ownerRef := metav1.OwnerReference{Name: "vm"}
+	return map[string]runtime.Object{
+		vckNameFor(ownerRef, "vol1", "add", "0"): &corev1.Pod{
+			Spec:   corev1.PodSpec{NodeName: "foo"},
+			Status: corev1.PodStatus{Phase: corev1.PodSucceeded},
+		},
+		vckNameFor(ownerRef, "vol1", "check", "0"): &corev1.Pod{
+			Spec: corev1.PodSpec{NodeName: "foo"},
+			Status: corev1.PodStatus{
+				Phase: checkPhase,
+				ContainerStatuses: []corev1.ContainerStatus{
+					{Name: "check", State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: checkExitCode}}},
+				},
+			},
+		},
 	}
 }
+
+func TestHandlerOnRepair(t *testing.T) {
+
+	namespace := "test"
+	nodeLabelKey := "vck.intelai.org/test-vm-vol1"
+
+	// Create fake clients
+	fakek8sClient := fake.NewSimpleClientset()
+
+	ownerRef := metav1.OwnerReference{Name: "vm"}
+	volumeConfig := vckv1alpha1.VolumeConfig{
+		ID:       "vol1",
+		Replicas: 1,
+	}
+	pvcVolume := vckv1alpha1.Volume{
+		ID: "vol1",
+		VolumeSource: corev1.VolumeSource{
+			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+				ClaimName: "foo",
+			},
+		},
+	}
+	hostPathVolume := vckv1alpha1.Volume{
+		ID: "vol1",
+		VolumeSource: corev1.VolumeSource{
+			HostPath: &corev1.HostPathVolumeSource{
+				Path: "/var/datasets/foo",
+			},
+		},
+	}
+
+	testCases := map[string]struct {
+		volume         vckv1alpha1.Volume
+		volumeConfig   vckv1alpha1.VolumeConfig
+		podClient      *testClient
+		nodeClient     *testClient
+		pvClient       *testClient
+		pvcClient      *testClient
+		handler        string
+		expectedRepair []string
+		expectedErr    string
+		// The objects expected to be deleted by each client.
+		expectedPodDeletes []string
+		expectedPVDeletes  []string
+		expectedPatches    []string
+	}{
+		"[nfs_handler] in sync": {
+			volume:    pvcVolume,
+			pvClient:  &testClient{plural: "persistentvolumes", objects: map[string]runtime.Object{"foo": &corev1.PersistentVolume{}}},
+			pvcClient: &testClient{plural: "persistentvolumeclaims", objects: map[string]runtime.Object{"foo": &corev1.PersistentVolumeClaim{}}},
+		},
+		"[nfs_handler] pvc deleted": {
+			volume:            pvcVolume,
+			pvClient:          &testClient{plural: "persistentvolumes", objects: map[string]runtime.Object{"foo": &corev1.PersistentVolume{}}},
+			pvcClient:         &testClient{plural: "persistentvolumeclaims", objects: map[string]runtime.Object{}},
+			expectedRepair:    []string{"sub-resource [persistentvolumeclaims] foo not found, recreated the PV and the PVC"},
+			expectedPVDeletes: []string{"foo"},
+		},
+		"[nfs_handler] nothing provisioned": {
+			volume:    vckv1alpha1.Volume{ID: "vol1"},
+			pvcClient: &testClient{plural: "persistentvolumeclaims", getNotFound: true},
+		},
+		"[s3_handler] node label removed": {
+			volume:             hostPathVolume,
+			podClient:          &testClient{plural: "pods", objects: replicaPods(corev1.PodSucceeded, 0)},
+			handler:            "s3",
+			expectedRepair:     []string{"node foo holding replica 0 of volume vol1 labeled again with " + nodeLabelKey},
+			expectedPodDeletes: []string{vckNameFor(ownerRef, "vol1", "check", "0")},
+			expectedPatches:    []string{`foo {"metadata":{"labels":{"` + nodeLabelKey + `":"true"}}}`},
+		},
+		"[s3_handler] check inconclusive": {
+			volume:             hostPathVolume,
+			podClient:          &testClient{plural: "pods", objects: replicaPods(corev1.PodFailed, 1)},
+			handler:            "s3",
+			expectedPodDeletes: []string{vckNameFor(ownerRef, "vol1", "check", "0")},
+		},
+		"[s3_handler] node of the replica unknown": {
+			volume:    hostPathVolume,
+			podClient: &testClient{plural: "pods", objects: map[string]runtime.Object{}},
+			handler:   "s3",
+		},
+		"[s3_handler] data missing with a distributionStrategy": {
+			volume: hostPathVolume,
+			volumeConfig: vckv1alpha1.VolumeConfig{
+				ID:       "vol1",
+				Replicas: 1,
+				Options:  map[string]string{"distributionStrategy": `{"*": 1}`},
+			},
+			podClient:          &testClient{plural: "pods", objects: replicaPods(corev1.PodFailed, dataMissingExitCode)},
+			nodeClient:         &testClient{plural: "nodes", nodeLabels: map[string]string{nodeLabelKey: "true"}},
+			handler:            "s3",
+			expectedErr:        "data of replicas [0] of volume vol1 is missing and cannot be downloaded again",
+			expectedPodDeletes: []string{vckNameFor(ownerRef, "vol1", "check", "0")},
+			expectedPatches:    []string{`foo {"metadata":{"labels":{"` + nodeLabelKey + `":null}}}`},
+		},
+		"[pachyderm_handler] data missing and download failed": {
+			volume:             hostPathVolume,
+			podClient:          &testClient{plural: "pods", objects: replicaPods(corev1.PodFailed, dataMissingExitCode)},
+			handler:            "pachyderm",
+			expectedErr:        "error downloading replicas [0] of volume vol1 again: labels cannot be empty",
+			expectedPodDeletes: []string{vckNameFor(ownerRef, "vol1", "check", "0"), vckNameFor(ownerRef, "vol1", "add", "0")},
+		},
+	}
+
+	for key, tc := range testCases {
+		t.Logf("Testing for: %v", key)
+		if tc.volumeConfig.ID == "" {
+			tc.volumeConfig = volumeConfig
+		}
+		tc.podClient = clientOrDefault(tc.podClient, "pods")
+		tc.nodeClient = clientOrDefault(tc.nodeClient, "nodes")
+		tc.pvClient = clientOrDefault(tc.pvClient, "persistentvolumes")
+		tc.pvcClient = clientOrDefault(tc.pvcClient, "persistentvolumeclaims")
+
+		resourceClients := []resource.Client{tc.podClient, tc.nodeClient, tc.pvClient, tc.pvcClient}
+		var handler DataHandler
+		switch tc.handler {
+		case "s3":
+			handler = NewS3Handler(fakek8sClient, resourceClients, &record.FakeRecorder{}, nil)
+		case "pachyderm":
+			handler = NewPachydermHandler(fakek8sClient, resourceClients, &record.FakeRecorder{}, nil)
+		default:
+			handler = NewNFSHandler(fakek8sClient, resourceClients, &record.FakeRecorder{})
+		}
+		repaired, err := handler.OnRepair(context.Background(), namespace, tc.volumeConfig, tc.volume, ownerRef)
+
+		// Assert stuff
+		if tc.expectedErr == "" {
+			require.Nil(t, err)
+		} else {
+			require.NotNil(t, err)
+			require.Equal(t, tc.expectedErr, err.Error())
+		}
+		if len(tc.expectedRepair) == 0 {
+			require.Empty(t, repaired)
+		} else {
+			require.Equal(t, tc.expectedRepair, repaired)
+		}
+		require.Equal(t, tc.expectedPodDeletes, tc.podClient.deleted)
+		require.Equal(t, tc.expectedPVDeletes, tc.pvClient.deleted)
+		require.Equal(t, tc.expectedPatches, tc.nodeClient.patches)
+	}
+}
+
+// clientOrDefault returns the supplied test client, or a new one for the
+// plural if nil.
+func clientOrDefault(client *testClient, plural string) *testClient {
+	if client == nil {
+		return &testClient{plural: plural}
+	}
+	return client
+}
+
+func TestRepairHostPathVolume(t *testing.T) {
+	ownerRef := metav1.OwnerReference{Name: "vm"}
+	nodeLabelKey := "vck.intelai.org/test-vm-vol1"
+	vc := vckv1alpha1.VolumeConfig{ID: "vol1", Replicas: 2}
+	vStatus := vckv1alpha1.Volume{
+		ID: "vol1",
+		VolumeSource: corev1.VolumeSource{
+			HostPath: &corev1.HostPathVolumeSource{
+				Path: "/var/datasets/foo",
+			},
+		},
+	}
+
+	// Replica 0 is still on node foo while the node of replica 1 is gone.
+	pods := replicaPods(corev1.PodSucceeded, 0)
+	pods[vckNameFor(ownerRef, "vol1", "add", "1")] = &corev1.Pod{
+		Spec:   corev1.PodSpec{NodeName: "bar"},
+		Status: corev1.PodStatus{Phase: corev1.PodSucceeded},
+	}
+	podClient := &testClient{plural: "pods", objects: pods}
+	nodeClient := &testClient{plural: "nodes", nodeLabels: map[string]string{nodeLabelKey: "true", "kubernetes.io/hostname": "foo"}}
+
+	var redownloaded []int
+	var excluded []string
+	redownload := func(replicas []int, excludedNodes []string) error {
+		redownloaded, excluded = replicas, excludedNodes
+		return nil
+	}
+
+	repaired, err := repairHostPathVolume(context.Background(), podClient, nodeClient, &record.FakeRecorder{}, "test", vc, vStatus, ownerRef, nodeLabelKey, redownload)
+	require.Nil(t, err)
+	require.Equal(t, []string{"data of replicas [1] of volume vol1 was missing and downloaded again"}, repaired)
+	require.Equal(t, []int{1}, redownloaded)
+	require.Equal(t, []string{"foo"}, excluded)
+	require.Equal(t, []string{vckNameFor(ownerRef, "vol1", "check", "0"), vckNameFor(ownerRef, "vol1", "add", "1")}, podClient.deleted)
+	require.Empty(t, nodeClient.patches)
+}
+
+func TestHandlerOnDelete(t *testing.T) {
+
+	namespace := "test"
+
+	// Create fake clients
+	fakek8sClient := fake.NewSimpleClientset()
+	fakePodClient := &testClient{plural: "pods"}
+	fakeNodeClient := &testClient{plural: "nodes"}
+	fakePVlient := &testClient{plural: "persistentvolumes"}
+	fakePVClient := &testClient{plural: "persistentvolumeclaims"}
+
+	ownerRef := metav1.OwnerReference{Name: "vm"}
+	volumeConfig := vckv1alpha1.VolumeConfig{
+		ID:     "vol1",
+		Labels: map[string]string{"foo": "bar"},
+	}
+
+	testCases := map[string]struct {
+		handler      DataHandler
+		expectedFail bool
+	}{
+		"[nfs_handler] cleaned up": {
+			handler: NewNFSHandler(fakek8sClient, []resource.Client{fakePodClient, fakeNodeClient, fakePVClient, fakePVlient}, &record.FakeRecorder{}),
+		},
+		"[nfs_handler] PVC List Failing": {
+			handler:      NewNFSHandler(fakek8sClient, []resource.Client{fakePodClient, fakeNodeClient, &testClient{plural: "persistentvolumeclaims", listShouldFail: true}, fakePVlient}, &record.FakeRecorder{}),
+			expectedFail: true,
+		},
+		"[s3_handler] Node List Failing": {
+			handler:      NewS3Handler(fakek8sClient, []resource.Client{fakePodClient, &testClient{plural: "nodes", listShouldFail: true}, fakePVClient, fakePVlient}, &record.FakeRecorder{}, nil),
+			expectedFail: true,
+		},
+		"[pachyderm_handler] Pod List Failing": {
+			handler:      NewPachydermHandler(fakek8sClient, []resource.Client{&testClient{plural: "pods", listShouldFail: true}, fakeNodeClient, fakePVClient, fakePVlient}, &record.FakeRecorder{}, nil),
+			expectedFail: true,
+		},
+	}
+
+	for key, tc := range testCases {
+		t.Logf("Testing for: %v", key)
+		err := tc.handler.OnDelete(context.Background(), namespace, volumeConfig, vckv1alpha1.Volume{ID: "vol1"}, ownerRef)
+
+		// Assert stuff
+		if tc.expectedFail {
+			require.NotNil(t, err)
+			continue
+		}
+		require.Nil(t, err)
+	}
+}
+
+func TestHandlerOnDeleteSelectors(t *testing.T) {
+	fakek8sClient := fake.NewSimpleClientset()
+	ownerRef := metav1.OwnerReference{Name: "vm", UID: "uid"}
+	volumeConfig := vckv1alpha1.VolumeConfig{
+		ID:     "vol1",
+		Labels: map[string]string{"foo": "bar"},
+	}
+	podLabels := map[string]string{"foo": "bar", resource.VolumeManagerUIDLabel: "uid"}
+	nodeLabels := map[string]string{"vck.intelai.org/test-vm-vol1": "true"}
+
+	testCases := map[string]func(podClient, nodeClient resource.Client) DataHandler{
+		"[s3_handler]": func(podClient, nodeClient resource.Client) DataHandler {
+			return NewS3Handler(fakek8sClient, []resource.Client{podClient, nodeClient}, &record.FakeRecorder{}, nil)
+		},
+		"[pachyderm_handler]": func(podClient, nodeClient resource.Client) DataHandler {
+			return NewPachydermHandler(fakek8sClient, []resource.Client{podClient, nodeClient}, &record.FakeRecorder{}, nil)
+		},
+	}
+
+	for key, newHandler := range testCases {
+		t.Logf("Testing for: %v", key)
+		podClient := &testClient{plural: "pods"}
+		nodeClient := &testClient{plural: "nodes"}
+		err := newHandler(podClient, nodeClient).OnDelete(context.Background(), "test", volumeConfig, vckv1alpha1.Volume{ID: "vol1"}, ownerRef)
+		require.Nil(t, err)
+
+		// Only the pods of the volume and the nodes carrying its label are
+		// listed, none of which matches the fake objects.
+		require.Equal(t, []resource.ListOptions{{Labels: podLabels}}, podClient.listed)
+		require.Equal(t, []resource.ListOptions{{Labels: nodeLabels}}, nodeClient.listed)
+		require.Empty(t, podClient.deleted)
+		require.Equal(t, 0, nodeClient.updated)
+		require.Empty(t, nodeClient.patches)
+	}
+}
+
+func TestSubResourceLabels(t *testing.T) {
+	// The labels of a volume cannot select the sub-resources of another
+	// volume manager.
+	volumeConfig := vckv1alpha1.VolumeConfig{
+		Labels: map[string]string{"foo": "bar", resource.VolumeManagerUIDLabel: "other"},
+	}
+	labels := subResourceLabels(volumeConfig, metav1.OwnerReference{UID: "uid"})
+	require.Equal(t, map[string]string{"foo": "bar", resource.VolumeManagerUIDLabel: "uid"}, labels)
+	require.Equal(t, "other", volumeConfig.Labels[resource.VolumeManagerUIDLabel])
+}
+
+func TestVCKNameFor(t *testing.T) {
+	controllerRef := metav1.OwnerReference{UID: "3f1c2a5e-0b8d-11e8-ba89-0ed5f89f718b"}
+
+	// The name is stable for a volume and unique among volumes.
+	name := vckNameFor(controllerRef, "vol1", "add", "0")
+	require.Equal(t, name, vckNameFor(controllerRef, "vol1", "add", "0"))
+	require.NotEqual(t, name, vckNameFor(controllerRef, "vol2", "add", "0"))
+	require.NotEqual(t, name, vckNameFor(controllerRef, "vol1", "add", "1"))
+	require.NotEqual(t, name, vckNameFor(metav1.OwnerReference{UID: "other"}, "vol1", "add", "0"))
+
+	// The name is a valid DNS label regardless of the volume ID.
+	name = vckNameFor(controllerRef, "A_Very_Long_Volume_ID_Which_Is_Not_A_Valid_Name_On_Its_Own", "delete", "10")
+	require.Regexp(t, "^[a-z0-9]([-a-z0-9]*[a-z0-9])?$", name)
+	require.True(t, len(name) <= 63)
+}
+
+func TestHandlerEvents(t *testing.T) {
+	fakek8sClient := fake.NewSimpleClientset()
+	recorder := record.NewFakeRecorder(10)
+	handler := NewNFSHandler(fakek8sClient, []resource.Client{&testClient{plural: "nodes"}, &testClient{plural: "persistentvolumes"}, &testClient{plural: "persistentvolumeclaims"}}, recorder)
+	ownerRef := metav1.OwnerReference{Name: "vm", UID: "uid"}
+
+	volume := handler.OnAdd(context.Background(), "test", vckv1alpha1.VolumeConfig{
+		ID:     "vol1",
+		Labels: map[string]string{"foo": "bar"},
+		Options: map[string]string{
+			"server": "foo",
+			"path":   "/",
+		},
+		AccessMode: "ReadWriteMany",
+	}, ownerRef, ignorePhase)
+	require.Equal(t, vckv1alpha1.VolumeReady, volume.Phase)
+	require.Empty(t, volume.Message)
+
+	// Every sub-resource created is recorded on the volume manager.
+	vckName := vckNameFor(ownerRef, "vol1")
+	require.Equal(t, fmt.Sprintf("Normal ResourceCreated created persistentvolumes %s for volume vol1", vckName), <-recorder.Events)
+	require.Equal(t, fmt.Sprintf("Normal ResourceCreated created persistentvolumeclaims %s for volume vol1", vckName), <-recorder.Events)
+}
+
+// failedPod returns a pod which could not be scheduled at first, then whose
+// init container succeeded and whose main container was OOMKilled.
+func failedPod() *corev1.Pod {
+	return &corev1.Pod{
+		Status: corev1.PodStatus{
+			Phase: corev1.PodFailed,
+			Conditions: []corev1.PodCondition{
+				{Type: corev1.PodScheduled, Status: corev1.ConditionFalse, Reason: "Unschedulable", Message: "0/1 nodes are available"},
+			},
+			InitContainerStatuses: []corev1.ContainerStatus{
+				{Name: "init", State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{Reason: "Completed"}}},
+			},
+			ContainerStatuses: []corev1.ContainerStatus{
+				{Name: "download", State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{Reason: "OOMKilled", ExitCode: 137}}},
+				{Name: "sidecar", State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "ImagePullBackOff", Message: "image not found"}}},
+			},
+		},
+	}
+}
+
+func TestPodDiagnostics(t *testing.T) {
+	logs := func(ns, podName, containerName string) (string, error) {
+		switch containerName {
+		case "init":
+			return "", nil
+		case "download":
+			return strings.Repeat("x", maxContainerLogLength) + "killed\n", nil
+		}
+		return "", fmt.Errorf("container %s has not started", containerName)
+	}
+
+	testCases := map[string]struct {
+		podClient           resource.Client
+		expectedDiagnostics string
+	}{
+		"failed pod": {
+			podClient: &testClient{plural: "pods", pod: failedPod()},
+			expectedDiagnostics: "pod not scheduled: Unschedulable: 0/1 nodes are available; " +
+				"container download terminated: OOMKilled (exit code 137); " +
+				"container sidecar waiting: ImagePullBackOff: image not found; " +
+				"logs of container download: ..." + strings.Repeat("x", maxContainerLogLength-len("killed")) + "killed",
+		},
+		"pod not found": {
+			podClient: &testClient{plural: "pods", getNotFound: true},
+		},
+	}
+
+	for key, tc := range testCases {
+		t.Logf("Testing for: %v", key)
+		diagnostics := podDiagnostics(context.Background(), tc.podClient, logs, "test", "pod1")
+		require.Equal(t, tc.expectedDiagnostics, diagnostics)
+	}
+
+	require.Equal(t, "timed out", withDiagnostics("timed out", ""))
+	require.Equal(t, "timed out (logs)", withDiagnostics("timed out", "logs"))
+}
+
+func TestDownloadFailedDiagnostics(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	podClient := &testClient{plural: "pods", pod: failedPod()}
+	handler := NewS3Handler(fake.NewSimpleClientset(), []resource.Client{podClient, &testClient{plural: "nodes"}}, recorder, nil).(*s3Handler)
+	handler.logs = func(ns, podName, containerName string) (string, error) {
+		return "out of memory", nil
+	}
+	ownerRef := metav1.OwnerReference{Name: "vm", UID: "uid"}
+	phases := &phaseRecorder{}
+
+	volume := handler.OnAdd(context.Background(), "test", vckv1alpha1.VolumeConfig{
+		ID:         "vol1",
+		Replicas:   1,
+		Labels:     map[string]string{"foo": "bar"},
+		AccessMode: "ReadWriteOnce",
+		Options: map[string]string{
+			"awsCredentialsSecretName": "foobar",
+			"sourceURL":                "s3://foo",
+		},
+	}, ownerRef, phases.setPhase)
+
+	// The failed pod is detected without waiting for the download timeout.
+	// The reasons of the failure and the logs are part of the volume status
+	// and of the event.
+	vckName := vckNameFor(ownerRef, "vol1", "add", "0")
+	diagnostics := "pod not scheduled: Unschedulable: 0/1 nodes are available; " +
+		"container download terminated: OOMKilled (exit code 137); " +
+		"container sidecar waiting: ImagePullBackOff: image not found; " +
+		"logs of container init: out of memory; logs of container download: out of memory"
+	require.Equal(t, vckv1alpha1.VolumeFailed, volume.Phase)
+	require.Equal(t, vckv1alpha1.VolumeReasonPodFailed, volume.Reason)
+	require.Equal(t, []vckv1alpha1.VolumePhase{vckv1alpha1.VolumeDownloading}, phases.phases)
+	require.Equal(t, fmt.Sprintf("error during data download using pod [name: %s]: pod failed (%s)", vckName, diagnostics), volume.Message)
+	require.Equal(t, fmt.Sprintf("Normal PodCreated created download pod %s for volume vol1", vckName), <-recorder.Events)
+	require.Equal(t, fmt.Sprintf("Warning DownloadFailed replica 0 of volume vol1 failed using pod %s: pod failed (%s)", vckName, diagnostics), <-recorder.Events)
+}
+
+func TestCleanupFailedDiagnostics(t *testing.T) {
+	logs := func(ns, podName, containerName string) (string, error) {
+		return "permission denied", nil
+	}
+	ownerRef := metav1.OwnerReference{Name: "vm", UID: "uid"}
+	vc := vckv1alpha1.VolumeConfig{
+		ID:       "vol1",
+		Replicas: 1,
+		Labels:   map[string]string{"foo": "bar"},
+	}
+	vStatus := vckv1alpha1.Volume{
+		ID: "vol1",
+		VolumeSource: corev1.VolumeSource{
+			HostPath: &corev1.HostPathVolumeSource{Path: "/var/datasets/vck-resource-uid"},
+		},
+	}
+
+	testCases := map[string]func(podClient resource.Client, recorder record.EventRecorder) DataHandler{
+		"[s3_handler]": func(podClient resource.Client, recorder record.EventRecorder) DataHandler {
+			handler := NewS3Handler(fake.NewSimpleClientset(), []resource.Client{podClient, &testClient{plural: "nodes"}}, recorder, nil).(*s3Handler)
+			handler.logs = logs
+			return handler
+		},
+		"[pachyderm_handler]": func(podClient resource.Client, recorder record.EventRecorder) DataHandler {
+			handler := NewPachydermHandler(fake.NewSimpleClientset(), []resource.Client{podClient, &testClient{plural: "nodes"}}, recorder, nil).(*pachydermHandler)
+			handler.logs = logs
+			return handler
+		},
+	}
+
+	for key, newHandler := range testCases {
+		t.Logf("Testing for: %v", key)
+		recorder := record.NewFakeRecorder(10)
+		podClient := &testClient{plural: "pods", pod: failedPod()}
+		err := newHandler(podClient, recorder).OnDelete(context.Background(), "test", vc, vStatus, ownerRef)
+
+		// The reasons of the failure and the logs of the cleanup pod are
+		// part of the error, which ends up in the volume status, and of the
+		// event.
+		vckName := vckNameFor(ownerRef, "vol1", "delete", "0")
+		diagnostics := "pod not scheduled: Unschedulable: 0/1 nodes are available; " +
+			"container download terminated: OOMKilled (exit code 137); " +
+			"container sidecar waiting: ImagePullBackOff: image not found; " +
+			"logs of container init: permission denied; logs of container download: permission denied"
+		require.NotNil(t, err)
+		require.Contains(t, err.Error(), fmt.Sprintf("error during data deletion using pod [name: %s]: pod failed (%s)", vckName, diagnostics))
+		require.Equal(t, fmt.Sprintf("Warning CleanupPodFailed cleanup pod %s of volume vol1 failed: pod failed (%s)", vckName, diagnostics), <-recorder.Events)
+	}
+}
+
+func TestPodMetrics(t *testing.T) {
+	startTime := metav1.NewTime(time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC))
+	pod := &corev1.Pod{
+		Status: corev1.PodStatus{
+			StartTime: &startTime,
+			ContainerStatuses: []corev1.ContainerStatus{
+				{
+					State: corev1.ContainerState{
+						Terminated: &corev1.ContainerStateTerminated{
+							FinishedAt: metav1.NewTime(startTime.Add(90 * time.Second)),
+							Message:    "2048\n",
+						},
+					},
+				},
+			},
+		},
+	}
+
+	require.Equal(t, 90*time.Second, podDuration(pod))
+	require.Equal(t, int64(2048*1024), podDataBytes(pod))
+
+	// A pod which did not report the size of its data provisioned nothing
+	// measurable.
+	pod.Status.ContainerStatuses[0].State.Terminated.Message = ""
+	require.Equal(t, int64(0), podDataBytes(pod))
+}
+
+func TestHandlerAbort(t *testing.T) {
+	podClient := &testClient{plural: "pods"}
+	nodeClient := &testClient{plural: "nodes"}
+	handler := NewS3Handler(fake.NewSimpleClientset(), []resource.Client{podClient, nodeClient}, &record.FakeRecorder{}, nil)
+	ownerRef := metav1.OwnerReference{Name: "vm", UID: "uid"}
+
+	phases := &phaseRecorder{}
+
+	// The volume manager is deleted while the data is being downloaded.
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	cancelFunc()
+	volume := handler.OnAdd(ctx, "test", vckv1alpha1.VolumeConfig{
+		ID:         "vol1",
+		Replicas:   1,
+		Labels:     map[string]string{"foo": "bar"},
+		AccessMode: "ReadWriteOnce",
+		Options: map[string]string{
+			"awsCredentialsSecretName": "foobar",
+			"sourceURL":                "s3://foo",
+			"endpointURL":              "foo",
+		},
+	}, ownerRef, phases.setPhase)
+
+	// The download pods are deleted and the nodes are not labeled.
+	require.Equal(t, vckv1alpha1.VolumeFailed, volume.Phase)
+	require.Equal(t, vckv1alpha1.VolumeReasonAborted, volume.Reason)
+	require.Equal(t, []vckv1alpha1.VolumePhase{vckv1alpha1.VolumeDownloading}, phases.phases)
+	require.Equal(t, []string{vckNameFor(ownerRef, "vol1", "add", "0")}, podClient.deleted)
+	require.Equal(t, 0, nodeClient.updated)
+	require.Empty(t, nodeClient.patches)
+}
+
+func TestHandlerPhases(t *testing.T) {
+	podClient := &testClient{plural: "pods", pod: &corev1.Pod{
+		Spec:   corev1.PodSpec{NodeName: "node1"},
+		Status: corev1.PodStatus{Phase: corev1.PodSucceeded},
+	}}
+	nodeClient := &testClient{plural: "nodes"}
+	handler := NewS3Handler(fake.NewSimpleClientset(), []resource.Client{podClient, nodeClient}, &record.FakeRecorder{}, nil)
+	ownerRef := metav1.OwnerReference{Name: "vm", UID: "uid"}
+	phases := &phaseRecorder{}
+
+	volume := handler.OnAdd(context.Background(), "test", vckv1alpha1.VolumeConfig{
+		ID:         "vol1",
+		Replicas:   1,
+		Labels:     map[string]string{"foo": "bar"},
+		AccessMode: "ReadWriteOnce",
+		Options: map[string]string{
+			"awsCredentialsSecretName": "foobar",
+			"sourceURL":                "s3://foo",
+			"endpointURL":              "foo",
+		},
+	}, ownerRef, phases.setPhase)
+
+	// The phases are reported as the steps start, the outcome is only
+	// recorded in the returned volume.
+	require.Equal(t, vckv1alpha1.VolumeReady, volume.Phase)
+	require.Equal(t, vckv1alpha1.VolumeReasonProvisioned, volume.Reason)
+	require.Empty(t, volume.Message)
+	require.Equal(t, []vckv1alpha1.VolumePhase{vckv1alpha1.VolumeDownloading, vckv1alpha1.VolumeLabeling}, phases.phases)
+	require.Len(t, nodeClient.patches, 1)
+}
+
+func TestPatchNodeLabels(t *testing.T) {
+	testCases := map[string]struct {
+		operation       string
+		expectedPatches []string
+	}{
+		"add": {
+			operation:       "add",
+			expectedPatches: []string{`node1 {"metadata":{"labels":{"vck.intelai.org/a":"true","vck.intelai.org/b":"true"}}}`},
+		},
+		"delete": {
+			operation:       "delete",
+			expectedPatches: []string{`node1 {"metadata":{"labels":{"vck.intelai.org/a":null,"vck.intelai.org/b":null}}}`},
+		},
+	}
+
+	for key, tc := range testCases {
+		t.Logf("Testing for: %v", key)
+		nodeClient := &testClient{plural: "nodes"}
+		err := patchNodeLabels(context.Background(), nodeClient, "node1", []string{"vck.intelai.org/a", "vck.intelai.org/b"}, tc.operation)
+		require.Nil(t, err)
+
+		// Only the labels of the controller are patched, the node is never
+		// updated as a whole.
+		require.Equal(t, tc.expectedPatches, nodeClient.patches)
+		require.Equal(t, 0, nodeClient.updated)
+	}
+}
+
+// watchClient is a client whose object goes through the supplied versions,
+// nil meaning the object does not exist.
+type watchClient struct {
+	*testClient
+	versions []runtime.Object
+}
+
+func (wc *watchClient) Watch(ctx context.Context, namespace, name string, changed func(runtime.Object) (bool, error)) error {
+	for _, obj := range wc.versions {
+		if done, err := changed(obj); done || err != nil {
+			return err
+		}
+	}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestWaitForPod(t *testing.T) {
+	pending := &corev1.Pod{Status: corev1.PodStatus{Phase: corev1.PodPending}}
+	succeeded := &corev1.Pod{Status: corev1.PodStatus{Phase: corev1.PodSucceeded}}
+
+	testCases := map[string]struct {
+		versions    []runtime.Object
+		timeout     time.Duration
+		cancel      bool
+		expectedErr error
+		expectedPod *corev1.Pod
+	}{
+		"succeeded": {
+			versions:    []runtime.Object{nil, pending, succeeded},
+			timeout:     time.Minute,
+			expectedPod: succeeded,
+		},
+		"timed out": {
+			versions:    []runtime.Object{pending},
+			timeout:     100 * time.Millisecond,
+			expectedErr: wait.ErrWaitTimeout,
+			expectedPod: pending,
+		},
+		"cancelled": {
+			versions:    []runtime.Object{pending},
+			timeout:     time.Minute,
+			cancel:      true,
+			expectedErr: context.Canceled,
+		},
+		"deleted": {
+			versions:    []runtime.Object{pending, nil},
+			timeout:     time.Minute,
+			expectedErr: fmt.Errorf("pod pod1 was deleted"),
+			expectedPod: pending,
+		},
+	}
+
+	for key, tc := range testCases {
+		t.Logf("Testing for: %v", key)
+		podClient := &watchClient{testClient: &testClient{plural: "pods"}, versions: tc.versions}
+		ctx, cancelFunc := context.WithCancel(context.Background())
+		if tc.cancel {
+			cancelFunc()
+		}
+
+		pod, err := waitForPodCompletion(ctx, podClient, "pod1", "test", tc.timeout)
+		cancelFunc()
+		require.Equal(t, tc.expectedErr, err)
+		if tc.expectedPod != nil {
+			require.Equal(t, tc.expectedPod, pod)
+		}
+	}
+}
+
+func TestWaitForPodSuccess(t *testing.T) {
+	pending := &corev1.Pod{Status: corev1.PodStatus{
+		Phase: corev1.PodPending,
+		Conditions: []corev1.PodCondition{
+			{Type: corev1.PodScheduled, Status: corev1.ConditionFalse, Reason: "Unschedulable", Message: "0/3 nodes are available: 3 node(s) had taints"},
+		},
+	}}
+	scheduled := &corev1.Pod{Spec: corev1.PodSpec{NodeName: "node1"}, Status: corev1.PodStatus{Phase: corev1.PodPending}}
+	waiting := func(reason string) *corev1.Pod {
+		pod := scheduled.DeepCopy()
+		pod.Status.ContainerStatuses = []corev1.ContainerStatus{
+			{Name: "download", Image: "minio/mc", State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: reason}}},
+		}
+		return pod
+	}
+	succeeded := scheduled.DeepCopy()
+	succeeded.Status.Phase = corev1.PodSucceeded
+	failed := scheduled.DeepCopy()
+	failed.Status.Phase = corev1.PodFailed
+	failed.Status.Message = "The node was low on resource: ephemeral-storage."
+
+	testCases := map[string]struct {
+		versions          []runtime.Object
+		schedulingTimeout time.Duration
+		expectedReason    vckv1alpha1.VolumeReason
+		expectedErr       string
+	}{
+		"succeeded": {
+			versions:          []runtime.Object{nil, pending, scheduled, waiting("ContainerCreating"), succeeded},
+			schedulingTimeout: time.Minute,
+		},
+		"unschedulable": {
+			versions:          []runtime.Object{pending},
+			schedulingTimeout: 100 * time.Millisecond,
+			expectedReason:    vckv1alpha1.VolumeReasonUnschedulable,
+			expectedErr:       "pod was not scheduled within 100ms: 0/3 nodes are available: 3 node(s) had taints",
+		},
+		"never observed": {
+			versions:          []runtime.Object{nil},
+			schedulingTimeout: 100 * time.Millisecond,
+			expectedReason:    vckv1alpha1.VolumeReasonUnschedulable,
+			expectedErr:       "pod was not scheduled within 100ms",
+		},
+		"image pull": {
+			versions:          []runtime.Object{scheduled, waiting("ErrImagePull")},
+			schedulingTimeout: time.Minute,
+			expectedReason:    vckv1alpha1.VolumeReasonImagePullFailed,
+			expectedErr:       "container download cannot pull image minio/mc: ErrImagePull",
+		},
+		"crash loop": {
+			versions:          []runtime.Object{scheduled, waiting("CrashLoopBackOff")},
+			schedulingTimeout: time.Minute,
+			expectedReason:    vckv1alpha1.VolumeReasonCrashLoop,
+			expectedErr:       "container download is crash looping",
+		},
+		"failed": {
+			versions:          []runtime.Object{scheduled, failed},
+			schedulingTimeout: time.Minute,
+			expectedReason:    vckv1alpha1.VolumeReasonPodFailed,
+			expectedErr:       "pod failed: The node was low on resource: ephemeral-storage.",
+		},
+		"scheduling timeout longer than the timeout": {
+			versions:          []runtime.Object{pending},
+			schedulingTimeout: time.Hour,
+			expectedReason:    vckv1alpha1.VolumeReasonDownloadTimeout,
+			expectedErr:       wait.ErrWaitTimeout.Error(),
+		},
+	}
+
+	for key, tc := range testCases {
+		t.Logf("Testing for: %v", key)
+		podClient := &watchClient{testClient: &testClient{plural: "pods"}, versions: tc.versions}
+		err := waitForPodSuccess(context.Background(), podClient, "pod1", "test", 200*time.Millisecond, tc.schedulingTimeout)
+		if tc.expectedErr == "" {
+			require.Nil(t, err)
+			continue
+		}
+		require.NotNil(t, err)
+		require.Equal(t, tc.expectedErr, err.Error())
+		require.Equal(t, tc.expectedReason, downloadReason(err))
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	fakek8sClient := fake.NewSimpleClientset()
+	s3Handler := NewS3Handler(fakek8sClient, []resource.Client{}, &record.FakeRecorder{}, nil)
+	nfsHandler := NewNFSHandler(fakek8sClient, []resource.Client{}, &record.FakeRecorder{})
+
+	registry := NewRegistry()
+	require.Nil(t, registry.Register(s3Handler, "S3-Dev"))
+	require.Nil(t, registry.Register(nfsHandler))
+	require.Equal(t, []string{"NFS", "S3", "S3-Dev"}, registry.SourceTypes())
+
+	// Source types and aliases are matched case-insensitively.
+	require.Equal(t, s3Handler, registry.Lookup("S3"))
+	require.Equal(t, s3Handler, registry.Lookup("s3"))
+	require.Equal(t, s3Handler, registry.Lookup("s3-dev"))
+	require.Equal(t, nfsHandler, registry.Lookup("Nfs"))
+	require.Nil(t, registry.Lookup("S4"))
+
+	// A source type can only be registered once.
+	require.NotNil(t, registry.Register(NewS3Handler(fakek8sClient, []resource.Client{}, &record.FakeRecorder{}, nil)))
+	require.NotNil(t, registry.Register(NewPachydermHandler(fakek8sClient, []resource.Client{}, &record.FakeRecorder{}, nil), "nfs"))
+	require.Equal(t, []string{"NFS", "S3", "S3-Dev"}, registry.SourceTypes())
+
+	// The source type and the aliases of a data handler are distinct.
+	otherRegistry := NewRegistry()
+	require.NotNil(t, otherRegistry.Register(s3Handler, "s3"))
+	require.NotNil(t, otherRegistry.Register(s3Handler, "S3-Dev", "s3-dev"))
+	require.Empty(t, otherRegistry.SourceTypes())
+	require.Nil(t, otherRegistry.Lookup("S3"))
+
+	// Modifying the returned source types does not modify the registry.
+	sourceTypes := registry.SourceTypes()
+	sourceTypes[0] = "S4"
+	require.Equal(t, []string{"NFS", "S3", "S3-Dev"}, registry.SourceTypes())
+}
+
+func TestDownloadLimiter(t *testing.T) {
+	// A nil limiter does not limit anything.
+	var unlimited *DownloadLimiter
+	require.Nil(t, unlimited.Acquire(context.Background(), "test/vm1", 0))
+	require.False(t, unlimited.binds())
+	require.Equal(t, 0, unlimited.Position("test/vm1"))
+	unlimited.Release()
+
+	limiter := NewDownloadLimiter(2, 1)
+	require.True(t, limiter.binds())
+	require.Nil(t, limiter.Acquire(context.Background(), "test/vm1", 0))
+	require.Nil(t, limiter.Acquire(context.Background(), "test/vm1", 0))
+
+	// The cluster is full.
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancelFunc()
+	require.Equal(t, context.DeadlineExceeded, limiter.Acquire(ctx, "test/vm1", 0))
+	require.Equal(t, 0, limiter.Position("test/vm1"))
+
+	// A pod which is not scheduled yet holds a slot on every node it may be
+	// scheduled on, so the next one waits for a free node.
+	nodes := []string{"node2", "node1"}
+	first, err := limiter.reserveNode(context.Background(), nodes)
+	require.Nil(t, err)
+	require.Equal(t, []string{"node1", "node2"}, first.allowedNodes())
+
+	ctx, cancelFunc = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancelFunc()
+	_, err = limiter.reserveNode(ctx, nodes)
+	require.Equal(t, context.DeadlineExceeded, err)
+
+	// Scheduling the first pod frees the other nodes.
+	reserved := make(chan *nodeReservation)
+	go func() {
+		reservation, _ := limiter.reserveNode(context.Background(), nodes)
+		reserved <- reservation
+	}()
+	limiter.bind(first, "node1")
+	second := <-reserved
+	require.Equal(t, []string{"node2"}, second.allowedNodes())
+
+	limiter.releaseNode(first)
+	third, err := limiter.reserveNode(context.Background(), nodes)
+	require.Nil(t, err)
+	require.Equal(t, []string{"node1"}, third.allowedNodes())
+	limiter.releaseNode(second)
+	limiter.releaseNode(third)
+	limiter.releaseNode(nil)
+	require.Nil(t, (*nodeReservation)(nil).allowedNodes())
+
+	// There has to be a node to reserve a slot on.
+	_, err = limiter.reserveNode(context.Background(), nil)
+	require.NotNil(t, err)
+
+	limiter.Release()
+	require.Nil(t, limiter.Acquire(context.Background(), "test/vm1", 0))
+}
+
+func TestDownloadQueue(t *testing.T) {
+	limiter := NewDownloadLimiter(1, 0)
+	require.Nil(t, limiter.Acquire(context.Background(), "test/running", 0))
+
+	// Queue the downloads one after the other so that their order is known.
+	admitted := make(chan string, 3)
+	queue := func(key string, priority int) {
+		go func() {
+			if err := limiter.Acquire(context.Background(), key, priority); err == nil {
+				admitted <- key
+			}
+		}()
+		require.Nil(t, wait.Poll(time.Millisecond, time.Second, func() (bool, error) {
+			return limiter.Position(key) != 0, nil
+		}))
+	}
+	queue("test/bulk1", 0)
+	queue("test/bulk2", 0)
+	queue("test/urgent", 10)
+
+	// Higher priorities come first, then the order of the requests.
+	require.Equal(t, 1, limiter.Position("test/urgent"))
+	require.Equal(t, 2, limiter.Position("test/bulk1"))
+	require.Equal(t, 3, limiter.Position("test/bulk2"))
+	require.Equal(t, 0, limiter.Position("test/running"))
+
+	for _, key := range []string{"test/urgent", "test/bulk1", "test/bulk2"} {
+		limiter.Release()
+		require.Equal(t, key, <-admitted)
+	}
+	require.Equal(t, 0, limiter.Position("test/bulk2"))
+}
+
+func TestExcludeNodes(t *testing.T) {
+	notIn := corev1.NodeSelectorRequirement{
+		Key:      "kubernetes.io/hostname",
+		Operator: corev1.NodeSelectorOpNotIn,
+		Values:   []string{"node1"},
+	}
+
+	require.Equal(t, corev1.NodeAffinity{}, excludeNodes(corev1.NodeAffinity{}, nil))
+	require.Equal(t, corev1.NodeAffinity{
+		RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
+			NodeSelectorTerms: []corev1.NodeSelectorTerm{{MatchExpressions: []corev1.NodeSelectorRequirement{notIn}}},
+		},
+	}, excludeNodes(corev1.NodeAffinity{}, []string{"node1"}))
+
+	// The requirement is added to every term, without modifying the
+	// supplied node affinity.
+	zone := corev1.NodeSelectorRequirement{Key: "zone", Operator: corev1.NodeSelectorOpIn, Values: []string{"a"}}
+	nodeAffinity := corev1.NodeAffinity{
+		RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
+			NodeSelectorTerms: []corev1.NodeSelectorTerm{
+				{MatchExpressions: []corev1.NodeSelectorRequirement{zone}},
+				{},
+			},
+		},
+	}
+	excluded := excludeNodes(nodeAffinity, []string{"node1"})
+	require.Equal(t, []corev1.NodeSelectorTerm{
+		{MatchExpressions: []corev1.NodeSelectorRequirement{zone, notIn}},
+		{MatchExpressions: []corev1.NodeSelectorRequirement{notIn}},
+	}, excluded.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms)
+	require.Equal(t, []corev1.NodeSelectorRequirement{zone}, nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms[0].MatchExpressions)
+
+	// The nodes a pod is restricted to are matched on the same label.
+	require.Equal(t, corev1.NodeAffinity{
+		RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
+			NodeSelectorTerms: []corev1.NodeSelectorTerm{{MatchExpressions: []corev1.NodeSelectorRequirement{
+				{Key: "kubernetes.io/hostname", Operator: corev1.NodeSelectorOpIn, Values: []string{"node2"}},
+			}}},
+		},
+	}, includeNodes(corev1.NodeAffinity{}, []string{"node2"}))
+	require.Equal(t, corev1.NodeAffinity{}, includeNodes(corev1.NodeAffinity{}, nil))
+}
+
+func TestDownloadReplicas(t *testing.T) {
+	podClient := &testClient{plural: "pods"}
+	vckNames := []string{"pod0", "pod1", "pod2", "pod3"}
+
+	// The replicas are downloaded concurrently, within the cluster limit.
+	var lock sync.Mutex
+	running, maxRunning := 0, 0
+	create := func(i int, excludedNodes []string) error {
+		if i == 1 {
+			return fmt.Errorf("create failed")
+		}
+		return nil
+	}
+	waitFunc := func(vckName string) error {
+		lock.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		lock.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		lock.Lock()
+		running--
+		lock.Unlock()
+		if vckName == "pod2" {
+			return wait.ErrWaitTimeout
+		}
+		return nil
+	}
+
+	downloads := downloadReplicas(context.Background(), NewDownloadLimiter(2, 0), podClient, "test", vckv1alpha1.VolumeConfig{}, metav1.OwnerReference{}, nil, nil, vckNames, time.Second, create, waitFunc)
+	require.Equal(t, []replicaDownload{
+		{},
+		{createErr: fmt.Errorf("create failed")},
+		{waitErr: wait.ErrWaitTimeout},
+		{},
+	}, downloads)
+	require.Equal(t, 2, maxRunning)
+
+	// A cancelled context stops the replicas waiting for a slot.
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	cancelFunc()
+	downloads = downloadReplicas(ctx, NewDownloadLimiter(1, 0), podClient, "test", vckv1alpha1.VolumeConfig{}, metav1.OwnerReference{}, nil, nil, vckNames[:1], time.Second, create, waitFunc)
+	require.Equal(t, context.Canceled, downloads[0].createErr)
+
+	// With a cap per node, the pods are restricted to the nodes with a free
+	// slot, matched by hostname, and wait while every node is full.
+	nodeList := []metav1.Object{
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-a", Labels: map[string]string{"kubernetes.io/hostname": "a"}}},
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-b", Labels: map[string]string{"kubernetes.io/hostname": "b"}}},
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-c", Labels: map[string]string{"kubernetes.io/hostname": "c"}}},
+	}
+	podClient = &testClient{plural: "pods", objects: map[string]runtime.Object{}}
+	scheduled := map[string]int{}
+	maxScheduled := 0
+	create = func(i int, allowedNodes []string) error {
+		require.NotContains(t, allowedNodes, "c")
+		podClient.lock.Lock()
+		defer podClient.lock.Unlock()
+		podClient.objects[vckNames[i]] = &corev1.Pod{Spec: corev1.PodSpec{NodeName: "node-" + allowedNodes[0]}}
+		return nil
+	}
+	waitFunc = func(vckName string) error {
+		podClient.lock.Lock()
+		nodeName := podClient.objects[vckName].(*corev1.Pod).Spec.NodeName
+		podClient.lock.Unlock()
+
+		lock.Lock()
+		scheduled[nodeName]++
+		if scheduled[nodeName] > maxScheduled {
+			maxScheduled = scheduled[nodeName]
+		}
+		lock.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		lock.Lock()
+		scheduled[nodeName]--
+		lock.Unlock()
+		return nil
+	}
+
+	downloads = downloadReplicas(context.Background(), NewDownloadLimiter(0, 1), podClient, "test", vckv1alpha1.VolumeConfig{}, metav1.OwnerReference{}, nodeList, []string{"c"}, vckNames, time.Second, create, waitFunc)
+	require.Equal(t, make([]replicaDownload, len(vckNames)), downloads)
+	require.Equal(t, 1, maxScheduled)
+}
@@ -19,18 +19,49 @@
 package handlers
 
 import (
+	"context"
+	"time"
+
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	vckv1alpha1 "github.com/IntelAI/vck/pkg/apis/vck/v1alpha1"
 )
 
+// PhaseFunc is called by a data handler with the phase a volume enters while
+// it is being provisioned.
+type PhaseFunc func(phase vckv1alpha1.VolumePhase)
+
 // DataHandler is the interface which defines the handler methods
 type DataHandler interface {
 	GetSourceType() vckv1alpha1.DataSourceType
-	OnAdd(namespace string, vc vckv1alpha1.VolumeConfig, controllerRef metav1.OwnerReference) vckv1alpha1.Volume
-	OnDelete(namespace string, vc vckv1alpha1.VolumeConfig, vStatus vckv1alpha1.Volume, controllerRef metav1.OwnerReference)
+	// Validate checks a volume config without creating anything. It is run
+	// for all the volume configs of a volume manager before any of them is
+	// provisioned.
+	Validate(namespace string, vc vckv1alpha1.VolumeConfig) error
+	// OnAdd provisions a volume. If the supplied context is done, e.g.
+	// because the volume manager is deleted, the provisioning is aborted and
+	// the sub-resources created so far are removed. setPhase is called as
+	// each step of the provisioning starts.
+	OnAdd(ctx context.Context, namespace string, vc vckv1alpha1.VolumeConfig, controllerRef metav1.OwnerReference, setPhase PhaseFunc) vckv1alpha1.Volume
+	// OnDelete removes the sub-resources, node labels and data of a volume.
+	// A nil error confirms that the cleanup is complete.
+	OnDelete(ctx context.Context, namespace string, vc vckv1alpha1.VolumeConfig, vStatus vckv1alpha1.Volume, controllerRef metav1.OwnerReference) error
+	// OnRepair compares the sub-resources recorded in vStatus with the
+	// cluster and repairs the differences found, recreating only what is
+	// missing. It returns a description of every repair made, and an error
+	// for the differences which could not be repaired. A difference which
+	// cannot be established, e.g. because a check pod could not run, is
+	// not reported.
+	OnRepair(ctx context.Context, namespace string, vc vckv1alpha1.VolumeConfig, vStatus vckv1alpha1.Volume, controllerRef metav1.OwnerReference) ([]string, error)
 }
 
 const (
 	vckNamePrefix string = "vck-resource-"
+	// The time to wait for a pod checking the data on a node to complete.
+	timeoutForDataCheck time.Duration = 2 * time.Minute
+	// The time to wait for a sub-resource to be gone before it is recreated.
+	timeoutForDeletion time.Duration = time.Minute
+	// The exit code of a pod checking the data on a node which found the data
+	// directory missing. An empty directory is a valid, empty dataset.
+	dataMissingExitCode int32 = 3
 )
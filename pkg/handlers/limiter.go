@@ -0,0 +1,317 @@
+//
+// Copyright (c) 2018 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: EPL-2.0
+//
+
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// hostnameLabel is the label of the nodes the download limiter identifies
+// them by.
+const hostnameLabel = "kubernetes.io/hostname"
+
+// DownloadLimiter caps the number of download pods which run at the same
+// time, across the cluster and on every node, so that the downloads do not
+// saturate the storage bandwidth. It is shared by all the data handlers of the
+// controller. The downloads waiting for a free slot in the cluster are queued
+// by priority, then in the order they were requested. A nil limiter does not
+// limit anything.
+//
+// The nodes are identified by their kubernetes.io/hostname label, which the
+// node affinity of the download pods is matched against. A slot on a node is
+// reserved before a download pod is created, so that a burst of downloads
+// does not go over the cap while the pods are being scheduled.
+type DownloadLimiter struct {
+	maxPerCluster int
+	maxPerNode    int
+
+	lock    sync.Mutex
+	running int
+	queue   []*downloadRequest
+	// reservations holds the node slots reserved by the download pods which
+	// are not done yet.
+	reservations map[*nodeReservation]struct{}
+	// nodesFreed is closed, and replaced, whenever a node slot may have been
+	// freed.
+	nodesFreed chan struct{}
+}
+
+// nodeReservation is the reservation of a slot on one of the nodes a download
+// pod may be scheduled on, which is narrowed down to a single node once the
+// pod is scheduled. Until then, the pod counts against every one of them.
+type nodeReservation struct {
+	hostnames []string
+}
+
+// downloadRequest is a download waiting in the queue for a free slot.
+type downloadRequest struct {
+	// key identifies the volume manager of the download.
+	key      string
+	priority int
+	// admitted is closed once the download has been given a slot.
+	admitted chan struct{}
+}
+
+// NewDownloadLimiter returns a limiter allowing maxPerCluster download pods in
+// the cluster and maxPerNode download pods on every node. A value of 0 does
+// not cap the number of download pods.
+func NewDownloadLimiter(maxPerCluster, maxPerNode int) *DownloadLimiter {
+	return &DownloadLimiter{
+		maxPerCluster: maxPerCluster,
+		maxPerNode:    maxPerNode,
+		reservations:  map[*nodeReservation]struct{}{},
+		nodesFreed:    make(chan struct{}),
+	}
+}
+
+// Acquire blocks until a download pod of the volume manager identified by
+// key, i.e. its namespace/name, may be created in the cluster. It returns the
+// error of the supplied context if the context is done first. Every
+// successful Acquire has to be followed by a Release once the pod is done.
+func (l *DownloadLimiter) Acquire(ctx context.Context, key string, priority int) error {
+	if l == nil || l.maxPerCluster <= 0 || ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	l.lock.Lock()
+	if l.running < l.maxPerCluster && len(l.queue) == 0 {
+		l.running++
+		l.lock.Unlock()
+		return nil
+	}
+
+	// Queue the request after the ones with the same or a higher priority.
+	request := &downloadRequest{key: key, priority: priority, admitted: make(chan struct{})}
+	idx := sort.Search(len(l.queue), func(i int) bool {
+		return l.queue[i].priority < priority
+	})
+	l.queue = append(l.queue, nil)
+	copy(l.queue[idx+1:], l.queue[idx:])
+	l.queue[idx] = request
+	l.lock.Unlock()
+
+	select {
+	case <-request.admitted:
+		return nil
+	case <-ctx.Done():
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for i, queued := range l.queue {
+		if queued == request {
+			l.queue = append(l.queue[:i], l.queue[i+1:]...)
+			return ctx.Err()
+		}
+	}
+
+	// The request was admitted concurrently, hand its slot over.
+	l.running--
+	l.admit()
+	return ctx.Err()
+}
+
+// admit hands the free slots over to the requests at the head of the queue.
+// It has to be called with the lock held.
+func (l *DownloadLimiter) admit() {
+	for l.running < l.maxPerCluster && len(l.queue) != 0 {
+		request := l.queue[0]
+		l.queue = l.queue[1:]
+		l.running++
+		close(request.admitted)
+	}
+}
+
+// Position returns the position in the queue of the first download of the
+// volume manager identified by key, starting at 1, or 0 if none of its
+// downloads is waiting for a free slot.
+func (l *DownloadLimiter) Position(key string) int {
+	if l == nil {
+		return 0
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for i, request := range l.queue {
+		if request.key == key {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// Release frees the slot of a download pod which is done.
+func (l *DownloadLimiter) Release() {
+	if l == nil || l.maxPerCluster <= 0 {
+		return
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.running--
+	l.admit()
+}
+
+// binds tells whether download pods have to reserve a slot on their node.
+func (l *DownloadLimiter) binds() bool {
+	return l != nil && l.maxPerNode > 0
+}
+
+// reserveNode blocks until one of the supplied nodes, identified by their
+// hostname, may run one more download pod, and reserves a slot on all of the
+// nodes which may. A node may run one more pod while the pods scheduled on it
+// and the pods which may still be scheduled on it are below the cap. It
+// returns the error of the supplied context if the context is done first.
+// Every successful reserveNode has to be followed by a releaseNode once the
+// pod is done.
+func (l *DownloadLimiter) reserveNode(ctx context.Context, hostnames []string) (*nodeReservation, error) {
+	if len(hostnames) == 0 {
+		return nil, fmt.Errorf("no node with a %s label to download on", hostnameLabel)
+	}
+
+	for {
+		l.lock.Lock()
+		load := map[string]int{}
+		for reservation := range l.reservations {
+			for _, hostname := range reservation.hostnames {
+				load[hostname]++
+			}
+		}
+
+		reservation := &nodeReservation{}
+		for _, hostname := range hostnames {
+			if load[hostname] < l.maxPerNode {
+				reservation.hostnames = append(reservation.hostnames, hostname)
+			}
+		}
+		if len(reservation.hostnames) != 0 {
+			sort.Strings(reservation.hostnames)
+			l.reservations[reservation] = struct{}{}
+			l.lock.Unlock()
+			return reservation, nil
+		}
+		nodesFreed := l.nodesFreed
+		l.lock.Unlock()
+
+		select {
+		case <-nodesFreed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// bind narrows the reservation of a download pod down to the node it has
+// been scheduled on, freeing its slot on the other nodes.
+func (l *DownloadLimiter) bind(reservation *nodeReservation, hostname string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	reservation.hostnames = []string{hostname}
+	l.freeNodes()
+}
+
+// releaseNode frees the node slot of a download pod which is done. A nil
+// reservation is ignored.
+func (l *DownloadLimiter) releaseNode(reservation *nodeReservation) {
+	if reservation == nil {
+		return
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	delete(l.reservations, reservation)
+	l.freeNodes()
+}
+
+// freeNodes wakes up the downloads waiting for a node slot. It has to be
+// called with the lock held.
+func (l *DownloadLimiter) freeNodes() {
+	close(l.nodesFreed)
+	l.nodesFreed = make(chan struct{})
+}
+
+// allowedNodes returns the hostnames of the nodes a download pod holding the
+// reservation may be scheduled on, nil if it may be scheduled on any node.
+func (r *nodeReservation) allowedNodes() []string {
+	if r == nil {
+		return nil
+	}
+	return r.hostnames
+}
+
+// excludeNodes returns a copy of the supplied node affinity which keeps pods
+// off the nodes with the supplied hostnames.
+func excludeNodes(nodeAffinity corev1.NodeAffinity, hostnames []string) corev1.NodeAffinity {
+	return requireNodes(nodeAffinity, corev1.NodeSelectorOpNotIn, hostnames)
+}
+
+// includeNodes returns a copy of the supplied node affinity which restricts
+// pods to the nodes with the supplied hostnames.
+func includeNodes(nodeAffinity corev1.NodeAffinity, hostnames []string) corev1.NodeAffinity {
+	return requireNodes(nodeAffinity, corev1.NodeSelectorOpIn, hostnames)
+}
+
+// requireNodes returns a copy of the supplied node affinity which requires
+// the kubernetes.io/hostname label of the nodes to match the supplied
+// hostnames using the operator. An empty list of hostnames leaves the node
+// affinity unchanged.
+func requireNodes(nodeAffinity corev1.NodeAffinity, operator corev1.NodeSelectorOperator, hostnames []string) corev1.NodeAffinity {
+	nodeAffinityCopy := *nodeAffinity.DeepCopy()
+	if len(hostnames) == 0 {
+		return nodeAffinityCopy
+	}
+
+	requirement := corev1.NodeSelectorRequirement{
+		Key:      hostnameLabel,
+		Operator: operator,
+		Values:   hostnames,
+	}
+	if nodeAffinityCopy.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		nodeAffinityCopy.RequiredDuringSchedulingIgnoredDuringExecution = &corev1.NodeSelector{}
+	}
+	nodeSelector := nodeAffinityCopy.RequiredDuringSchedulingIgnoredDuringExecution
+	if len(nodeSelector.NodeSelectorTerms) == 0 {
+		nodeSelector.NodeSelectorTerms = []corev1.NodeSelectorTerm{{}}
+	}
+
+	// The terms are ORed, the requirement has to be part of every one.
+	for idx := range nodeSelector.NodeSelectorTerms {
+		nodeSelector.NodeSelectorTerms[idx].MatchExpressions = append(nodeSelector.NodeSelectorTerms[idx].MatchExpressions, requirement)
+	}
+	return nodeAffinityCopy
+}
+
+// nodeHostnames returns the kubernetes.io/hostname label of the supplied
+// nodes, keyed by node name. Nodes without the label are left out, as no
+// affinity can select them by hostname.
+func nodeHostnames(nodeList []metav1.Object) map[string]string {
+	hostnames := map[string]string{}
+	for _, node := range nodeList {
+		if hostname, ok := node.GetLabels()[hostnameLabel]; ok {
+			hostnames[node.GetName()] = hostname
+		}
+	}
+	return hostnames
+}
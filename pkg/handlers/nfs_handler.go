@@ -19,14 +19,17 @@
 package handlers
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/golang/glog"
 
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/util/uuid"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 
 	vckv1alpha1 "github.com/IntelAI/vck/pkg/apis/vck/v1alpha1"
 	"github.com/IntelAI/vck/pkg/resource"
@@ -40,14 +43,16 @@ type nfsHandler struct {
 	sourceType         vckv1alpha1.DataSourceType
 	k8sClientset       kubernetes.Interface
 	k8sResourceClients []resource.Client
+	recorder           record.EventRecorder
 }
 
 // NewNFSHandler creates and returns an instance of the NFS handler.
-func NewNFSHandler(k8sClientset kubernetes.Interface, resourceClients []resource.Client) DataHandler {
+func NewNFSHandler(k8sClientset kubernetes.Interface, resourceClients []resource.Client, recorder record.EventRecorder) DataHandler {
 	return &nfsHandler{
 		sourceType:         nfsSourceType,
 		k8sClientset:       k8sClientset,
 		k8sResourceClients: resourceClients,
+		recorder:           recorder,
 	}
 }
 
@@ -55,92 +60,71 @@ func (h *nfsHandler) GetSourceType() vckv1alpha1.DataSourceType {
 	return h.sourceType
 }
 
-func (h *nfsHandler) OnAdd(ns string, vc vckv1alpha1.VolumeConfig, controllerRef metav1.OwnerReference) vckv1alpha1.Volume {
-	if len(vc.Labels) == 0 {
-		return vckv1alpha1.Volume{
-			ID:      vc.ID,
-			Message: fmt.Sprintf("labels cannot be empty"),
-		}
+// Validate checks the options of an NFS volume config.
+func (h *nfsHandler) Validate(ns string, vc vckv1alpha1.VolumeConfig) error {
+	if err := validateLabels(vc); err != nil {
+		return err
 	}
 
 	if _, ok := vc.Options["server"]; !ok {
-		return vckv1alpha1.Volume{
-			ID:      vc.ID,
-			Message: fmt.Sprintf("server has to be set in options"),
-		}
+		return invalidOptions("server has to be set in options")
 	}
 
 	if _, ok := vc.Options["path"]; !ok {
-		return vckv1alpha1.Volume{
-			ID:      vc.ID,
-			Message: fmt.Sprintf("path has to be set in options"),
-		}
+		return invalidOptions("path has to be set in options")
 	}
 
 	if vc.AccessMode != "ReadWriteMany" && vc.AccessMode != "ReadOnlyMany" {
-		return vckv1alpha1.Volume{
-			ID:      vc.ID,
-			Message: fmt.Sprintf("access mode has to be either ReadWriteMany or ReadOnlyMany"),
-		}
+		return invalidOptions("access mode has to be either ReadWriteMany or ReadOnlyMany")
 	}
 
-	vckName := fmt.Sprintf("%s%s", vckNamePrefix, uuid.NewUUID())
+	return nil
+}
+
+func (h *nfsHandler) OnAdd(ctx context.Context, ns string, vc vckv1alpha1.VolumeConfig, controllerRef metav1.OwnerReference, setPhase PhaseFunc) vckv1alpha1.Volume {
+	if err := h.Validate(ns, vc); err != nil {
+		return InvalidVolume(vc.ID, err)
+	}
+
+	vckName := vckNameFor(controllerRef, vc.ID)
 	for _, client := range h.k8sResourceClients {
 		if client.Plural() == "nodes" || client.Plural() == "pods" {
 			continue
 		}
 
-		err := client.Create(ns, struct {
-			vckv1alpha1.VolumeConfig
-			metav1.OwnerReference
-			NS                  string
-			NodeName            string
-			VCKName             string
-			VCKStorageClassName string
-			PVType              string
-			VCKOptions          map[string]string
-		}{
-			vc,
-			controllerRef,
-			ns,
-			"",
-			vckName,
-			"vck",
-			"nfs",
-			map[string]string{
-				"server": vc.Options["server"],
-				"path":   vc.Options["path"],
-			},
-		})
-
-		if err != nil {
+		if err := h.create(ctx, client, ns, vc, controllerRef, vckName); err != nil {
 			return vckv1alpha1.Volume{
 				ID:      vc.ID,
+				Phase:   vckv1alpha1.VolumeFailed,
+				Reason:  vckv1alpha1.VolumeReasonResourceCreationFailed,
 				Message: fmt.Sprintf("error during sub-resource [%s] creation: %v", client.Plural(), err),
 			}
 		}
 	}
 
 	return vckv1alpha1.Volume{
-		ID: vc.ID,
+		ID:     vc.ID,
+		Phase:  vckv1alpha1.VolumeReady,
+		Reason: vckv1alpha1.VolumeReasonProvisioned,
 		VolumeSource: corev1.VolumeSource{
 			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
 				ClaimName: vckName,
 			},
 		},
-		Message: vckv1alpha1.SuccessfulVolumeStatusMessage,
 	}
 }
 
-func (h *nfsHandler) OnDelete(ns string, vc vckv1alpha1.VolumeConfig, vStatus vckv1alpha1.Volume, controllerRef metav1.OwnerReference) {
+func (h *nfsHandler) OnDelete(ctx context.Context, ns string, vc vckv1alpha1.VolumeConfig, vStatus vckv1alpha1.Volume, controllerRef metav1.OwnerReference) error {
+	errs := []error{}
 	for _, client := range h.k8sResourceClients {
 		if client.Plural() == "nodes" || client.Plural() == "pods" {
 			continue
 		}
 
-		resourceList, err := client.List(ns, vc.Labels)
+		resourceList, err := client.List(ctx, ns, resource.ListOptions{Labels: subResourceLabels(vc, controllerRef)})
 		if err != nil {
 			glog.Warningf("[nfs-handler] OnDelete: error while listing resource [%s], %v", client.Plural(), err)
+			errs = append(errs, err)
 		}
 
 		for _, resource := range resourceList {
@@ -150,9 +134,96 @@ func (h *nfsHandler) OnDelete(ns string, vc vckv1alpha1.VolumeConfig, vStatus vc
 			}
 
 			if resControllerRef.UID == controllerRef.UID {
-				client.Delete(ns, resource.GetName())
+				if err := client.Delete(ctx, ns, resource.GetName()); err != nil && !errors.IsNotFound(err) {
+					errs = append(errs, err)
+				}
 			}
 		}
 	}
 
+	return utilerrors.NewAggregate(errs)
+}
+
+// create creates the PV or the PVC of a volume, depending on the client.
+func (h *nfsHandler) create(ctx context.Context, client resource.Client, ns string, vc vckv1alpha1.VolumeConfig, controllerRef metav1.OwnerReference, vckName string) error {
+	err := client.Create(ctx, ns, struct {
+		vckv1alpha1.VolumeConfig
+		metav1.OwnerReference
+		NS                  string
+		NodeName            string
+		VCKName             string
+		VCKStorageClassName string
+		PVType              string
+		VCKOptions          map[string]string
+	}{
+		vc,
+		controllerRef,
+		ns,
+		"",
+		vckName,
+		"vck",
+		"nfs",
+		map[string]string{
+			"server": vc.Options["server"],
+			"path":   vc.Options["path"],
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	h.recorder.Eventf(volumeManagerRef(ns, controllerRef), corev1.EventTypeNormal, "ResourceCreated", "created %s %s for volume %s", client.Plural(), vckName, vc.ID)
+	return nil
+}
+
+func (h *nfsHandler) OnRepair(ctx context.Context, ns string, vc vckv1alpha1.VolumeConfig, vStatus vckv1alpha1.Volume, controllerRef metav1.OwnerReference) ([]string, error) {
+	if vStatus.VolumeSource.PersistentVolumeClaim == nil {
+		return nil, nil
+	}
+
+	// The PV and the PVC are both named after the claim.
+	vckName := vStatus.VolumeSource.PersistentVolumeClaim.ClaimName
+	clients := []resource.Client{}
+	missing := []string{}
+	for _, client := range h.k8sResourceClients {
+		if client.Plural() == "nodes" || client.Plural() == "pods" {
+			continue
+		}
+		clients = append(clients, client)
+
+		_, err := client.Get(ctx, ns, vckName)
+		if errors.IsNotFound(err) {
+			missing = append(missing, client.Plural())
+			continue
+		}
+
+		if err != nil {
+			glog.Warningf("[nfs-handler] OnRepair: error while getting sub-resource [%s] %s, volume %s is not checked: %v", client.Plural(), vckName, vc.ID, err)
+			return nil, nil
+		}
+	}
+
+	if len(missing) == 0 {
+		return nil, nil
+	}
+
+	// A claim is not bound again to a volume released by the deleted claim,
+	// nor is a volume bound to a claim which has lost its volume, so the
+	// remaining sub-resource is recreated along with the missing one.
+	for _, client := range clients {
+		if err := client.Delete(ctx, ns, vckName); err != nil && !errors.IsNotFound(err) {
+			return nil, fmt.Errorf("error during sub-resource [%s] deletion: %v", client.Plural(), err)
+		}
+		if err := waitForDeletion(ctx, client, ns, vckName, timeoutForDeletion); err != nil {
+			return nil, fmt.Errorf("error waiting for the deletion of sub-resource [%s] %s: %v", client.Plural(), vckName, err)
+		}
+	}
+
+	for _, client := range clients {
+		if err := h.create(ctx, client, ns, vc, controllerRef, vckName); err != nil {
+			return nil, fmt.Errorf("error during sub-resource [%s] creation: %v", client.Plural(), err)
+		}
+	}
+
+	return []string{fmt.Sprintf("sub-resource %v %s not found, recreated the PV and the PVC", missing, vckName)}, nil
 }
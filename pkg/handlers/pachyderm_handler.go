@@ -19,18 +19,23 @@
 package handlers
 
 import (
+	"context"
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/util/uuid"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 
 	"github.com/golang/glog"
 
 	vckv1alpha1 "github.com/IntelAI/vck/pkg/apis/vck/v1alpha1"
+	"github.com/IntelAI/vck/pkg/metrics"
 	"github.com/IntelAI/vck/pkg/resource"
 )
 
@@ -42,14 +47,22 @@ type pachydermHandler struct {
 	sourceType         vckv1alpha1.DataSourceType
 	k8sClientset       kubernetes.Interface
 	k8sResourceClients []resource.Client
+	recorder           record.EventRecorder
+	limiter            *DownloadLimiter
+	// logs retrieves the logs of the failed download and cleanup pods.
+	logs podLogger
 }
 
-// NewPachydermHandler creates and returns an instance of the NFS handler.
-func NewPachydermHandler(k8sClientset kubernetes.Interface, resourceClients []resource.Client) DataHandler {
+// NewPachydermHandler creates and returns an instance of the NFS handler. The
+// download pods are created within the limits of the supplied limiter.
+func NewPachydermHandler(k8sClientset kubernetes.Interface, resourceClients []resource.Client, recorder record.EventRecorder, limiter *DownloadLimiter) DataHandler {
 	return &pachydermHandler{
 		sourceType:         pachydermSourceType,
 		k8sClientset:       k8sClientset,
 		k8sResourceClients: resourceClients,
+		recorder:           recorder,
+		limiter:            limiter,
+		logs:               clientsetLogger(k8sClientset),
 	}
 }
 
@@ -57,46 +70,43 @@ func (h *pachydermHandler) GetSourceType() vckv1alpha1.DataSourceType {
 	return h.sourceType
 }
 
-func (h *pachydermHandler) OnAdd(ns string, vc vckv1alpha1.VolumeConfig, controllerRef metav1.OwnerReference) vckv1alpha1.Volume {
-	if len(vc.Labels) == 0 {
-		return vckv1alpha1.Volume{
-			ID:      vc.ID,
-			Message: fmt.Sprintf("labels cannot be empty"),
-		}
+// Validate checks the options of a Pachyderm volume config.
+func (h *pachydermHandler) Validate(ns string, vc vckv1alpha1.VolumeConfig) error {
+	if err := validateLabels(vc); err != nil {
+		return err
 	}
 
-	if _, ok := vc.Options["repo"]; !ok {
-		return vckv1alpha1.Volume{
-			ID:      vc.ID,
-			Message: fmt.Sprintf("repo has to be set in options"),
+	for _, option := range []string{"repo", "branch", "inputPath", "outputPath"} {
+		if _, ok := vc.Options[option]; !ok {
+			return invalidOptions("%s has to be set in options", option)
 		}
 	}
-	if _, ok := vc.Options["branch"]; !ok {
-		return vckv1alpha1.Volume{
-			ID:      vc.ID,
-			Message: fmt.Sprintf("branch has to be set in options"),
-		}
+
+	if vc.AccessMode != "ReadWriteOnce" {
+		return invalidOptions("access mode has to be ReadWriteOnce")
 	}
 
-	if _, ok := vc.Options["inputPath"]; !ok {
-		return vckv1alpha1.Volume{
-			ID:      vc.ID,
-			Message: fmt.Sprintf("inputPath has to be set in options"),
-		}
+	if _, err := downloadTimeout(vc); err != nil {
+		return invalidOptions("%v", err)
 	}
 
-	if _, ok := vc.Options["outputPath"]; !ok {
-		return vckv1alpha1.Volume{
-			ID:      vc.ID,
-			Message: fmt.Sprintf("outputPath has to be set in options"),
-		}
+	if _, err := schedulingTimeout(vc); err != nil {
+		return invalidOptions("%v", err)
 	}
 
-	if vc.AccessMode != "ReadWriteOnce" {
-		return vckv1alpha1.Volume{
-			ID:      vc.ID,
-			Message: fmt.Sprintf("access mode has to be ReadWriteOnce"),
-		}
+	return nil
+}
+
+func (h *pachydermHandler) OnAdd(ctx context.Context, ns string, vc vckv1alpha1.VolumeConfig, controllerRef metav1.OwnerReference, setPhase PhaseFunc) vckv1alpha1.Volume {
+	return h.provision(ctx, ns, vc, controllerRef, nil, nil, setPhase)
+}
+
+// provision downloads the supplied replicas of a volume, all of them if
+// replicas is nil, keeping the download pods off the nodes with the excluded
+// hostnames.
+func (h *pachydermHandler) provision(ctx context.Context, ns string, vc vckv1alpha1.VolumeConfig, controllerRef metav1.OwnerReference, replicas []int, excludedNodes []string, setPhase PhaseFunc) vckv1alpha1.Volume {
+	if err := h.Validate(ns, vc); err != nil {
+		return InvalidVolume(vc.ID, err)
 	}
 
 	// Set the pachyderm service address
@@ -109,24 +119,17 @@ func (h *pachydermHandler) OnAdd(ns string, vc vckv1alpha1.VolumeConfig, control
 		vc.Options["dataPath"] = "/var/datasets"
 	}
 
-	// Set the default timeout for data download using a pod to 5 minutes.
-	timeout, err := time.ParseDuration("5m")
-	// Check if timeout for data download was set and use it.
-	if _, ok := vc.Options["timeoutForDataDownload"]; ok {
-		timeout, err = time.ParseDuration(vc.Options["timeoutForDataDownload"])
-		if err != nil {
-			return vckv1alpha1.Volume{
-				ID:      vc.ID,
-				Message: fmt.Sprintf("error while parsing timeout for data download: %v", err),
-			}
-		}
-	}
+	// The timeout has been validated above.
+	timeout, _ := downloadTimeout(vc)
+	scheduling, _ := schedulingTimeout(vc)
 
 	nodeClient := getK8SResourceClientFromPlural(h.k8sResourceClients, "nodes")
-	nodeList, err := nodeClient.List(ns, map[string]string{})
+	nodeList, err := nodeClient.List(ctx, "", resource.ListOptions{})
 	if err != nil {
 		return vckv1alpha1.Volume{
 			ID:      vc.ID,
+			Phase:   vckv1alpha1.VolumeFailed,
+			Reason:  vckv1alpha1.VolumeReasonNodeListFailed,
 			Message: fmt.Sprintf("error getting node list: %v", err),
 		}
 	}
@@ -134,7 +137,9 @@ func (h *pachydermHandler) OnAdd(ns string, vc vckv1alpha1.VolumeConfig, control
 	// If number of nodes < replicas, then return immediately.
 	if len(nodeList) < vc.Replicas {
 		return vckv1alpha1.Volume{
-			ID: vc.ID,
+			ID:     vc.ID,
+			Phase:  vckv1alpha1.VolumeFailed,
+			Reason: vckv1alpha1.VolumeReasonInsufficientNodes,
 			Message: fmt.Sprintf("replicas [%v] greater than number of nodes [%v]",
 				vc.Replicas, len(nodeList)),
 		}
@@ -145,14 +150,24 @@ func (h *pachydermHandler) OnAdd(ns string, vc vckv1alpha1.VolumeConfig, control
 		vc.Options["recursive"] = "-r"
 	}
 
+	if replicas == nil {
+		for i := 0; i < vc.Replicas; i++ {
+			replicas = append(replicas, i)
+		}
+	}
+
 	vckNames := []string{}
-	podClient := getK8SResourceClientFromPlural(h.k8sResourceClients, "pods")
-	vckDataPathSuffix := fmt.Sprintf("%s%s", vckNamePrefix, uuid.NewUUID())
-	for i := 0; i < vc.Replicas; i++ {
-		vckName := fmt.Sprintf("%s%s", vckNamePrefix, uuid.NewUUID())
-		vckNames = append(vckNames, vckName)
+	for _, i := range replicas {
+		vckNames = append(vckNames, vckNameFor(controllerRef, vc.ID, "add", strconv.Itoa(i)))
+	}
 
-		err = podClient.Create(ns, struct {
+	// The replicas are downloaded concurrently.
+	podClient := getK8SResourceClientFromPlural(h.k8sResourceClients, "pods")
+	vckDataPathSuffix := vckNameFor(controllerRef, vc.ID)
+	create := func(i int, allowedNodes []string) error {
+		podVC := vc
+		podVC.NodeAffinity = includeNodes(excludeNodes(vc.NodeAffinity, excludedNodes), allowedNodes)
+		err := podClient.Create(ctx, ns, struct {
 			vckv1alpha1.VolumeConfig
 			metav1.OwnerReference
 			NS                  string
@@ -162,10 +177,10 @@ func (h *pachydermHandler) OnAdd(ns string, vc vckv1alpha1.VolumeConfig, control
 			PVType              string
 			VCKOptions          map[string]string
 		}{
-			vc,
+			podVC,
 			controllerRef,
 			ns,
-			vckName,
+			vckNames[i],
 			"add",
 			"vck",
 			"",
@@ -173,31 +188,50 @@ func (h *pachydermHandler) OnAdd(ns string, vc vckv1alpha1.VolumeConfig, control
 				"path": fmt.Sprintf("%s/%s", vc.Options["dataPath"], vckDataPathSuffix),
 			},
 		})
-
 		if err != nil {
+			return err
+		}
+
+		h.recorder.Eventf(volumeManagerRef(ns, controllerRef), corev1.EventTypeNormal, "PodCreated", "created download pod %s for volume %s", vckNames[i], vc.ID)
+		return nil
+	}
+	wait := func(vckName string) error {
+		return waitForPodSuccess(ctx, podClient, vckName, ns, timeout, scheduling)
+	}
+
+	setPhase(vckv1alpha1.VolumeDownloading)
+	downloads := downloadReplicas(ctx, h.limiter, podClient, ns, vc, controllerRef, nodeList, excludedNodes, vckNames, scheduling, create, wait)
+	if ctx.Err() != nil {
+		return abortDownload(ctx, podClient, ns, vc, vckNames)
+	}
+	for _, download := range downloads {
+		if download.createErr != nil {
 			return vckv1alpha1.Volume{
 				ID:      vc.ID,
-				Message: fmt.Sprintf("error during sub-resource [%s] creation: %v", podClient.Plural(), err),
+				Phase:   vckv1alpha1.VolumeFailed,
+				Reason:  vckv1alpha1.VolumeReasonResourceCreationFailed,
+				Message: fmt.Sprintf("error during sub-resource [%s] creation: %v", podClient.Plural(), download.createErr),
 			}
 		}
 	}
 
-	usedNodeNames := []string{}
-	nodeLabelKey := fmt.Sprintf("%s/%s-%s-%s", vckv1alpha1.GroupName, ns, controllerRef.Name, vc.ID)
-	for _, vckName := range vckNames {
-		err := waitForPodSuccess(podClient, vckName, ns, timeout)
-		if err != nil {
-			return vckv1alpha1.Volume{
-				ID: vc.ID,
-				// TODO(balajismaniam): append pod logs to this message if possible.
-				Message: fmt.Sprintf("error during data download using pod [name: %v]: %v", vckName, err),
-			}
+	for i, vckName := range vckNames {
+		if err := downloads[i].waitErr; err != nil {
+			return downloadFailed(ctx, podClient, h.logs, h.recorder, ns, vc, controllerRef, replicas[i], vckName, err)
 		}
+	}
 
-		podObj, err := podClient.Get(ns, vckName)
+	setPhase(vckv1alpha1.VolumeLabeling)
+	usedNodeNames := []string{}
+	provisionedBytes := int64(0)
+	nodeLabelKey := fmt.Sprintf("%s/%s-%s-%s", vckv1alpha1.GroupName, ns, controllerRef.Name, vc.ID)
+	for i, vckName := range vckNames {
+		podObj, err := podClient.Get(ctx, ns, vckName)
 		if err != nil {
 			return vckv1alpha1.Volume{
 				ID:      vc.ID,
+				Phase:   vckv1alpha1.VolumeFailed,
+				Reason:  vckv1alpha1.VolumeReasonPodLookupFailed,
 				Message: fmt.Sprintf("error getting pod [name: %v]: %v", vckName, err),
 			}
 		}
@@ -206,33 +240,41 @@ func (h *pachydermHandler) OnAdd(ns string, vc vckv1alpha1.VolumeConfig, control
 		if !ok {
 			return vckv1alpha1.Volume{
 				ID:      vc.ID,
+				Phase:   vckv1alpha1.VolumeFailed,
+				Reason:  vckv1alpha1.VolumeReasonPodLookupFailed,
 				Message: fmt.Sprintf("object returned from podclient.Get() is not a pod"),
 			}
 		}
 
 		usedNodeNames = append(usedNodeNames, pod.Spec.NodeName)
+		metrics.DownloadPodDuration.WithLabelValues(string(h.sourceType)).Observe(podDuration(pod).Seconds())
+		provisionedBytes += podDataBytes(pod)
+		h.recorder.Eventf(volumeManagerRef(ns, controllerRef), corev1.EventTypeNormal, "DownloadSucceeded", "replica %d of volume %s downloaded on node %s", replicas[i], vc.ID, pod.Spec.NodeName)
 
-		node, err := nodeClient.Get("", pod.Spec.NodeName)
-		if err != nil {
-			return vckv1alpha1.Volume{
-				ID:      vc.ID,
-				Message: fmt.Sprintf("could not get node %s, error: %v", pod.Spec.NodeName, err),
-			}
-		}
 		// update nodes with the correct label
-		err = updateNodeWithLabels(nodeClient, node.(*corev1.Node), []string{nodeLabelKey}, "add")
-
+		err = patchNodeLabels(ctx, nodeClient, pod.Spec.NodeName, []string{nodeLabelKey}, "add")
 		if err != nil {
 			return vckv1alpha1.Volume{
 				ID:      vc.ID,
+				Phase:   vckv1alpha1.VolumeFailed,
+				Reason:  vckv1alpha1.VolumeReasonNodeLabelingFailed,
 				Message: fmt.Sprintf("could not label node %s, error: %v", pod.Spec.NodeName, err),
 			}
 		}
+		h.recorder.Eventf(volumeManagerRef(ns, controllerRef), corev1.EventTypeNormal, "NodeLabeled", "labeled node %s with %s", pod.Spec.NodeName, nodeLabelKey)
 
 	}
 
+	// The size of the data is only known once all the replicas are
+	// downloaded together.
+	if len(replicas) == vc.Replicas {
+		metrics.ProvisionedBytes.WithLabelValues(ns, controllerRef.Name, vc.ID).Set(float64(provisionedBytes))
+	}
+
 	return vckv1alpha1.Volume{
-		ID: vc.ID,
+		ID:     vc.ID,
+		Phase:  vckv1alpha1.VolumeReady,
+		Reason: vckv1alpha1.VolumeReasonProvisioned,
 		VolumeSource: corev1.VolumeSource{
 			HostPath: &corev1.HostPathVolumeSource{
 				Path: fmt.Sprintf("%s/%s", vc.Options["dataPath"], vckDataPathSuffix),
@@ -252,21 +294,22 @@ func (h *pachydermHandler) OnAdd(ns string, vc vckv1alpha1.VolumeConfig, control
 				},
 			},
 		},
-		Message: vckv1alpha1.SuccessfulVolumeStatusMessage,
 	}
 }
 
-func (h *pachydermHandler) OnDelete(ns string, vc vckv1alpha1.VolumeConfig, vStatus vckv1alpha1.Volume, controllerRef metav1.OwnerReference) {
+func (h *pachydermHandler) OnDelete(ctx context.Context, ns string, vc vckv1alpha1.VolumeConfig, vStatus vckv1alpha1.Volume, controllerRef metav1.OwnerReference) error {
 	nodeLabelKey := fmt.Sprintf("%s/%s-%s-%s", vckv1alpha1.GroupName, ns, controllerRef.Name, vc.ID)
 	podClient := getK8SResourceClientFromPlural(h.k8sResourceClients, "pods")
+	errs := []error{}
+	metrics.ProvisionedBytes.DeleteLabelValues(ns, controllerRef.Name, vc.ID)
 
 	if vStatus.VolumeSource != (corev1.VolumeSource{}) {
 		vckNames := []string{}
 		for i := 0; i < vc.Replicas; i++ {
-			vckName := fmt.Sprintf("%s%s", vckNamePrefix, uuid.NewUUID())
+			vckName := vckNameFor(controllerRef, vc.ID, "delete", strconv.Itoa(i))
 			vckNames = append(vckNames, vckName)
 
-			err := podClient.Create(ns, struct {
+			err := podClient.Create(ctx, ns, struct {
 				vckv1alpha1.VolumeConfig
 				metav1.OwnerReference
 				NS              string
@@ -288,23 +331,28 @@ func (h *pachydermHandler) OnDelete(ns string, vc vckv1alpha1.VolumeConfig, vSta
 
 			if err != nil {
 				glog.Warningf("error during sub-resource [%s] deletion: %v", podClient.Plural(), err)
+				h.recorder.Eventf(volumeManagerRef(ns, controllerRef), corev1.EventTypeWarning, "CleanupPodFailed", "error creating cleanup pod %s for volume %s: %v", vckName, vc.ID, err)
+				errs = append(errs, fmt.Errorf("error during sub-resource [%s] deletion: %v", podClient.Plural(), err))
 			}
 		}
 
 		timeout, _ := time.ParseDuration("3m")
+		scheduling, _ := schedulingTimeout(vc)
 		for _, vckName := range vckNames {
-			err := waitForPodSuccess(podClient, vckName, ns, timeout)
+			err := waitForPodSuccess(ctx, podClient, vckName, ns, timeout, scheduling)
 			if err != nil {
-				// TODO(balajismaniam): append pod logs to this message if possible.
-				glog.Warningf("error during data deletion using pod [name: %v]: %v", vckName, err)
+				errs = append(errs, cleanupFailed(ctx, podClient, h.logs, h.recorder, ns, vc, controllerRef, vckName, err))
+			}
+			if err := podClient.Delete(ctx, ns, vckName); err != nil && !errors.IsNotFound(err) {
+				errs = append(errs, err)
 			}
-			podClient.Delete(ns, vckName)
 		}
 	}
 
-	podList, err := podClient.List(ns, vc.Labels)
+	podList, err := podClient.List(ctx, ns, resource.ListOptions{Labels: subResourceLabels(vc, controllerRef)})
 	if err != nil {
 		glog.Warningf("[pachyderm-handler] OnDelete: error while listing resource [%s], %v", podClient.Plural(), err)
+		errs = append(errs, err)
 	}
 
 	for _, resource := range podList {
@@ -314,7 +362,9 @@ func (h *pachydermHandler) OnDelete(ns string, vc vckv1alpha1.VolumeConfig, vSta
 		}
 
 		if resControllerRef.UID == controllerRef.UID {
-			podClient.Delete(ns, resource.GetName())
+			if err := podClient.Delete(ctx, ns, resource.GetName()); err != nil && !errors.IsNotFound(err) {
+				errs = append(errs, err)
+			}
 		}
 	}
 
@@ -322,23 +372,39 @@ func (h *pachydermHandler) OnDelete(ns string, vc vckv1alpha1.VolumeConfig, vSta
 	nodeClient := getK8SResourceClientFromPlural(h.k8sResourceClients, "nodes")
 
 	// Get the node list based on the label
-	nodeList, err := nodeClient.List("", map[string]string{nodeLabelKey: "true"})
+	nodeList, err := nodeClient.List(ctx, "", resource.ListOptions{Labels: map[string]string{nodeLabelKey: "true"}})
 	if err != nil {
 		glog.Warningf("[pachyderm-handler] OnDelete: error while listing nodes %v", err)
-		return
+		return utilerrors.NewAggregate(append(errs, err))
 	}
 	nodeNames := getNodeNames(nodeList)
 
 	for _, nodeName := range nodeNames {
 
-		node, err := nodeClient.Get("", nodeName)
+		err := patchNodeLabels(ctx, nodeClient, nodeName, []string{nodeLabelKey}, "delete")
 		if err != nil {
-			glog.Warningf("[pachyderm-handler] OnDelete: error while getting node: %v", err)
+			glog.Warningf("[pachyderm-handler] OnDelete: error while deleting label for node nodes %v", err)
+			errs = append(errs, err)
+			continue
 		}
+		h.recorder.Eventf(volumeManagerRef(ns, controllerRef), corev1.EventTypeNormal, "NodeUnlabeled", "removed label %s from node %s", nodeLabelKey, nodeName)
+	}
 
-		err = updateNodeWithLabels(nodeClient, node.(*corev1.Node), []string{nodeLabelKey}, "delete")
-		if err != nil {
-			glog.Warningf("[pachyderm-handler] OnDelete: error while deleting label for node nodes %v", err)
+	return utilerrors.NewAggregate(errs)
+}
+
+func (h *pachydermHandler) OnRepair(ctx context.Context, ns string, vc vckv1alpha1.VolumeConfig, vStatus vckv1alpha1.Volume, controllerRef metav1.OwnerReference) ([]string, error) {
+	nodeLabelKey := fmt.Sprintf("%s/%s-%s-%s", vckv1alpha1.GroupName, ns, controllerRef.Name, vc.ID)
+	podClient := getK8SResourceClientFromPlural(h.k8sResourceClients, "pods")
+	nodeClient := getK8SResourceClientFromPlural(h.k8sResourceClients, "nodes")
+
+	redownload := func(replicas []int, excludedNodes []string) error {
+		vStatus := h.provision(ctx, ns, vc, controllerRef, replicas, excludedNodes, func(vckv1alpha1.VolumePhase) {})
+		if vStatus.Phase != vckv1alpha1.VolumeReady {
+			return fmt.Errorf("%s", vStatus.Message)
 		}
+		return nil
 	}
+
+	return repairHostPathVolume(ctx, podClient, nodeClient, h.recorder, ns, vc, vStatus, controllerRef, nodeLabelKey, redownload)
 }
@@ -0,0 +1,162 @@
+//
+// Copyright (c) 2018 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: EPL-2.0
+//
+
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+
+	vckv1alpha1 "github.com/IntelAI/vck/pkg/apis/vck/v1alpha1"
+	"github.com/IntelAI/vck/pkg/resource"
+)
+
+const (
+	// The number of lines retrieved from the end of the logs of a container.
+	podLogTailLines = 20
+
+	// The maximum length of the logs of a container attached to a volume
+	// status or an event. The end of the logs is kept.
+	maxContainerLogLength = 1024
+)
+
+// podLogger returns the tail of the logs of a container of a pod.
+type podLogger func(ns, podName, containerName string) (string, error)
+
+// clientsetLogger returns a podLogger retrieving the logs from the API server.
+func clientsetLogger(k8sClientset kubernetes.Interface) podLogger {
+	return func(ns, podName, containerName string) (string, error) {
+		tailLines := int64(podLogTailLines)
+		logs, err := k8sClientset.CoreV1().Pods(ns).GetLogs(podName, &corev1.PodLogOptions{
+			Container: containerName,
+			TailLines: &tailLines,
+		}).DoRaw()
+		return string(logs), err
+	}
+}
+
+// containerStatuses returns the statuses of the init containers of a pod
+// followed by the ones of its main containers.
+func containerStatuses(pod *corev1.Pod) []corev1.ContainerStatus {
+	return append(append([]corev1.ContainerStatus{}, pod.Status.InitContainerStatuses...), pod.Status.ContainerStatuses...)
+}
+
+// podFailureReasons returns why a pod cannot run or why its containers
+// failed, e.g. because it is unschedulable, its image cannot be pulled or a
+// container was OOMKilled.
+func podFailureReasons(pod *corev1.Pod) []string {
+	reasons := []string{}
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodScheduled && condition.Status == corev1.ConditionFalse {
+			reasons = append(reasons, fmt.Sprintf("pod not scheduled: %s: %s", condition.Reason, condition.Message))
+		}
+	}
+
+	for _, status := range containerStatuses(pod) {
+		waiting, terminated := status.State.Waiting, status.State.Terminated
+		switch {
+		case waiting != nil && waiting.Reason != "" && waiting.Reason != "ContainerCreating" && waiting.Reason != "PodInitializing":
+			reason := fmt.Sprintf("container %s waiting: %s", status.Name, waiting.Reason)
+			if waiting.Message != "" {
+				reason = fmt.Sprintf("%s: %s", reason, waiting.Message)
+			}
+			reasons = append(reasons, reason)
+		case terminated != nil && terminated.ExitCode != 0:
+			reasons = append(reasons, fmt.Sprintf("container %s terminated: %s (exit code %d)", status.Name, terminated.Reason, terminated.ExitCode))
+		}
+	}
+	return reasons
+}
+
+// podDiagnostics describes why a download or cleanup pod failed, using the
+// reasons of its failure and the tail of the logs of its init and main
+// containers. The diagnostics are best effort, what cannot be retrieved is
+// left out.
+func podDiagnostics(ctx context.Context, podClient resource.Client, logs podLogger, ns, podName string) string {
+	obj, err := podClient.Get(ctx, ns, podName)
+	if err != nil {
+		glog.Warningf("could not get pod [name: %v] for its diagnostics: %v", podName, err)
+		return ""
+	}
+	pod, ok := obj.(*corev1.Pod)
+	if !ok {
+		return ""
+	}
+
+	diagnostics := podFailureReasons(pod)
+	for _, status := range containerStatuses(pod) {
+		// Only the containers which have started have logs.
+		if status.State.Running == nil && status.State.Terminated == nil && status.LastTerminationState.Terminated == nil {
+			continue
+		}
+
+		containerLogs, err := logs(ns, podName, status.Name)
+		if err != nil {
+			glog.Warningf("could not get the logs of container %s of pod [name: %v]: %v", status.Name, podName, err)
+			continue
+		}
+
+		containerLogs = strings.TrimSpace(containerLogs)
+		if containerLogs == "" {
+			continue
+		}
+		if len(containerLogs) > maxContainerLogLength {
+			containerLogs = "..." + containerLogs[len(containerLogs)-maxContainerLogLength:]
+		}
+		diagnostics = append(diagnostics, fmt.Sprintf("logs of container %s: %s", status.Name, containerLogs))
+	}
+	return strings.Join(diagnostics, "; ")
+}
+
+// withDiagnostics appends the diagnostics of a pod, if any, to a message.
+func withDiagnostics(message, diagnostics string) string {
+	if diagnostics == "" {
+		return message
+	}
+	return fmt.Sprintf("%s (%s)", message, diagnostics)
+}
+
+// downloadFailed records the failure of the download pod of a replica along
+// with the diagnostics of the pod and returns the failed volume.
+func downloadFailed(ctx context.Context, podClient resource.Client, logs podLogger, recorder record.EventRecorder, ns string, vc vckv1alpha1.VolumeConfig, controllerRef metav1.OwnerReference, replica int, vckName string, err error) vckv1alpha1.Volume {
+	diagnostics := podDiagnostics(ctx, podClient, logs, ns, vckName)
+	recorder.Eventf(volumeManagerRef(ns, controllerRef), corev1.EventTypeWarning, "DownloadFailed", "replica %d of volume %s failed using pod %s: %s", replica, vc.ID, vckName, withDiagnostics(err.Error(), diagnostics))
+	return vckv1alpha1.Volume{
+		ID:      vc.ID,
+		Phase:   vckv1alpha1.VolumeFailed,
+		Reason:  downloadReason(err),
+		Message: fmt.Sprintf("error during data download using pod [name: %v]: %s", vckName, withDiagnostics(err.Error(), diagnostics)),
+	}
+}
+
+// cleanupFailed records the failure of a cleanup pod along with the
+// diagnostics of the pod and returns the error to be reported in the status of
+// the volume.
+func cleanupFailed(ctx context.Context, podClient resource.Client, logs podLogger, recorder record.EventRecorder, ns string, vc vckv1alpha1.VolumeConfig, controllerRef metav1.OwnerReference, vckName string, err error) error {
+	diagnostics := podDiagnostics(ctx, podClient, logs, ns, vckName)
+	glog.Warningf("error during data deletion using pod [name: %v]: %v", vckName, withDiagnostics(err.Error(), diagnostics))
+	recorder.Eventf(volumeManagerRef(ns, controllerRef), corev1.EventTypeWarning, "CleanupPodFailed", "cleanup pod %s of volume %s failed: %s", vckName, vc.ID, withDiagnostics(err.Error(), diagnostics))
+	return fmt.Errorf("error during data deletion using pod [name: %v]: %s", vckName, withDiagnostics(err.Error(), diagnostics))
+}
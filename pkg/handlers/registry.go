@@ -0,0 +1,79 @@
+//
+// Copyright (c) 2018 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: EPL-2.0
+//
+
+package handlers
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	vckv1alpha1 "github.com/IntelAI/vck/pkg/apis/vck/v1alpha1"
+)
+
+// Registry resolves the source types of volume configs to data handlers.
+// Source types are matched case-insensitively, either against the source type
+// of a data handler or against one of its aliases.
+type Registry struct {
+	sourceTypes []string
+	byName      map[string]DataHandler
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		byName: map[string]DataHandler{},
+	}
+}
+
+// Register adds a data handler along with aliases for its source type. It
+// returns an error if the source type or any of the aliases is already
+// registered, or if they are not distinct from each other.
+func (r *Registry) Register(handler DataHandler, aliases ...string) error {
+	names := append([]string{string(handler.GetSourceType())}, aliases...)
+	seen := map[string]bool{}
+	for _, name := range names {
+		if existing, ok := r.byName[strings.ToLower(name)]; ok {
+			return fmt.Errorf("source type %q is already registered for the %s data handler", name, existing.GetSourceType())
+		}
+		if seen[strings.ToLower(name)] {
+			return fmt.Errorf("source type %q is given more than once for the %s data handler", name, handler.GetSourceType())
+		}
+		seen[strings.ToLower(name)] = true
+	}
+
+	for _, name := range names {
+		r.byName[strings.ToLower(name)] = handler
+		r.sourceTypes = append(r.sourceTypes, name)
+	}
+	sort.Strings(r.sourceTypes)
+	return nil
+}
+
+// Lookup returns the data handler for the supplied source type, or nil if no
+// data handler supports it.
+func (r *Registry) Lookup(sourceType vckv1alpha1.DataSourceType) DataHandler {
+	return r.byName[strings.ToLower(string(sourceType))]
+}
+
+// SourceTypes returns the supported source types, including the aliases, in
+// alphabetical order. The returned slice is a copy which the caller may
+// modify.
+func (r *Registry) SourceTypes() []string {
+	return append([]string(nil), r.sourceTypes...)
+}
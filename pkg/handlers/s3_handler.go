@@ -19,6 +19,7 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/url"
@@ -27,14 +28,16 @@ import (
 	"time"
 
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/util/uuid"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 
 	"github.com/golang/glog"
 
-	"bytes"
 	vckv1alpha1 "github.com/IntelAI/vck/pkg/apis/vck/v1alpha1"
+	"github.com/IntelAI/vck/pkg/metrics"
 	"github.com/IntelAI/vck/pkg/resource"
 )
 
@@ -46,14 +49,22 @@ type s3Handler struct {
 	sourceType         vckv1alpha1.DataSourceType
 	k8sClientset       kubernetes.Interface
 	k8sResourceClients []resource.Client
+	recorder           record.EventRecorder
+	limiter            *DownloadLimiter
+	// logs retrieves the logs of the failed download and cleanup pods.
+	logs podLogger
 }
 
-// NewS3Handler creates and returns an instance of the NFS handler.
-func NewS3Handler(k8sClientset kubernetes.Interface, resourceClients []resource.Client) DataHandler {
+// NewS3Handler creates and returns an instance of the NFS handler. The
+// download pods are created within the limits of the supplied limiter.
+func NewS3Handler(k8sClientset kubernetes.Interface, resourceClients []resource.Client, recorder record.EventRecorder, limiter *DownloadLimiter) DataHandler {
 	return &s3Handler{
 		sourceType:         s3SourceType,
 		k8sClientset:       k8sClientset,
 		k8sResourceClients: resourceClients,
+		recorder:           recorder,
+		limiter:            limiter,
+		logs:               clientsetLogger(k8sClientset),
 	}
 }
 
@@ -61,81 +72,112 @@ func (h *s3Handler) GetSourceType() vckv1alpha1.DataSourceType {
 	return h.sourceType
 }
 
-func (h *s3Handler) OnAdd(ns string, vc vckv1alpha1.VolumeConfig, controllerRef metav1.OwnerReference) vckv1alpha1.Volume {
-	if len(vc.Labels) == 0 {
-		return vckv1alpha1.Volume{
-			ID:      vc.ID,
-			Message: fmt.Sprintf("labels cannot be empty"),
-		}
+// Validate checks the options of an S3 volume config.
+func (h *s3Handler) Validate(ns string, vc vckv1alpha1.VolumeConfig) error {
+	if err := validateLabels(vc); err != nil {
+		return err
 	}
 
 	if _, ok := vc.Options["awsCredentialsSecretName"]; !ok {
-		return vckv1alpha1.Volume{
-			ID:      vc.ID,
-			Message: fmt.Sprintf("awsCredentialsSecretName key has to be set in options"),
+		return &validationError{
+			reason:  vckv1alpha1.VolumeReasonCredentialsMissing,
+			message: fmt.Sprintf("awsCredentialsSecretName key has to be set in options"),
 		}
 	}
 
 	if vc.AccessMode != "ReadWriteOnce" {
-		return vckv1alpha1.Volume{
-			ID:      vc.ID,
-			Message: fmt.Sprintf("access mode has to be ReadWriteOnce"),
-		}
+		return invalidOptions("access mode has to be ReadWriteOnce")
 	}
 
 	if _, ok := vc.Options["sourceURL"]; !ok {
-		return vckv1alpha1.Volume{
-			ID:      vc.ID,
-			Message: fmt.Sprintf("sourceURL has to be set in options"),
-		}
+		return invalidOptions("sourceURL has to be set in options")
 	}
 
-	if _, ok := vc.Options["endpointURL"]; !ok {
-		vc.Options["EndpointURL"] = "https://s3.amazonaws.com"
+	if _, err := downloadTimeout(vc); err != nil {
+		return invalidOptions("%v", err)
 	}
 
-	// Check if dataPath  was set and  if not set default to /var/datasets.
-	if _, ok := vc.Options["dataPath"]; !ok {
-		vc.Options["dataPath"] = "/var/datasets"
+	if _, err := schedulingTimeout(vc); err != nil {
+		return invalidOptions("%v", err)
 	}
 
-	// Set the default timeout for data download using a pod to 5 minutes.
-	timeout, err := time.ParseDuration("5m")
-	// Check if timeout for data download was set and use it.
-	if _, ok := vc.Options["timeoutForDataDownload"]; ok {
-		timeout, err = time.ParseDuration(vc.Options["timeoutForDataDownload"])
-		if err != nil {
-			return vckv1alpha1.Volume{
-				ID:      vc.ID,
-				Message: fmt.Sprintf("error while parsing timeout for data download: %v", err),
-			}
-		}
+	resync, err := s3Resync(vc)
+	if err != nil {
+		return invalidOptions("%v", err)
 	}
 
-	resync := false
-	// Check if resync was set and use it.
-	if _, ok := vc.Options["resync"]; ok {
-		resync, err = strconv.ParseBool(vc.Options["resync"])
-		if err != nil {
-			return vckv1alpha1.Volume{
-				ID:      vc.ID,
-				Message: fmt.Sprintf("error while parsing resync option: %v", err),
-			}
-		}
+	if resync && vc.Replicas > 1 {
+		return invalidOptions("replicas cannot be > 1 when resync is set")
 	}
 
-	if resync && vc.Replicas > 1 {
-		return vckv1alpha1.Volume{
-			ID:      vc.ID,
-			Message: fmt.Sprintf("replicas cannot be > 1 when resync is set"),
+	if distributionStrategy, ok := vc.Options["distributionStrategy"]; ok {
+		var distributionMap map[string]int
+		if err := json.Unmarshal([]byte(distributionStrategy), &distributionMap); err != nil {
+			return invalidOptions("invalid distributionStrategy [%v] specified, it must be a map[string]int", distributionStrategy)
+		}
+
+		replicaCount := 0
+		for _, replicas := range distributionMap {
+			replicaCount += replicas
+		}
+		if replicaCount != vc.Replicas {
+			return invalidOptions("total number of replicas: [%v] in distributionStrategy [%v], does not match number of replicas provided: [%v]", replicaCount, distributionStrategy, vc.Replicas)
 		}
 	}
 
+	if _, err := url.Parse(vc.Options["sourceURL"]); err != nil {
+		return invalidOptions("error while parsing URL [%s]: %v", vc.Options["sourceURL"], err)
+	}
+
+	return nil
+}
+
+// s3Resync returns the resync option of a volume config, false by default.
+func s3Resync(vc vckv1alpha1.VolumeConfig) (bool, error) {
+	if _, ok := vc.Options["resync"]; !ok {
+		return false, nil
+	}
+
+	resync, err := strconv.ParseBool(vc.Options["resync"])
+	if err != nil {
+		return false, fmt.Errorf("error while parsing resync option: %v", err)
+	}
+	return resync, nil
+}
+
+func (h *s3Handler) OnAdd(ctx context.Context, ns string, vc vckv1alpha1.VolumeConfig, controllerRef metav1.OwnerReference, setPhase PhaseFunc) vckv1alpha1.Volume {
+	return h.provision(ctx, ns, vc, controllerRef, nil, nil, setPhase)
+}
+
+// provision downloads the supplied replicas of a volume, all of them if
+// replicas is nil, keeping the download pods off the nodes with the excluded
+// hostnames.
+func (h *s3Handler) provision(ctx context.Context, ns string, vc vckv1alpha1.VolumeConfig, controllerRef metav1.OwnerReference, replicas []int, excludedNodes []string, setPhase PhaseFunc) vckv1alpha1.Volume {
+	if err := h.Validate(ns, vc); err != nil {
+		return InvalidVolume(vc.ID, err)
+	}
+
+	if _, ok := vc.Options["endpointURL"]; !ok {
+		vc.Options["EndpointURL"] = "https://s3.amazonaws.com"
+	}
+
+	// Check if dataPath  was set and  if not set default to /var/datasets.
+	if _, ok := vc.Options["dataPath"]; !ok {
+		vc.Options["dataPath"] = "/var/datasets"
+	}
+
+	// The options have been validated above.
+	timeout, _ := downloadTimeout(vc)
+	scheduling, _ := schedulingTimeout(vc)
+	resync, _ := s3Resync(vc)
+
 	nodeClient := getK8SResourceClientFromPlural(h.k8sResourceClients, "nodes")
-	nodeList, err := nodeClient.List(ns, map[string]string{})
+	nodeList, err := nodeClient.List(ctx, "", resource.ListOptions{})
 	if err != nil {
 		return vckv1alpha1.Volume{
 			ID:      vc.ID,
+			Phase:   vckv1alpha1.VolumeFailed,
+			Reason:  vckv1alpha1.VolumeReasonNodeListFailed,
 			Message: fmt.Sprintf("error getting node list: %v", err),
 		}
 	}
@@ -143,27 +185,21 @@ func (h *s3Handler) OnAdd(ns string, vc vckv1alpha1.VolumeConfig, controllerRef
 	// If number of nodes < replicas, then return immediately.
 	if len(nodeList) < vc.Replicas {
 		return vckv1alpha1.Volume{
-			ID: vc.ID,
+			ID:     vc.ID,
+			Phase:  vckv1alpha1.VolumeFailed,
+			Reason: vckv1alpha1.VolumeReasonInsufficientNodes,
 			Message: fmt.Sprintf("replicas [%v] greater than number of nodes [%v]",
 				vc.Replicas, len(nodeList)),
 		}
 	}
 
-	vckDataPathSuffix := fmt.Sprintf("%s%s", vckNamePrefix, uuid.NewUUID())
+	vckDataPathSuffix := vckNameFor(controllerRef, vc.ID)
 	vckPath := fmt.Sprintf("%s/%s", vc.Options["dataPath"], vckDataPathSuffix)
 	copyCommand := []string{}
 
 	if distributionStrategy, ok := vc.Options["distributionStrategy"]; ok {
 		var distributionMap map[string]int
-
-		err := json.Unmarshal([]byte(distributionStrategy), &distributionMap)
-		if err != nil {
-			return vckv1alpha1.Volume{
-				ID:      vc.ID,
-				Message: fmt.Sprintf("invalid distributionStrategy [%v] specified, it must be a map[string]int", distributionStrategy),
-			}
-		}
-		replicaCount := 0
+		json.Unmarshal([]byte(distributionStrategy), &distributionMap)
 
 		for filter, replicas := range distributionMap {
 
@@ -172,13 +208,6 @@ func (h *s3Handler) OnAdd(ns string, vc vckv1alpha1.VolumeConfig, controllerRef
 				if resync {
 					copyCommand[i] = strings.Join([]string{copyCommand[i], "mc mirror -w --overwrite ${DATA_PATH} s3/${BUCKET_NAME}"}, "; ")
 				}
-				replicaCount++
-			}
-		}
-		if replicaCount != vc.Replicas {
-			return vckv1alpha1.Volume{
-				ID:      vc.ID,
-				Message: fmt.Sprintf("total number of replicas: [%v] in distributionStrategy [%v], does not match number of replicas provided: [%v]", replicaCount, distributionStrategy, vc.Replicas),
 			}
 		}
 	} else {
@@ -195,23 +224,27 @@ func (h *s3Handler) OnAdd(ns string, vc vckv1alpha1.VolumeConfig, controllerRef
 		recursiveFlag = "--recursive"
 	}
 
-	s3URL, err := url.Parse(vc.Options["sourceURL"])
-	if err != nil {
-		return vckv1alpha1.Volume{
-			ID:      vc.ID,
-			Message: fmt.Sprintf("error while parsing URL [%s]: %v", vc.Options["sourceURL"], err),
-		}
-	}
+	s3URL, _ := url.Parse(vc.Options["sourceURL"])
 	bucketName := s3URL.Host
 	bucketPath := s3URL.Path
 
+	if replicas == nil {
+		for i := 0; i < vc.Replicas; i++ {
+			replicas = append(replicas, i)
+		}
+	}
+
 	vckNames := []string{}
-	podClient := getK8SResourceClientFromPlural(h.k8sResourceClients, "pods")
-	for i := 0; i < vc.Replicas; i++ {
-		vckName := fmt.Sprintf("%s%s", vckNamePrefix, uuid.NewUUID())
-		vckNames = append(vckNames, vckName)
+	for _, i := range replicas {
+		vckNames = append(vckNames, vckNameFor(controllerRef, vc.ID, "add", strconv.Itoa(i)))
+	}
 
-		err = podClient.Create(ns, struct {
+	// The replicas are downloaded concurrently.
+	podClient := getK8SResourceClientFromPlural(h.k8sResourceClients, "pods")
+	create := func(i int, allowedNodes []string) error {
+		podVC := vc
+		podVC.NodeAffinity = includeNodes(excludeNodes(vc.NodeAffinity, excludedNodes), allowedNodes)
+		err := podClient.Create(ctx, ns, struct {
 			vckv1alpha1.VolumeConfig
 			metav1.OwnerReference
 			NS              string
@@ -222,79 +255,69 @@ func (h *s3Handler) OnAdd(ns string, vc vckv1alpha1.VolumeConfig, controllerRef
 			BucketPath      string
 			VCKOptions      map[string]string
 		}{
-			vc,
+			podVC,
 			controllerRef,
 			ns,
-			vckName,
+			vckNames[i],
 			"add",
 			recursiveFlag,
 			bucketName,
 			bucketPath,
 			map[string]string{
 				"path":        vckPath,
-				"copyCommand": copyCommand[i],
+				"copyCommand": copyCommand[replicas[i]],
 			},
 		})
-
 		if err != nil {
-			return vckv1alpha1.Volume{
-				ID:      vc.ID,
-				Message: fmt.Sprintf("error during sub-resource [%s] creation: %v", podClient.Plural(), err),
-			}
+			return err
 		}
-	}
-
-	usedNodeNames := []string{}
-	nodeLabelKey := fmt.Sprintf("%s/%s-%s-%s", vckv1alpha1.GroupName, ns, controllerRef.Name, vc.ID)
-	for _, vckName := range vckNames {
-		var err error
-		podRunning := true
-		if !resync {
-			err = waitForPodSuccess(podClient, vckName, ns, timeout)
-		} else {
-			podRunning = isPodRunningAfterTimeout(podClient, vckName, ns, timeout)
-		}
-
-		if err != nil || !podRunning {
-			downloadErrMsg := "error during data download using pod"
 
-			podResource := h.k8sClientset.CoreV1().RESTClient().Get().Namespace(ns).Name(vckName).Resource("pods")
-			if podResource == nil {
-				return vckv1alpha1.Volume{
-					ID:      vc.ID,
-					Message: fmt.Sprintf("%v [name: %v]: %v", downloadErrMsg, vckName, err),
-				}
-			}
-
-			logReq := podResource.SubResource("log")
-			if logReq == nil {
-				return vckv1alpha1.Volume{
-					ID:      vc.ID,
-					Message: fmt.Sprintf("%v [name: %v]: %v", downloadErrMsg, vckName, err),
-				}
-			}
-
-			readCloser, logErr := logReq.Stream()
-			if logErr != nil {
-				return vckv1alpha1.Volume{
-					ID:      vc.ID,
-					Message: fmt.Sprintf("%v [name: %v]: %v", downloadErrMsg, vckName, err),
-				}
+		h.recorder.Eventf(volumeManagerRef(ns, controllerRef), corev1.EventTypeNormal, "PodCreated", "created download pod %s for volume %s", vckNames[i], vc.ID)
+		return nil
+	}
+	wait := func(vckName string) error {
+		if resync {
+			if !isPodRunningAfterTimeout(ctx, podClient, vckName, ns, timeout) {
+				return errPodNotRunning
 			}
+			return nil
+		}
+		return waitForPodSuccess(ctx, podClient, vckName, ns, timeout, scheduling)
+	}
 
-			defer readCloser.Close()
-			logBuf := new(bytes.Buffer)
-			logBuf.ReadFrom(readCloser)
+	setPhase(vckv1alpha1.VolumeDownloading)
+	downloads := downloadReplicas(ctx, h.limiter, podClient, ns, vc, controllerRef, nodeList, excludedNodes, vckNames, scheduling, create, wait)
+	if ctx.Err() != nil {
+		return abortDownload(ctx, podClient, ns, vc, vckNames)
+	}
+	for _, download := range downloads {
+		if download.createErr != nil {
 			return vckv1alpha1.Volume{
 				ID:      vc.ID,
-				Message: fmt.Sprintf("%v [name: %v]: %v", downloadErrMsg, vckName, logBuf.String()),
+				Phase:   vckv1alpha1.VolumeFailed,
+				Reason:  vckv1alpha1.VolumeReasonResourceCreationFailed,
+				Message: fmt.Sprintf("error during sub-resource [%s] creation: %v", podClient.Plural(), download.createErr),
 			}
 		}
+	}
 
-		podObj, err := podClient.Get(ns, vckName)
+	for i, vckName := range vckNames {
+		if err := downloads[i].waitErr; err != nil {
+			return downloadFailed(ctx, podClient, h.logs, h.recorder, ns, vc, controllerRef, replicas[i], vckName, err)
+		}
+	}
+
+	setPhase(vckv1alpha1.VolumeLabeling)
+	usedNodeNames := []string{}
+	provisionedBytes := int64(0)
+	nodeLabelKey := fmt.Sprintf("%s/%s-%s-%s", vckv1alpha1.GroupName, ns, controllerRef.Name, vc.ID)
+	for i, vckName := range vckNames {
+		podObj, err := podClient.Get(ctx, ns, vckName)
 		if err != nil {
 			return vckv1alpha1.Volume{
 				ID:      vc.ID,
+				Phase:   vckv1alpha1.VolumeFailed,
+				Reason:  vckv1alpha1.VolumeReasonPodLookupFailed,
 				Message: fmt.Sprintf("error getting pod [name: %v]: %v", vckName, err),
 			}
 		}
@@ -303,32 +326,42 @@ func (h *s3Handler) OnAdd(ns string, vc vckv1alpha1.VolumeConfig, controllerRef
 		if !ok {
 			return vckv1alpha1.Volume{
 				ID:      vc.ID,
+				Phase:   vckv1alpha1.VolumeFailed,
+				Reason:  vckv1alpha1.VolumeReasonPodLookupFailed,
 				Message: fmt.Sprintf("object returned from podclient.Get() is not a pod"),
 			}
 		}
 
 		usedNodeNames = append(usedNodeNames, pod.Spec.NodeName)
-
-		node, err := nodeClient.Get("", pod.Spec.NodeName)
-		if err != nil {
-			return vckv1alpha1.Volume{
-				ID:      vc.ID,
-				Message: fmt.Sprintf("could not get node %s, error: %v", pod.Spec.NodeName, err),
-			}
+		if !resync {
+			metrics.DownloadPodDuration.WithLabelValues(string(h.sourceType)).Observe(podDuration(pod).Seconds())
+			provisionedBytes += podDataBytes(pod)
 		}
-		// update nodes with the correct label
-		err = updateNodeWithLabels(nodeClient, node.(*corev1.Node), []string{nodeLabelKey}, "add")
+		h.recorder.Eventf(volumeManagerRef(ns, controllerRef), corev1.EventTypeNormal, "DownloadSucceeded", "replica %d of volume %s downloaded on node %s", replicas[i], vc.ID, pod.Spec.NodeName)
 
+		// update nodes with the correct label
+		err = patchNodeLabels(ctx, nodeClient, pod.Spec.NodeName, []string{nodeLabelKey}, "add")
 		if err != nil {
 			return vckv1alpha1.Volume{
 				ID:      vc.ID,
+				Phase:   vckv1alpha1.VolumeFailed,
+				Reason:  vckv1alpha1.VolumeReasonNodeLabelingFailed,
 				Message: fmt.Sprintf("could not label node %s, error: %v", pod.Spec.NodeName, err),
 			}
 		}
+		h.recorder.Eventf(volumeManagerRef(ns, controllerRef), corev1.EventTypeNormal, "NodeLabeled", "labeled node %s with %s", pod.Spec.NodeName, nodeLabelKey)
+	}
+
+	// The size of the data is only known once all the replicas are
+	// downloaded together.
+	if len(replicas) == vc.Replicas {
+		metrics.ProvisionedBytes.WithLabelValues(ns, controllerRef.Name, vc.ID).Set(float64(provisionedBytes))
 	}
 
 	return vckv1alpha1.Volume{
-		ID: vc.ID,
+		ID:     vc.ID,
+		Phase:  vckv1alpha1.VolumeReady,
+		Reason: vckv1alpha1.VolumeReasonProvisioned,
 		VolumeSource: corev1.VolumeSource{
 			HostPath: &corev1.HostPathVolumeSource{
 				Path: fmt.Sprintf("%s/%s", vc.Options["dataPath"], vckDataPathSuffix),
@@ -348,21 +381,22 @@ func (h *s3Handler) OnAdd(ns string, vc vckv1alpha1.VolumeConfig, controllerRef
 				},
 			},
 		},
-		Message: vckv1alpha1.SuccessfulVolumeStatusMessage,
 	}
 }
 
-func (h *s3Handler) OnDelete(ns string, vc vckv1alpha1.VolumeConfig, vStatus vckv1alpha1.Volume, controllerRef metav1.OwnerReference) {
+func (h *s3Handler) OnDelete(ctx context.Context, ns string, vc vckv1alpha1.VolumeConfig, vStatus vckv1alpha1.Volume, controllerRef metav1.OwnerReference) error {
 	nodeLabelKey := fmt.Sprintf("%s/%s-%s-%s", vckv1alpha1.GroupName, ns, controllerRef.Name, vc.ID)
 	podClient := getK8SResourceClientFromPlural(h.k8sResourceClients, "pods")
+	errs := []error{}
+	metrics.ProvisionedBytes.DeleteLabelValues(ns, controllerRef.Name, vc.ID)
 
 	if vStatus.VolumeSource != (corev1.VolumeSource{}) {
 		vckNames := []string{}
 		for i := 0; i < vc.Replicas; i++ {
-			vckName := fmt.Sprintf("%s%s", vckNamePrefix, uuid.NewUUID())
+			vckName := vckNameFor(controllerRef, vc.ID, "delete", strconv.Itoa(i))
 			vckNames = append(vckNames, vckName)
 
-			err := podClient.Create(ns, struct {
+			err := podClient.Create(ctx, ns, struct {
 				vckv1alpha1.VolumeConfig
 				metav1.OwnerReference
 				NS              string
@@ -384,23 +418,28 @@ func (h *s3Handler) OnDelete(ns string, vc vckv1alpha1.VolumeConfig, vStatus vck
 
 			if err != nil {
 				glog.Warningf("error during sub-resource [%s] deletion: %v", podClient.Plural(), err)
+				h.recorder.Eventf(volumeManagerRef(ns, controllerRef), corev1.EventTypeWarning, "CleanupPodFailed", "error creating cleanup pod %s for volume %s: %v", vckName, vc.ID, err)
+				errs = append(errs, fmt.Errorf("error during sub-resource [%s] deletion: %v", podClient.Plural(), err))
 			}
 		}
 
 		timeout, _ := time.ParseDuration("3m")
+		scheduling, _ := schedulingTimeout(vc)
 		for _, vckName := range vckNames {
-			err := waitForPodSuccess(podClient, vckName, ns, timeout)
+			err := waitForPodSuccess(ctx, podClient, vckName, ns, timeout, scheduling)
 			if err != nil {
-				// TODO(balajismaniam): append pod logs to this message if possible.
-				glog.Warningf("error during data deletion using pod [name: %v]: %v", vckName, err)
+				errs = append(errs, cleanupFailed(ctx, podClient, h.logs, h.recorder, ns, vc, controllerRef, vckName, err))
+			}
+			if err := podClient.Delete(ctx, ns, vckName); err != nil && !errors.IsNotFound(err) {
+				errs = append(errs, err)
 			}
-			podClient.Delete(ns, vckName)
 		}
 	}
 
-	podList, err := podClient.List(ns, vc.Labels)
+	podList, err := podClient.List(ctx, ns, resource.ListOptions{Labels: subResourceLabels(vc, controllerRef)})
 	if err != nil {
 		glog.Warningf("[s3-handler] OnDelete: error while listing resource [%s], %v", podClient.Plural(), err)
+		errs = append(errs, err)
 	}
 
 	for _, resource := range podList {
@@ -410,7 +449,9 @@ func (h *s3Handler) OnDelete(ns string, vc vckv1alpha1.VolumeConfig, vStatus vck
 		}
 
 		if resControllerRef.UID == controllerRef.UID {
-			podClient.Delete(ns, resource.GetName())
+			if err := podClient.Delete(ctx, ns, resource.GetName()); err != nil && !errors.IsNotFound(err) {
+				errs = append(errs, err)
+			}
 		}
 	}
 
@@ -418,22 +459,44 @@ func (h *s3Handler) OnDelete(ns string, vc vckv1alpha1.VolumeConfig, vStatus vck
 	nodeClient := getK8SResourceClientFromPlural(h.k8sResourceClients, "nodes")
 
 	// Get the node list based on the label
-	nodeList, err := nodeClient.List("", map[string]string{nodeLabelKey: "true"})
+	nodeList, err := nodeClient.List(ctx, "", resource.ListOptions{Labels: map[string]string{nodeLabelKey: "true"}})
 	if err != nil {
 		glog.Warningf("[s3-handler] OnDelete: error while listing nodes %v", err)
-		return
+		return utilerrors.NewAggregate(append(errs, err))
 	}
 	nodeNames := getNodeNames(nodeList)
 
 	for _, nodeName := range nodeNames {
-		node, err := nodeClient.Get("", nodeName)
+		err := patchNodeLabels(ctx, nodeClient, nodeName, []string{nodeLabelKey}, "delete")
 		if err != nil {
-			glog.Warningf("[s3-handler] OnDelete: error while getting node: %v", err)
+			glog.Warningf("[s3-handler] OnDelete: error while deleting label from nodes %v", err)
+			errs = append(errs, err)
+			continue
 		}
+		h.recorder.Eventf(volumeManagerRef(ns, controllerRef), corev1.EventTypeNormal, "NodeUnlabeled", "removed label %s from node %s", nodeLabelKey, nodeName)
+	}
 
-		err = updateNodeWithLabels(nodeClient, node.(*corev1.Node), []string{nodeLabelKey}, "delete")
-		if err != nil {
-			glog.Warningf("[s3-handler] OnDelete: error while deleting label from nodes %v", err)
+	return utilerrors.NewAggregate(errs)
+}
+
+func (h *s3Handler) OnRepair(ctx context.Context, ns string, vc vckv1alpha1.VolumeConfig, vStatus vckv1alpha1.Volume, controllerRef metav1.OwnerReference) ([]string, error) {
+	nodeLabelKey := fmt.Sprintf("%s/%s-%s-%s", vckv1alpha1.GroupName, ns, controllerRef.Name, vc.ID)
+	podClient := getK8SResourceClientFromPlural(h.k8sResourceClients, "pods")
+	nodeClient := getK8SResourceClientFromPlural(h.k8sResourceClients, "nodes")
+
+	// The files of a replica distributed with a distributionStrategy depend
+	// on the order in which the filters are iterated, so a single replica
+	// cannot be downloaded again.
+	var redownload func(replicas []int, excludedNodes []string) error
+	if _, ok := vc.Options["distributionStrategy"]; !ok {
+		redownload = func(replicas []int, excludedNodes []string) error {
+			vStatus := h.provision(ctx, ns, vc, controllerRef, replicas, excludedNodes, func(vckv1alpha1.VolumePhase) {})
+			if vStatus.Phase != vckv1alpha1.VolumeReady {
+				return fmt.Errorf("%s", vStatus.Message)
+			}
+			return nil
 		}
 	}
+
+	return repairHostPathVolume(ctx, podClient, nodeClient, h.recorder, ns, vc, vStatus, controllerRef, nodeLabelKey, redownload)
 }
@@ -19,13 +19,28 @@
 package handlers
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
 	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/golang/glog"
+
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/record"
 
+	vckv1alpha1 "github.com/IntelAI/vck/pkg/apis/vck/v1alpha1"
 	"github.com/IntelAI/vck/pkg/resource"
 )
 
@@ -39,6 +54,28 @@ func getNodeNames(nodeList []metav1.Object) []string {
 	return nodeNames
 }
 
+// vckNameFor returns the name of a sub-resource of a volume, with the suffixes
+// appended. The name is derived from the UID of the volume manager and the ID
+// of the volume so that a retried provisioning, e.g. after a restart of the
+// controller, finds the sub-resources created before. Both are hashed to keep
+// the name short and valid regardless of the volume ID.
+func vckNameFor(controllerRef metav1.OwnerReference, volumeID string, suffixes ...string) string {
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%s/%s", controllerRef.UID, volumeID)))
+	return strings.Join(append([]string{fmt.Sprintf("%s%x", vckNamePrefix, hash[:8])}, suffixes...), "-")
+}
+
+// volumeManagerRef returns a reference to the volume manager owning the
+// sub-resources of a volume, on which the handlers record events.
+func volumeManagerRef(ns string, controllerRef metav1.OwnerReference) *corev1.ObjectReference {
+	return &corev1.ObjectReference{
+		APIVersion: controllerRef.APIVersion,
+		Kind:       controllerRef.Kind,
+		Namespace:  ns,
+		Name:       controllerRef.Name,
+		UID:        controllerRef.UID,
+	}
+}
+
 func getK8SResourceClientFromPlural(k8sResourceClients []resource.Client, plural string) resource.Client {
 	for _, client := range k8sResourceClients {
 		if plural == client.Plural() {
@@ -49,29 +86,97 @@ func getK8SResourceClientFromPlural(k8sResourceClients []resource.Client, plural
 	return nil
 }
 
-func waitForPodSuccess(podClient resource.Client, podName string, podNS string, timeout time.Duration) error {
-	return waitPoll(func() (bool, error) {
-		obj, err := podClient.Get(podNS, podName)
-		if err != nil {
-			return false, fmt.Errorf("error while getting pod object when checking for pod success")
+// waitForPodSuccess waits until the pod has succeeded. It fails fast with a
+// podFailure once the pod is found unable to succeed, and if the pod has not
+// been scheduled within the scheduling timeout.
+func waitForPodSuccess(ctx context.Context, podClient resource.Client, podName string, podNS string, timeout, schedulingTimeout time.Duration) error {
+	start := time.Now()
+	if schedulingTimeout < timeout {
+		if _, err := waitForPodScheduled(ctx, podClient, podName, podNS, schedulingTimeout); err != nil {
+			return err
 		}
+	}
 
-		pod, ok := obj.(*corev1.Pod)
-		if !ok {
-			return false, fmt.Errorf("object returned from podClient.Get() is not a pod")
+	_, err := waitForPod(ctx, podClient, podName, podNS, timeout-time.Since(start), func(pod *corev1.Pod) (bool, error) {
+		if failure := podFailed(pod); failure != nil {
+			return false, failure
+		}
+		return pod.Status.Phase == corev1.PodSucceeded, nil
+	})
+	return err
+}
+
+// waitForPodCompletion waits until the pod has either succeeded or failed and
+// returns the last version of the pod.
+func waitForPodCompletion(ctx context.Context, podClient resource.Client, podName string, podNS string, timeout time.Duration) (*corev1.Pod, error) {
+	return waitForPod(ctx, podClient, podName, podNS, timeout, func(pod *corev1.Pod) (bool, error) {
+		return pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed, nil
+	})
+}
+
+// waitForPodScheduled waits until the pod has been scheduled and returns the
+// name of its node. It returns a podFailure if the pod fails or has not been
+// scheduled once the timeout has passed.
+func waitForPodScheduled(ctx context.Context, podClient resource.Client, podName string, podNS string, timeout time.Duration) (string, error) {
+	pod, err := waitForPod(ctx, podClient, podName, podNS, timeout, func(pod *corev1.Pod) (bool, error) {
+		if failure := podFailed(pod); failure != nil {
+			return false, failure
 		}
+		return pod.Spec.NodeName != "", nil
+	})
+	if err == wait.ErrWaitTimeout {
+		return "", unschedulable(pod, timeout)
+	}
+	if err != nil {
+		return "", err
+	}
+	return pod.Spec.NodeName, nil
+}
+
+// waitForPod waits until the condition holds for the pod, which is evaluated
+// whenever the pod changes, and returns the last version of the pod. It
+// returns wait.ErrWaitTimeout once the timeout has passed, the error of the
+// supplied context if the context is done first and an error if the pod is
+// deleted.
+func waitForPod(ctx context.Context, podClient resource.Client, podName string, podNS string, timeout time.Duration, condition func(*corev1.Pod) (bool, error)) (*corev1.Pod, error) {
+	timeoutCtx, cancelFunc := context.WithTimeout(ctx, timeout)
+	defer cancelFunc()
 
-		if err == nil && pod.Status.Phase == corev1.PodSucceeded {
-			return true, nil
+	var pod *corev1.Pod
+	err := podClient.Watch(timeoutCtx, podNS, podName, func(obj runtime.Object) (bool, error) {
+		if obj == nil {
+			if pod != nil {
+				return false, fmt.Errorf("pod %s was deleted", podName)
+			}
+			// The pod has just been created and has not been observed yet.
+			return false, nil
+		}
+
+		var ok bool
+		pod, ok = obj.(*corev1.Pod)
+		if !ok {
+			return false, fmt.Errorf("object returned from podClient.Watch() is not a pod")
 		}
+		return condition(pod)
+	})
 
-		return false, err
-	}, timeout)
+	if err != nil && ctx.Err() != nil {
+		return pod, ctx.Err()
+	}
+	if err == context.DeadlineExceeded {
+		return pod, wait.ErrWaitTimeout
+	}
+	return pod, err
 }
 
-func isPodRunningAfterTimeout(podClient resource.Client, podName string, podNS string, timeout time.Duration) bool {
-	time.Sleep(timeout)
-	obj, err := podClient.Get(podNS, podName)
+func isPodRunningAfterTimeout(ctx context.Context, podClient resource.Client, podName string, podNS string, timeout time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(timeout):
+	}
+
+	obj, err := podClient.Get(ctx, podNS, podName)
 	if err != nil {
 		return false
 	}
@@ -88,24 +193,555 @@ func isPodRunningAfterTimeout(podClient resource.Client, podName string, podNS s
 	return false
 }
 
-func waitPoll(waitFunc func() (bool, error), timeout time.Duration) error {
-	return wait.Poll(1*time.Second, timeout, waitFunc)
+// podDuration returns how long the containers of a completed pod ran, or the
+// time since the pod was created if that is not known.
+func podDuration(pod *corev1.Pod) time.Duration {
+	if pod.Status.StartTime != nil {
+		for _, status := range pod.Status.ContainerStatuses {
+			if status.State.Terminated != nil {
+				return status.State.Terminated.FinishedAt.Sub(pod.Status.StartTime.Time)
+			}
+		}
+	}
+
+	return time.Since(pod.CreationTimestamp.Time)
+}
+
+// podDataBytes returns the size of the data downloaded by a completed pod. The
+// download container writes the size in KiB to its termination message.
+func podDataBytes(pod *corev1.Pod) int64 {
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.State.Terminated == nil {
+			continue
+		}
+
+		kib, err := strconv.ParseInt(strings.TrimSpace(status.State.Terminated.Message), 10, 64)
+		if err == nil {
+			return kib * 1024
+		}
+	}
+
+	return 0
+}
+
+// validationError describes why a volume config is invalid, along with the
+// reason recorded in the status of the volume.
+type validationError struct {
+	reason  vckv1alpha1.VolumeReason
+	message string
+}
+
+func (e *validationError) Error() string {
+	return e.message
+}
+
+// invalidOptions returns a validation error for the invalid options of a
+// volume config.
+func invalidOptions(format string, args ...interface{}) error {
+	return &validationError{
+		reason:  vckv1alpha1.VolumeReasonInvalidOptions,
+		message: fmt.Sprintf(format, args...),
+	}
+}
+
+// validateLabels checks that a volume config has labels and that none of them
+// is reserved for the labels set by the controller on the sub-resources.
+func validateLabels(vc vckv1alpha1.VolumeConfig) error {
+	if len(vc.Labels) == 0 {
+		return invalidOptions("labels cannot be empty")
+	}
+
+	if _, ok := vc.Labels[resource.VolumeManagerUIDLabel]; ok {
+		return invalidOptions("label %s is reserved for the controller", resource.VolumeManagerUIDLabel)
+	}
+
+	return nil
+}
+
+// InvalidVolume returns the status of the volume with the supplied ID whose
+// volume config was rejected with the supplied validation error.
+func InvalidVolume(id string, err error) vckv1alpha1.Volume {
+	reason := vckv1alpha1.VolumeReasonInvalidOptions
+	if validationErr, ok := err.(*validationError); ok {
+		reason = validationErr.reason
+	}
+
+	return vckv1alpha1.Volume{
+		ID:      id,
+		Phase:   vckv1alpha1.VolumeFailed,
+		Reason:  reason,
+		Message: err.Error(),
+	}
+}
+
+// downloadTimeout returns the timeout for the data download using a pod set in
+// the options of a volume config, 5 minutes by default.
+func downloadTimeout(vc vckv1alpha1.VolumeConfig) (time.Duration, error) {
+	if _, ok := vc.Options["timeoutForDataDownload"]; !ok {
+		return 5 * time.Minute, nil
+	}
+
+	timeout, err := time.ParseDuration(vc.Options["timeoutForDataDownload"])
+	if err != nil {
+		return 0, fmt.Errorf("error while parsing timeout for data download: %v", err)
+	}
+	return timeout, nil
+}
+
+// schedulingTimeout returns the time a download or cleanup pod is given to be
+// scheduled, set in the options of a volume config, 2 minutes by default.
+func schedulingTimeout(vc vckv1alpha1.VolumeConfig) (time.Duration, error) {
+	if _, ok := vc.Options["timeoutForScheduling"]; !ok {
+		return 2 * time.Minute, nil
+	}
+
+	timeout, err := time.ParseDuration(vc.Options["timeoutForScheduling"])
+	if err != nil {
+		return 0, fmt.Errorf("error while parsing timeout for scheduling: %v", err)
+	}
+	return timeout, nil
+}
+
+// podFailure is returned when a pod is found unable to succeed before the
+// timeout of the wait, along with the reason of the failed volume.
+type podFailure struct {
+	reason  vckv1alpha1.VolumeReason
+	message string
+}
+
+func (f *podFailure) Error() string {
+	return f.message
+}
+
+// podFailed returns a podFailure if the pod has failed, or if one of its
+// containers cannot pull its image or is crash looping.
+func podFailed(pod *corev1.Pod) *podFailure {
+	if pod.Status.Phase == corev1.PodFailed {
+		message := "pod failed"
+		if pod.Status.Message != "" {
+			message = fmt.Sprintf("%s: %s", message, pod.Status.Message)
+		}
+		return &podFailure{reason: vckv1alpha1.VolumeReasonPodFailed, message: message}
+	}
+
+	for _, status := range containerStatuses(pod) {
+		waiting := status.State.Waiting
+		if waiting == nil {
+			continue
+		}
+
+		switch waiting.Reason {
+		case "ErrImagePull", "ImagePullBackOff", "InvalidImageName", "ErrImageNeverPull":
+			return &podFailure{
+				reason:  vckv1alpha1.VolumeReasonImagePullFailed,
+				message: fmt.Sprintf("container %s cannot pull image %s: %s", status.Name, status.Image, waiting.Reason),
+			}
+		case "CrashLoopBackOff":
+			return &podFailure{
+				reason:  vckv1alpha1.VolumeReasonCrashLoop,
+				message: fmt.Sprintf("container %s is crash looping", status.Name),
+			}
+		}
+	}
+	return nil
+}
+
+// unschedulable returns the podFailure of a pod which has not been scheduled
+// within the supplied timeout, with the message of the scheduler if any.
+func unschedulable(pod *corev1.Pod, timeout time.Duration) *podFailure {
+	message := fmt.Sprintf("pod was not scheduled within %v", timeout)
+	if pod != nil {
+		for _, condition := range pod.Status.Conditions {
+			if condition.Type == corev1.PodScheduled && condition.Status == corev1.ConditionFalse && condition.Message != "" {
+				message = fmt.Sprintf("%s: %s", message, condition.Message)
+			}
+		}
+	}
+	return &podFailure{reason: vckv1alpha1.VolumeReasonUnschedulable, message: message}
+}
+
+// abortDownload deletes the download pods of a volume whose provisioning was
+// aborted because the supplied context is done. The pods are deleted
+// regardless of the context, and the nodes are not labeled.
+func abortDownload(ctx context.Context, podClient resource.Client, ns string, vc vckv1alpha1.VolumeConfig, vckNames []string) vckv1alpha1.Volume {
+	glog.Infof("aborting the provisioning of volume %s: %v", vc.ID, ctx.Err())
+	for _, vckName := range vckNames {
+		if err := podClient.Delete(context.Background(), ns, vckName); err != nil && !errors.IsNotFound(err) {
+			glog.Warningf("error deleting download pod [name: %v] of aborted volume %s: %v", vckName, vc.ID, err)
+		}
+	}
+
+	return vckv1alpha1.Volume{
+		ID:      vc.ID,
+		Phase:   vckv1alpha1.VolumeFailed,
+		Reason:  vckv1alpha1.VolumeReasonAborted,
+		Message: fmt.Sprintf("provisioning aborted: %v", ctx.Err()),
+	}
+}
+
+// errPodNotRunning is returned for a resync pod which is not running once the
+// download timeout has passed.
+var errPodNotRunning = fmt.Errorf("pod is not running after the timeout")
+
+// replicaDownload is the outcome of the download of one replica of a volume.
+type replicaDownload struct {
+	// createErr is set if the download pod could not be created.
+	createErr error
+	// waitErr is set if the download pod did not succeed.
+	waitErr error
+}
+
+// downloadReplicas creates the download pods of all the replicas of a volume
+// and waits for them concurrently, within the limits of the supplied limiter.
+// The pods are kept off the nodes with the excluded hostnames. create is
+// called with the index of every replica and the hostnames of the nodes its
+// pod is restricted to, nil if it is not restricted, and wait is called with
+// the name of the pod once created. The outcomes are returned in the order of
+// the replicas.
+func downloadReplicas(ctx context.Context, limiter *DownloadLimiter, podClient resource.Client, ns string, vc vckv1alpha1.VolumeConfig, controllerRef metav1.OwnerReference,
+	nodeList []metav1.Object, excludedNodes []string, vckNames []string, timeout time.Duration, create func(i int, allowedNodes []string) error, wait func(vckName string) error) []replicaDownload {
+	key := ns + "/" + controllerRef.Name
+	downloads := make([]replicaDownload, len(vckNames))
+
+	// The node slots are reserved on the nodes the pods may be scheduled on.
+	hostnames := nodeHostnames(nodeList)
+	excluded := map[string]bool{}
+	for _, hostname := range excludedNodes {
+		excluded[hostname] = true
+	}
+	candidates := []string{}
+	for _, hostname := range hostnames {
+		if !excluded[hostname] {
+			candidates = append(candidates, hostname)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i, vckName := range vckNames {
+		wg.Add(1)
+		go func(i int, vckName string) {
+			defer wg.Done()
+
+			if err := limiter.Acquire(ctx, key, vc.Priority); err != nil {
+				downloads[i].createErr = err
+				return
+			}
+			defer limiter.Release()
+
+			var reservation *nodeReservation
+			if limiter.binds() {
+				var err error
+				// The download waits here while every node is full.
+				if reservation, err = limiter.reserveNode(ctx, candidates); err != nil {
+					downloads[i].createErr = err
+					return
+				}
+				defer limiter.releaseNode(reservation)
+			}
+
+			if err := create(i, reservation.allowedNodes()); err != nil {
+				downloads[i].createErr = err
+				return
+			}
+
+			if limiter.binds() {
+				nodeName, err := waitForPodScheduled(ctx, podClient, vckName, ns, timeout)
+				if err != nil {
+					downloads[i].waitErr = err
+					return
+				}
+				hostname, ok := hostnames[nodeName]
+				if !ok {
+					hostname = nodeName
+				}
+				limiter.bind(reservation, hostname)
+			}
+
+			downloads[i].waitErr = wait(vckName)
+		}(i, vckName)
+	}
+	wg.Wait()
+
+	return downloads
+}
+
+// downloadReason returns the reason for a failed data download based on the
+// error returned while waiting for the download pod.
+func downloadReason(err error) vckv1alpha1.VolumeReason {
+	if failure, ok := err.(*podFailure); ok {
+		return failure.reason
+	}
+	if err == wait.ErrWaitTimeout {
+		return vckv1alpha1.VolumeReasonDownloadTimeout
+	}
+	return vckv1alpha1.VolumeReasonDownloadFailed
+}
+
+// subResourceLabels returns the labels selecting the sub-resources created for
+// a volume of the volume manager referenced by controllerRef. The UID label is
+// set last, so that the labels of the volume cannot override it.
+func subResourceLabels(vc vckv1alpha1.VolumeConfig, controllerRef metav1.OwnerReference) map[string]string {
+	selector := map[string]string{}
+	for key, val := range vc.Labels {
+		selector[key] = val
+	}
+	selector[resource.VolumeManagerUIDLabel] = string(controllerRef.UID)
+	return selector
+}
+
+// patchNodeLabels adds or removes labels of a node using a strategic merge
+// patch which only touches the supplied label keys, so that concurrent updates
+// of the node, e.g. by the kubelet, are neither rejected nor overwritten.
+// Operation can be add or delete.
+func patchNodeLabels(ctx context.Context, nodeClient resource.Client, nodeName string, labels []string, operation string) error {
+	patchLabels := map[string]interface{}{}
+	for _, key := range labels {
+		switch operation {
+		case "add":
+			patchLabels[key] = "true"
+		case "delete":
+			// A null value removes the label.
+			patchLabels[key] = nil
+		}
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels": patchLabels,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = nodeClient.Patch(ctx, "", nodeName, types.StrategicMergePatchType, patch)
+	return err
+}
+
+// dataMissing returns whether a pod checking the data of a volume on a node
+// found the data missing, as opposed to a check which could not be completed.
+func dataMissing(pod *corev1.Pod) bool {
+	if pod.Status.Phase != corev1.PodFailed {
+		return false
+	}
+	for _, status := range containerStatuses(pod) {
+		if terminated := status.State.Terminated; terminated != nil && terminated.ExitCode == dataMissingExitCode {
+			return true
+		}
+	}
+	return false
+}
+
+// waitForDeletion waits until the object no longer exists.
+func waitForDeletion(ctx context.Context, client resource.Client, ns string, name string, timeout time.Duration) error {
+	timeoutCtx, cancelFunc := context.WithTimeout(ctx, timeout)
+	defer cancelFunc()
+
+	return client.Watch(timeoutCtx, ns, name, func(obj runtime.Object) (bool, error) {
+		return obj == nil, nil
+	})
+}
+
+// dataCheck is the outcome of the check of the data of one replica of a
+// hostPath volume.
+type dataCheck int
+
+const (
+	// dataInconclusive is the outcome of a check which could not be
+	// completed, e.g. because the check pod could not be created or run.
+	dataInconclusive dataCheck = iota
+	dataPresent
+	dataMissingOnNode
+)
+
+// checkReplicaData runs a pod on the node of a replica of a hostPath volume
+// to check that its data is still present.
+func checkReplicaData(ctx context.Context, podClient resource.Client, ns string, vc vckv1alpha1.VolumeConfig, controllerRef metav1.OwnerReference, replica int, nodeName string, dataPath string) dataCheck {
+	vckName := vckNameFor(controllerRef, vc.ID, "check", strconv.Itoa(replica))
+
+	// The pod is bound to the node rather than scheduled through the label
+	// of the volume, which may be missing.
+	err := podClient.Create(ctx, ns, struct {
+		vckv1alpha1.VolumeConfig
+		metav1.OwnerReference
+		NS          string
+		VCKName     string
+		VCKOp       string
+		VCKNodeName string
+		VCKOptions  map[string]string
+	}{
+		vc,
+		controllerRef,
+		ns,
+		vckName,
+		"check",
+		nodeName,
+		map[string]string{
+			"path":            dataPath,
+			"missingExitCode": strconv.Itoa(int(dataMissingExitCode)),
+		},
+	})
+	if err != nil {
+		glog.Warningf("error during sub-resource [%s] creation: %v", podClient.Plural(), err)
+		return dataInconclusive
+	}
+
+	pod, err := waitForPodCompletion(ctx, podClient, vckName, ns, timeoutForDataCheck)
+	// The check pods are deleted even if the check was aborted.
+	podClient.Delete(context.Background(), ns, vckName)
+	if err != nil {
+		glog.Warningf("error during data check using pod [name: %v]: %v", vckName, err)
+		return dataInconclusive
+	}
+
+	switch {
+	case pod.Status.Phase == corev1.PodSucceeded:
+		return dataPresent
+	case dataMissing(pod):
+		return dataMissingOnNode
+	}
+	glog.Warningf("data check using pod [name: %v] failed: %s", vckName, pod.Status.Message)
+	return dataInconclusive
 }
 
-// Returns a strategic patch for adding or removing a label for a node. Operation can be add or delete.
-func updateNodeWithLabels(nodeClient resource.Client, node *corev1.Node, labels []string, operation string) (err error) {
-	switch operation {
-	case "add":
-		for _, key := range labels {
-			node.ObjectMeta.Labels[key] = "true"
+// repairHostPathVolume checks the data of every replica of a hostPath volume
+// on the node it was downloaded to, as found from its download pod, and
+// repairs the drift found. A node which still holds the data is labeled
+// again, and the replicas whose data or node is gone are unlabeled and
+// downloaded again using redownload, with the hostnames of the nodes holding
+// the other replicas to be kept off. redownload is nil if the replicas of the volume
+// cannot be downloaded again. A check which cannot be completed is not a
+// drift. It returns a description of every repair made, and an error for the
+// drift which could not be repaired.
+func repairHostPathVolume(ctx context.Context, podClient resource.Client, nodeClient resource.Client, recorder record.EventRecorder, ns string, vc vckv1alpha1.VolumeConfig, vStatus vckv1alpha1.Volume, controllerRef metav1.OwnerReference,
+	nodeLabelKey string, redownload func(replicas []int, excludedNodes []string) error) ([]string, error) {
+	if vStatus.VolumeSource.HostPath == nil {
+		return nil, nil
+	}
+
+	nodeList, err := nodeClient.List(ctx, "", resource.ListOptions{})
+	if err != nil {
+		glog.Warningf("error while listing nodes, the data of volume %s is not checked: %v", vc.ID, err)
+		return nil, nil
+	}
+	nodeLabeled := map[string]bool{}
+	for _, node := range nodeList {
+		_, labeled := node.GetLabels()[nodeLabelKey]
+		nodeLabeled[node.GetName()] = labeled
+	}
+	hostnames := nodeHostnames(nodeList)
+
+	// The data root is mounted in the check pod, use the one the data was
+	// provisioned in rather than relying on the options being defaulted.
+	dataPath := vStatus.VolumeSource.HostPath.Path
+	checkVC := vc
+	checkVC.Options = map[string]string{}
+	for key, val := range vc.Options {
+		checkVC.Options[key] = val
+	}
+	checkVC.Options["dataPath"] = filepath.Dir(dataPath)
+
+	// The replicas whose node is unknown, e.g. because their download pod was
+	// removed, are left alone.
+	nodeNames := make([]string, vc.Replicas)
+	checks := make([]dataCheck, vc.Replicas)
+	var wg sync.WaitGroup
+	for i := 0; i < vc.Replicas; i++ {
+		vckName := vckNameFor(controllerRef, vc.ID, "add", strconv.Itoa(i))
+		podObj, err := podClient.Get(ctx, ns, vckName)
+		if err != nil {
+			glog.Warningf("error getting pod [name: %v], replica %d of volume %s is not checked: %v", vckName, i, vc.ID, err)
+			continue
 		}
-	case "delete":
-		for _, key := range labels {
-			delete(node.ObjectMeta.Labels, key)
+		pod, ok := podObj.(*corev1.Pod)
+		if !ok || pod.Spec.NodeName == "" || (pod.Status.Phase != corev1.PodSucceeded && pod.Status.Phase != corev1.PodRunning) {
+			glog.Warningf("node of replica %d of volume %s is unknown, the replica is not checked", i, vc.ID)
+			continue
 		}
+		nodeNames[i] = pod.Spec.NodeName
+
+		if _, ok := nodeLabeled[pod.Spec.NodeName]; !ok {
+			checks[i] = dataMissingOnNode
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, nodeName string) {
+			defer wg.Done()
+			checks[i] = checkReplicaData(ctx, podClient, ns, checkVC, controllerRef, i, nodeName, dataPath)
+		}(i, pod.Spec.NodeName)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return nil, nil
 	}
 
-	_, err = nodeClient.Update(node)
-	return
+	repaired := []string{}
+	errs := []error{}
+	lost := []int{}
+	excludedNodes := []string{}
+	for i, check := range checks {
+		nodeName := nodeNames[i]
+		labeled, nodeExists := nodeLabeled[nodeName]
 
+		switch check {
+		case dataPresent:
+			if hostname, ok := hostnames[nodeName]; ok {
+				excludedNodes = append(excludedNodes, hostname)
+			}
+			if labeled {
+				continue
+			}
+			if err := patchNodeLabels(ctx, nodeClient, nodeName, []string{nodeLabelKey}, "add"); err != nil {
+				errs = append(errs, fmt.Errorf("could not label node %s, error: %v", nodeName, err))
+				continue
+			}
+			recorder.Eventf(volumeManagerRef(ns, controllerRef), corev1.EventTypeNormal, "NodeLabeled", "labeled node %s with %s", nodeName, nodeLabelKey)
+			repaired = append(repaired, fmt.Sprintf("node %s holding replica %d of volume %s labeled again with %s", nodeName, i, vc.ID, nodeLabelKey))
+		case dataMissingOnNode:
+			lost = append(lost, i)
+			if !labeled {
+				continue
+			}
+			if err := patchNodeLabels(ctx, nodeClient, nodeName, []string{nodeLabelKey}, "delete"); err != nil {
+				errs = append(errs, fmt.Errorf("could not remove label %s from node %s, error: %v", nodeLabelKey, nodeName, err))
+				continue
+			}
+			recorder.Eventf(volumeManagerRef(ns, controllerRef), corev1.EventTypeNormal, "NodeUnlabeled", "removed label %s from node %s", nodeLabelKey, nodeName)
+		default:
+			if hostname, ok := hostnames[nodeName]; ok && nodeExists {
+				// The replica may still be there, keep the other replicas off
+				// its node.
+				excludedNodes = append(excludedNodes, hostname)
+			}
+		}
+	}
+
+	if len(lost) == 0 {
+		return repaired, utilerrors.NewAggregate(errs)
+	}
+	if redownload == nil {
+		errs = append(errs, fmt.Errorf("data of replicas %v of volume %s is missing and cannot be downloaded again", lost, vc.ID))
+		return repaired, utilerrors.NewAggregate(errs)
+	}
+
+	// The download pods of the lost replicas are replaced.
+	for _, i := range lost {
+		vckName := vckNameFor(controllerRef, vc.ID, "add", strconv.Itoa(i))
+		if err := podClient.Delete(ctx, ns, vckName); err != nil && !errors.IsNotFound(err) {
+			errs = append(errs, fmt.Errorf("error deleting pod [name: %v]: %v", vckName, err))
+			return repaired, utilerrors.NewAggregate(errs)
+		}
+		if err := waitForDeletion(ctx, podClient, ns, vckName, timeoutForDeletion); err != nil {
+			errs = append(errs, fmt.Errorf("error waiting for the deletion of pod [name: %v]: %v", vckName, err))
+			return repaired, utilerrors.NewAggregate(errs)
+		}
+	}
+
+	if err := redownload(lost, excludedNodes); err != nil {
+		errs = append(errs, fmt.Errorf("error downloading replicas %v of volume %s again: %v", lost, vc.ID, err))
+		return repaired, utilerrors.NewAggregate(errs)
+	}
+	repaired = append(repaired, fmt.Sprintf("data of replicas %v of volume %s was missing and downloaded again", lost, vc.ID))
+	return repaired, utilerrors.NewAggregate(errs)
 }
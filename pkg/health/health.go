@@ -0,0 +1,63 @@
+//
+// Copyright (c) 2018 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: EPL-2.0
+//
+
+package health
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/golang/glog"
+)
+
+// Check returns an error describing why a part of the controller is not
+// healthy.
+type Check func() error
+
+// Handler runs the supplied checks for every request. It responds with a 200
+// status code if all of them pass and with a 500 status code otherwise. The
+// body lists the outcome of every check.
+func Handler(checks map[string]Check) http.Handler {
+	names := []string{}
+	for name := range checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		failed := false
+		var body bytes.Buffer
+		for _, name := range names {
+			if err := checks[name](); err != nil {
+				glog.Warningf("[health] %s check failed for %s: %v", name, r.URL.Path, err)
+				fmt.Fprintf(&body, "[-]%s failed: %v\n", name, err)
+				failed = true
+				continue
+			}
+			fmt.Fprintf(&body, "[+]%s ok\n", name)
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if failed {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		w.Write(body.Bytes())
+	})
+}
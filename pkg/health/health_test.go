@@ -0,0 +1,67 @@
+//
+// Copyright (c) 2018 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: EPL-2.0
+//
+
+package health
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler(t *testing.T) {
+	testCases := map[string]struct {
+		checks       map[string]Check
+		expectedCode int
+		expectedBody string
+	}{
+		"no checks": {
+			checks:       map[string]Check{},
+			expectedCode: http.StatusOK,
+			expectedBody: "",
+		},
+		"all checks pass": {
+			checks: map[string]Check{
+				"b": func() error { return nil },
+				"a": func() error { return nil },
+			},
+			expectedCode: http.StatusOK,
+			expectedBody: "[+]a ok\n[+]b ok\n",
+		},
+		"a check fails": {
+			checks: map[string]Check{
+				"a": func() error { return nil },
+				"b": func() error { return fmt.Errorf("not synced") },
+			},
+			expectedCode: http.StatusInternalServerError,
+			expectedBody: "[+]a ok\n[-]b failed: not synced\n",
+		},
+	}
+
+	for key, tc := range testCases {
+		t.Logf("Testing for: %v", key)
+		recorder := httptest.NewRecorder()
+		Handler(tc.checks).ServeHTTP(recorder, httptest.NewRequest("GET", "/readyz", nil))
+
+		require.Equal(t, tc.expectedCode, recorder.Code)
+		require.Equal(t, tc.expectedBody, recorder.Body.String())
+	}
+}
@@ -19,166 +19,1384 @@
 package hooks
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/golang/glog"
 
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 
 	vckv1alpha1 "github.com/IntelAI/vck/pkg/apis/vck/v1alpha1"
 	vckv1alpha1_volume_manager "github.com/IntelAI/vck/pkg/client/clientset/versioned/typed/vck/v1alpha1"
+	"github.com/IntelAI/vck/pkg/controller"
 	"github.com/IntelAI/vck/pkg/handlers"
+	"github.com/IntelAI/vck/pkg/metrics"
 	"github.com/IntelAI/vck/pkg/states"
 )
 
-// VolumeManagerHooks implements controller.Hooks interface
+// queuePositionPeriod is the period at which the position of the downloads of
+// a volume manager in the download queue is reported in its status.
+var queuePositionPeriod = 5 * time.Second
+
+// VolumeManagerHooks implements controller.Reconciler interface
 type VolumeManagerHooks struct {
-	crdClient    vckv1alpha1_volume_manager.VolumeManagerInterface
-	dataHandlers []handlers.DataHandler
+	crdClient vckv1alpha1_volume_manager.VolumeManagersGetter
+	registry  *handlers.Registry
+	limiter   *handlers.DownloadLimiter
+	recorder  record.EventRecorder
+
+	// observed holds the last version of every volume manager seen by
+	// Reconcile, keyed by namespace/name. It is used to clean up objects
+	// which are gone without having been finalized.
+	observedLock sync.Mutex
+	observed     map[string]*vckv1alpha1.VolumeManager
+
+	// checkPeriod is the period at which the sub-resources of the running
+	// volume managers are checked for drift, 0 to disable the checks.
+	// lastChecked holds the time of the last check of every volume manager,
+	// keyed by namespace/name, and is guarded by observedLock.
+	checkPeriod time.Duration
+	lastChecked map[string]time.Time
+
+	// operations holds the mutating operations in progress on the volume
+	// managers, keyed by namespace/name, along with the ones which were
+	// aborted, so that they can be marked as interrupted on shutdown. An entry
+	// is dropped once its operation completes or the volume manager is
+	// reconciled again.
+	operationsLock sync.Mutex
+	operations     map[string]operation
 }
 
+// operation is a mutating operation on a volume manager, whose interruption
+// is recorded in its status.
+type operation string
+
+const (
+	operationProvisioning operation = "provisioning"
+	operationReconfigure  operation = "reconfigure"
+	operationCleanup      operation = "cleanup"
+)
+
 // NewVolumeManagerHooks creates and returns a new instance of the VolumeManagerHooks
-func NewVolumeManagerHooks(crdClient vckv1alpha1_volume_manager.VolumeManagerInterface, dataHandlers []handlers.DataHandler) *VolumeManagerHooks {
+func NewVolumeManagerHooks(crdClient vckv1alpha1_volume_manager.VolumeManagersGetter, registry *handlers.Registry, limiter *handlers.DownloadLimiter, recorder record.EventRecorder, checkPeriod time.Duration) *VolumeManagerHooks {
 	return &VolumeManagerHooks{
-		crdClient:    crdClient,
-		dataHandlers: dataHandlers,
+		crdClient:   crdClient,
+		registry:    registry,
+		limiter:     limiter,
+		recorder:    recorder,
+		observed:    map[string]*vckv1alpha1.VolumeManager{},
+		checkPeriod: checkPeriod,
+		lastChecked: map[string]time.Time{},
+		operations:  map[string]operation{},
 	}
 }
 
-func (h *VolumeManagerHooks) add(obj interface{}) {
-	volumeManager, ok := obj.(*vckv1alpha1.VolumeManager)
-	if !ok {
-		glog.Errorf("object received is not of type VolumeManager %v", obj)
-		return
+// Reconcile handles the volume manager object identified by the supplied
+// namespace/name key. It is called by the controller workers for every add,
+// update and delete event. When the context is cancelled, e.g. because the
+// volume manager is deleted during its provisioning, the outcome of the
+// aborted operations is not recorded and the reconcile of the event which
+// caused the cancellation takes over.
+func (h *VolumeManagerHooks) Reconcile(ctx context.Context, key string) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		glog.Errorf("invalid volume manager key %q: %v", key, err)
+		return nil
+	}
+
+	// This reconcile takes over from the operations aborted by the previous
+	// one.
+	h.operationsLock.Lock()
+	delete(h.operations, key)
+	h.operationsLock.Unlock()
+
+	volumeManager, err := h.crdClient.VolumeManagers(namespace).Get(name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		// The object is gone without having been finalized, e.g. because the
+		// finalizer was removed by hand. Clean up using the last version we
+		// have seen.
+		if oldVolumeManager := h.forget(key); oldVolumeManager != nil && hasFinalizer(oldVolumeManager) {
+			defer h.track(ctx, oldVolumeManager, operationCleanup)()
+			if err := h.delete(ctx, oldVolumeManager); err != nil {
+				glog.Warningf("error cleaning up sub-resources of volume manager %s: %v", key, err)
+			}
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if volumeManager.DeletionTimestamp != nil {
+		return h.finalize(ctx, key, volumeManager)
+	}
+
+	if !hasFinalizer(volumeManager) {
+		// Make sure the sub-resources are cleaned up even if the volume
+		// manager is deleted while the controller is down.
+		volumeManagerCopy := volumeManager.DeepCopy()
+		volumeManagerCopy.Finalizers = append(volumeManagerCopy.Finalizers, vckv1alpha1.CleanupFinalizer)
+		volumeManager, err = h.crdClient.VolumeManagers(namespace).Update(volumeManagerCopy)
+		if err != nil {
+			return fmt.Errorf("error adding finalizer to volume manager %s: %v", key, err)
+		}
+	}
+
+	h.observe(key, volumeManager)
+
+	// A desired state of Completed tears down the sub-resources but keeps the
+	// volume manager as a record of what was provisioned. It takes precedence
+	// over the provisioning, so that a volume manager which is added as
+	// completed or completed while pending is not provisioned.
+	if volumeManager.Spec.State == states.Completed && volumeManager.Status.State != states.Completed &&
+		states.Transition(volumeManager.Status.State, states.Completed) == nil {
+		return h.complete(ctx, volumeManager)
+	}
+
+	if volumeManager.Status.State == states.Initial {
+		// The volume manager has never been handled before.
+		h.add(ctx, volumeManager)
+		return nil
+	}
+
+	// A volume manager is only seen pending when its provisioning was
+	// interrupted, e.g. by a restart or a leader handover.
+	if volumeManager.Status.State == states.Pending {
+		return h.resume(ctx, volumeManager)
+	}
+
+	// The rest of the reconcile is left to the event caused by the status
+	// update.
+	if h.update(ctx, volumeManager) {
+		return nil
+	}
+
+	if volumeManager.Status.State == states.Running && h.checkDue(key) {
+		return h.repair(ctx, volumeManager)
+	}
+
+	return nil
+}
+
+// Interrupt records in the status of every volume manager whose provisioning,
+// reconfiguration or cleanup was aborted by the controller shutdown, e.g.
+// because the shutdown grace period has passed, that it was interrupted. It is
+// called once the reconciles have returned. Volume managers which were being
+// provisioned are moved back to Pending so that the next leader resumes their
+// provisioning. A reconfiguration or a cleanup is retried regardless, as it is
+// only recorded in the status once it is done.
+func (h *VolumeManagerHooks) Interrupt() error {
+	h.operationsLock.Lock()
+	operations := map[string]operation{}
+	for key, op := range h.operations {
+		operations[key] = op
+	}
+	h.operationsLock.Unlock()
+
+	errs := []error{}
+	for key, op := range operations {
+		if err := h.interrupt(key, op); err != nil {
+			errs = append(errs, fmt.Errorf("volume manager %s: %v", key, err))
+		}
+	}
+
+	return utilerrors.NewAggregate(errs)
+}
+
+// interrupt marks the supplied operation on the volume manager identified by
+// the namespace/name key as interrupted.
+func (h *VolumeManagerHooks) interrupt(key string, op operation) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+
+	volumeManager, err := h.crdClient.VolumeManagers(namespace).Get(name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	glog.Warningf("the %s of volume manager %s was interrupted", op, key)
+	volumeManagerCopy := volumeManager.DeepCopy()
+	state := volumeManagerCopy.Status.State
+	switch {
+	case state == states.Initial:
+		// The next leader handles the volume manager as a new one.
+		return nil
+	case op == operationProvisioning && state == states.Pending &&
+		volumeManagerCopy.DeletionTimestamp == nil && volumeManagerCopy.Spec.State != states.Completed:
+		volumeManagerCopy.Status.Message = fmt.Sprintf("provisioning interrupted by the controller shutdown, to be resumed")
+		volumeManagerCopy.Status.SetCondition(vckv1alpha1.VolumeManagerProvisioning, corev1.ConditionTrue, "Interrupted", volumeManagerCopy.Status.Message)
+		volumeManagerCopy.Status.SetCondition(vckv1alpha1.VolumeManagerReady, corev1.ConditionFalse, "Interrupted", volumeManagerCopy.Status.Message)
+	case op == operationReconfigure && state == states.Running && volumeManagerCopy.DeletionTimestamp == nil:
+		volumeManagerCopy.Status.Message = fmt.Sprintf("reconfiguration interrupted by the controller shutdown, to be retried")
+	default:
+		volumeManagerCopy.Status.Message = fmt.Sprintf("cleanup interrupted by the controller shutdown, to be retried")
+	}
+	h.recorder.Event(volumeManagerCopy, corev1.EventTypeWarning, "Interrupted", volumeManagerCopy.Status.Message)
+
+	_, err = h.updateStatus(volumeManagerCopy)
+	return err
+}
+
+// track records that the supplied operation on a volume manager is in
+// progress. The returned function drops the record once the operation has
+// completed, but keeps it if the operation was aborted, so that its
+// interruption is recorded on shutdown.
+func (h *VolumeManagerHooks) track(ctx context.Context, volumeManager *vckv1alpha1.VolumeManager, op operation) func() {
+	key := volumeManager.Namespace + "/" + volumeManager.Name
+	h.operationsLock.Lock()
+	h.operations[key] = op
+	h.operationsLock.Unlock()
+
+	return func() {
+		if ctx.Err() != nil {
+			return
+		}
+		h.operationsLock.Lock()
+		delete(h.operations, key)
+		h.operationsLock.Unlock()
+	}
+}
+
+// finalize cleans up the sub-resources of a volume manager which is being
+// deleted. The cleanup finalizer is removed only once every data handler
+// confirmed the cleanup, otherwise the error is recorded in the status and the
+// volume manager is retried.
+func (h *VolumeManagerHooks) finalize(ctx context.Context, key string, volumeManager *vckv1alpha1.VolumeManager) error {
+	if !hasFinalizer(volumeManager) {
+		h.forget(key)
+		return nil
+	}
+	defer h.track(ctx, volumeManager, operationCleanup)()
+
+	volumeManagerCopy := volumeManager.DeepCopy()
+	if !isCleanedUp(volumeManagerCopy) {
+		h.markDeleting(volumeManagerCopy)
+		if err := h.delete(ctx, volumeManagerCopy); err != nil {
+			volumeManagerCopy.Status.Message = fmt.Sprintf("failed to clean up the sub-resources: %v", err)
+			volumeManagerCopy.Status.SetCondition(vckv1alpha1.VolumeManagerCleanupFailed, corev1.ConditionTrue, "CleanupFailed", err.Error())
+			h.recorder.Event(volumeManagerCopy, corev1.EventTypeWarning, "CleanupFailed", volumeManagerCopy.Status.Message)
+			if _, updateErr := h.updateStatus(volumeManagerCopy); updateErr != nil {
+				glog.Warningf("error updating status for volume manager %s: %v\n", volumeManagerCopy.Name, updateErr)
+			}
+			return err
+		}
+
+		volumeManagerCopy.Status.Message = fmt.Sprintf("successfully cleaned up all sub-resources")
+		volumeManagerCopy.Status.SetCondition(vckv1alpha1.VolumeManagerCleanupFailed, corev1.ConditionFalse, "CleanedUp", "")
+		h.recorder.Event(volumeManagerCopy, corev1.EventTypeNormal, "CleanedUp", volumeManagerCopy.Status.Message)
+		var err error
+		volumeManagerCopy, err = h.updateStatus(volumeManagerCopy)
+		if err != nil {
+			return fmt.Errorf("error updating status for volume manager %s: %v", key, err)
+		}
+	}
+
+	finalizers := []string{}
+	for _, finalizer := range volumeManagerCopy.Finalizers {
+		if finalizer != vckv1alpha1.CleanupFinalizer {
+			finalizers = append(finalizers, finalizer)
+		}
+	}
+	volumeManagerCopy.Finalizers = finalizers
+
+	if _, err := h.crdClient.VolumeManagers(volumeManagerCopy.Namespace).Update(volumeManagerCopy); err != nil {
+		return fmt.Errorf("error removing finalizer from volume manager %s: %v", key, err)
+	}
+
+	h.forget(key)
+	return nil
+}
+
+// resume provisions a volume manager whose provisioning was interrupted. The
+// sub-resources of a volume are named after the volume manager UID and the
+// volume ID, so the handlers adopt the ones created before the interruption
+// and carry on from where the provisioning left off.
+func (h *VolumeManagerHooks) resume(ctx context.Context, volumeManager *vckv1alpha1.VolumeManager) error {
+	glog.Infof("resuming the interrupted provisioning of volume manager %s/%s", volumeManager.Namespace, volumeManager.Name)
+	h.recorder.Event(volumeManager, corev1.EventTypeNormal, "ProvisioningResumed", "resuming the interrupted provisioning")
+
+	h.add(ctx, volumeManager)
+	return nil
+}
+
+// complete tears down the sub-resources of a volume manager whose desired
+// state is Completed. The volume manager and the volumes in its status are
+// kept as a record of what was provisioned. A volume manager added as
+// completed is marked as Completed without being provisioned.
+func (h *VolumeManagerHooks) complete(ctx context.Context, volumeManager *vckv1alpha1.VolumeManager) error {
+	defer h.track(ctx, volumeManager, operationCleanup)()
+	volumeManagerCopy := volumeManager.DeepCopy()
+	prior := h.markDeleting(volumeManagerCopy)
+	err := h.delete(ctx, volumeManagerCopy)
+	restorePhases(volumeManagerCopy, prior)
+	if err != nil {
+		if aborted(ctx, volumeManagerCopy) {
+			return nil
+		}
+		volumeManagerCopy.Status.SetCondition(vckv1alpha1.VolumeManagerCleanupFailed, corev1.ConditionTrue, "CleanupFailed", err.Error())
+		h.recorder.Eventf(volumeManagerCopy, corev1.EventTypeWarning, "CleanupFailed", "failed to clean up the sub-resources: %v", err)
+		if _, updateErr := h.updateStatus(volumeManagerCopy); updateErr != nil {
+			glog.Warningf("error updating status for volume manager %s: %v\n", volumeManagerCopy.Name, updateErr)
+		}
+		return err
+	}
+
+	message := "successfully undeployed all sub-resources"
+	if volumeManagerCopy.Status.State == states.Initial {
+		message = "added with desired state as completed, no sub-resources were deployed"
+	}
+	if !setState(volumeManagerCopy, states.Completed, message) {
+		return nil
+	}
+	volumeManagerCopy.Status.SetCondition(vckv1alpha1.VolumeManagerCleanupFailed, corev1.ConditionFalse, "CleanedUp", "")
+	volumeManagerCopy.Status.SetCondition(vckv1alpha1.VolumeManagerReady, corev1.ConditionFalse, "Completed", volumeManagerCopy.Status.Message)
+	h.recorder.Event(volumeManagerCopy, corev1.EventTypeNormal, "Completed", volumeManagerCopy.Status.Message)
+
+	_, err = h.updateStatus(volumeManagerCopy)
+	return err
+}
+
+// aborted returns true if the supplied context has been cancelled, in which
+// case the outcome of the operations on the volume manager is discarded.
+func aborted(ctx context.Context, volumeManager *vckv1alpha1.VolumeManager) bool {
+	if ctx.Err() == nil {
+		return false
 	}
+
+	glog.Infof("aborted the reconcile of volume manager %s/%s: %v", volumeManager.Namespace, volumeManager.Name, ctx.Err())
+	return true
+}
+
+// isCleanedUp returns true if the sub-resources of the volume manager have
+// already been cleaned up, i.e. it completed or its failure has been cleaned
+// up.
+func isCleanedUp(volumeManager *vckv1alpha1.VolumeManager) bool {
+	switch volumeManager.Status.State {
+	case states.Completed:
+		return true
+	case states.Failed:
+		condition := volumeManager.Status.GetCondition(vckv1alpha1.VolumeManagerCleanupFailed)
+		return condition != nil && condition.Status == corev1.ConditionFalse
+	}
+	return false
+}
+
+// updateStatus writes the status of the supplied volume manager through the
+// status subresource, along with the generation of the spec it reflects.
+func (h *VolumeManagerHooks) updateStatus(volumeManager *vckv1alpha1.VolumeManager) (*vckv1alpha1.VolumeManager, error) {
+	volumeManager.Status.ObservedGeneration = volumeManager.Generation
+	return h.crdClient.VolumeManagers(volumeManager.Namespace).UpdateStatus(volumeManager)
+}
+
+// setState moves the volume manager to the supplied state along with the
+// message, if the transition is allowed by the state machine. Illegal
+// transitions are logged and leave the status untouched.
+func setState(volumeManager *vckv1alpha1.VolumeManager, state states.State, message string) bool {
+	if err := states.Transition(volumeManager.Status.State, state); err != nil {
+		glog.Errorf("rejecting state change of volume manager %s: %v", volumeManager.Name, err)
+		return false
+	}
+
+	volumeManager.SetStatusStateWithMessage(state, message)
+	return true
+}
+
+// hasFinalizer returns true if the cleanup finalizer is set on the volume
+// manager.
+func hasFinalizer(volumeManager *vckv1alpha1.VolumeManager) bool {
+	for _, finalizer := range volumeManager.Finalizers {
+		if finalizer == vckv1alpha1.CleanupFinalizer {
+			return true
+		}
+	}
+
+	return false
+}
+
+// observe records the supplied volume manager as the last seen version for
+// key.
+func (h *VolumeManagerHooks) observe(key string, volumeManager *vckv1alpha1.VolumeManager) {
+	h.observedLock.Lock()
+	defer h.observedLock.Unlock()
+
+	h.observed[key] = volumeManager
+}
+
+// forget removes and returns the last seen version of the volume manager.
+func (h *VolumeManagerHooks) forget(key string) *vckv1alpha1.VolumeManager {
+	h.observedLock.Lock()
+	defer h.observedLock.Unlock()
+
+	oldVolumeManager := h.observed[key]
+	delete(h.observed, key)
+	delete(h.lastChecked, key)
+	return oldVolumeManager
+}
+
+// checkDue returns true if the sub-resources of the volume manager are due to
+// be checked for drift, and records the check. They are checked at most once
+// per check period, i.e. on the periodic resync rather than on every event,
+// with half a period of tolerance for the delay of the resync in the queue.
+// The first reconcile of a running volume manager only starts the period, as
+// its volumes have just been provisioned or the controller has just started.
+func (h *VolumeManagerHooks) checkDue(key string) bool {
+	if h.checkPeriod <= 0 {
+		return false
+	}
+
+	h.observedLock.Lock()
+	defer h.observedLock.Unlock()
+
+	now := time.Now()
+	lastChecked, ok := h.lastChecked[key]
+	if ok && now.Sub(lastChecked) < h.checkPeriod/2 {
+		return false
+	}
+	h.lastChecked[key] = now
+	return ok
+}
+
+// add handles the addition of a new volume manager object
+func (h *VolumeManagerHooks) add(ctx context.Context, volumeManager *vckv1alpha1.VolumeManager) {
 	glog.V(4).Infof("Volume Manager add hook - got: %v", volumeManager)
+	defer h.track(ctx, volumeManager, operationProvisioning)()
 
 	volumeManagerCopy := volumeManager.DeepCopy()
 
 	// If created with a Failed desired state. We immediately change the volume
 	// manager status to Failed.
 	if volumeManagerCopy.Spec.State == states.Failed {
-		volumeManagerCopy.Status = vckv1alpha1.VolumeManagerStatus{
-			State:   volumeManagerCopy.Spec.State,
-			Message: "Added with desired state as failed and controller marked volume manager as " + string(volumeManagerCopy.Spec.State),
+		if !setState(volumeManagerCopy, volumeManagerCopy.Spec.State,
+			"Added with desired state as failed and controller marked volume manager as "+string(volumeManagerCopy.Spec.State)) {
+			return
 		}
+		volumeManagerCopy.Status.SetCondition(vckv1alpha1.VolumeManagerReady, corev1.ConditionFalse, "DesiredStateFailed", volumeManagerCopy.Status.Message)
+		h.recorder.Event(volumeManagerCopy, corev1.EventTypeWarning, "DesiredStateFailed", volumeManagerCopy.Status.Message)
 
-		h.crdClient.Update(volumeManagerCopy)
+		h.updateStatus(volumeManagerCopy)
 		return
 	}
 
-	// Mark the CR as pending before starting to invoke the handlers.
-	volumeManagerCopy.Status = vckv1alpha1.VolumeManagerStatus{
-		State:   states.Pending,
-		Message: fmt.Sprintf("Beginning sub-resource deployment"),
+	// Mark the CR as pending and its volumes as being validated before
+	// starting to validate and provision them.
+	volumeManagerCopy.Status.Volumes = []vckv1alpha1.Volume{}
+	for _, vConfig := range volumeManagerCopy.Spec.VolumeConfigs {
+		volumeManagerCopy.Status.Volumes = append(volumeManagerCopy.Status.Volumes, vckv1alpha1.Volume{
+			ID:    vConfig.ID,
+			Phase: vckv1alpha1.VolumeValidating,
+		})
 	}
+	if !setState(volumeManagerCopy, states.Pending, fmt.Sprintf("Beginning sub-resource deployment")) {
+		return
+	}
+	volumeManagerCopy.Status.SetCondition(vckv1alpha1.VolumeManagerProvisioning, corev1.ConditionTrue, "ProvisioningStarted", "")
+	volumeManagerCopy.Status.SetCondition(vckv1alpha1.VolumeManagerReady, corev1.ConditionFalse, "ProvisioningStarted", "")
+	h.recorder.Event(volumeManagerCopy, corev1.EventTypeNormal, "ProvisioningStarted", "beginning sub-resource deployment")
 
-	volumeManagerCopy, err := h.crdClient.Update(volumeManagerCopy)
+	volumeManagerCopy, err := h.updateStatus(volumeManagerCopy)
 	if err != nil {
 		glog.Warningf("error updating status for volume manager %s: %v\n", volumeManagerCopy.Name, err)
 		return
 	}
 
+	// Reject the CR as a whole before anything is created if its spec or
+	// any of its volume configs is invalid.
+	switch volumeManagerCopy.Spec.ProvisioningPolicy {
+	case "", vckv1alpha1.ProvisioningPolicyAllOrNothing, vckv1alpha1.ProvisioningPolicyPartialSuccess:
+	default:
+		h.reject(volumeManagerCopy, []vckv1alpha1.Volume{}, fmt.Sprintf("unknown provisioning policy %q", volumeManagerCopy.Spec.ProvisioningPolicy))
+		return
+	}
+	if _, err := annotatedPriority(volumeManagerCopy); err != nil {
+		h.reject(volumeManagerCopy, []vckv1alpha1.Volume{}, err.Error())
+		return
+	}
+	if invalid := h.validate(volumeManagerCopy); len(invalid) != 0 {
+		h.reject(volumeManagerCopy, invalid, fmt.Sprintf("rejected invalid volumes: %s", describeInvalid(invalid)))
+		return
+	}
+	volumeManagerCopy.Status.SetCondition(vckv1alpha1.VolumeManagerValidated, corev1.ConditionTrue, "Validated", "")
+
 	controllerRef := metav1.NewControllerRef(volumeManagerCopy, vckv1alpha1.GVK)
 
-	vStatuses := []vckv1alpha1.Volume{}
-	for _, handler := range h.dataHandlers {
-		for _, vConfig := range volumeManagerCopy.Spec.VolumeConfigs {
-			if handler.GetSourceType() == vConfig.SourceType {
-				vStatus := handler.OnAdd(volumeManagerCopy.Namespace, vConfig, *controllerRef)
-				vStatuses = append(vStatuses, vStatus)
-			}
-		}
+	// The volumes are provisioned concurrently. Meanwhile, their phases and
+	// the position of their downloads in the download queue are reported in
+	// the status.
+	progress := h.reportProgress(ctx, volumeManagerCopy)
+	vStatuses := make([]vckv1alpha1.Volume, len(volumeManagerCopy.Spec.VolumeConfigs))
+	var wg sync.WaitGroup
+	for idx, vConfig := range volumeManagerCopy.Spec.VolumeConfigs {
+		wg.Add(1)
+		go func(idx int, vConfig vckv1alpha1.VolumeConfig) {
+			defer wg.Done()
+			vStatuses[idx] = h.onAdd(ctx, h.handlerFor(vConfig), volumeManagerCopy, vConfig, *controllerRef, progress.phaseFunc(vConfig.ID))
+		}(idx, vConfig)
 	}
+	wg.Wait()
+	volumeManagerCopy.ResourceVersion = progress.stopReporting().ResourceVersion
+	volumeManagerCopy.Status.QueuePosition = 0
 
+	if aborted(ctx, volumeManagerCopy) {
+		return
+	}
+
+	volumeManagerCopy.Status.Volumes = vStatuses
+	failed := []string{}
 	for _, vStatus := range vStatuses {
-		// If any of the volume claim was not successful, mark the CR as Failed.
-		if vStatus.Message != vckv1alpha1.SuccessfulVolumeStatusMessage {
-			volumeManagerCopy.Status = vckv1alpha1.VolumeManagerStatus{
-				Volumes: vStatuses,
-				State:   states.Failed,
-				Message: fmt.Sprintf("failed to deploy all the sub-resources"),
-			}
+		if vStatus.Phase != vckv1alpha1.VolumeReady {
+			failed = append(failed, vStatus.ID)
+		}
+	}
 
-			_, err := h.crdClient.Update(volumeManagerCopy)
-			if err != nil {
-				glog.Warningf("error updating status for volume manager %s: %v\n", volumeManagerCopy.Name, err)
-				return
-			}
+	if len(failed) != 0 && volumeManagerCopy.Spec.ProvisioningPolicy == vckv1alpha1.ProvisioningPolicyPartialSuccess {
+		// Keep the volumes which were provisioned and mark the CR as Running.
+		if !setState(volumeManagerCopy, states.Running, fmt.Sprintf("deployed %d of %d volumes, failed to deploy the sub-resources of volumes: %s",
+			len(vStatuses)-len(failed), len(vStatuses), strings.Join(failed, ", "))) {
+			return
+		}
+		volumeManagerCopy.Status.SetCondition(vckv1alpha1.VolumeManagerProvisioning, corev1.ConditionFalse, "PartiallyProvisioned", volumeManagerCopy.Status.Message)
+		volumeManagerCopy.Status.SetCondition(vckv1alpha1.VolumeManagerReady, corev1.ConditionFalse, "PartiallyProvisioned", volumeManagerCopy.Status.Message)
+		h.recorder.Event(volumeManagerCopy, corev1.EventTypeWarning, "PartiallyProvisioned", volumeManagerCopy.Status.Message)
+
+		if _, err := h.updateStatus(volumeManagerCopy); err != nil {
+			glog.Warningf("error updating status for volume manager %s: %v\n", volumeManagerCopy.Name, err)
 		}
+		return
+	}
+
+	if len(failed) != 0 {
+		// If any of the volume claim was not successful, roll back all the
+		// volumes and mark the CR as Failed.
+		if !setState(volumeManagerCopy, states.Failed, fmt.Sprintf("failed to deploy all the sub-resources")) {
+			return
+		}
+		volumeManagerCopy.Status.SetCondition(vckv1alpha1.VolumeManagerProvisioning, corev1.ConditionFalse, "ProvisioningFailed", volumeManagerCopy.Status.Message)
+		volumeManagerCopy.Status.SetCondition(vckv1alpha1.VolumeManagerReady, corev1.ConditionFalse, "ProvisioningFailed", volumeManagerCopy.Status.Message)
+		h.recorder.Event(volumeManagerCopy, corev1.EventTypeWarning, "ProvisioningFailed", volumeManagerCopy.Status.Message)
+
+		h.rollback(ctx, volumeManagerCopy, failed)
+		if aborted(ctx, volumeManagerCopy) {
+			return
+		}
+
+		if _, err := h.updateStatus(volumeManagerCopy); err != nil {
+			glog.Warningf("error updating status for volume manager %s: %v\n", volumeManagerCopy.Name, err)
+		}
+		return
 	}
 
 	// Mark the CR as Running.
-	volumeManagerCopy.Status = vckv1alpha1.VolumeManagerStatus{
-		Volumes: vStatuses,
-		State:   states.Running,
-		Message: fmt.Sprintf("successfully deployed all sub-resources"),
+	if !setState(volumeManagerCopy, states.Running, fmt.Sprintf("successfully deployed all sub-resources")) {
+		return
 	}
+	volumeManagerCopy.Status.SetCondition(vckv1alpha1.VolumeManagerProvisioning, corev1.ConditionFalse, "Provisioned", "")
+	volumeManagerCopy.Status.SetCondition(vckv1alpha1.VolumeManagerReady, corev1.ConditionTrue, "Provisioned", "")
+	h.recorder.Event(volumeManagerCopy, corev1.EventTypeNormal, "Provisioned", volumeManagerCopy.Status.Message)
 
-	_, err = h.crdClient.Update(volumeManagerCopy)
+	_, err = h.updateStatus(volumeManagerCopy)
 	if err != nil {
 		glog.Warningf("error updating status for volume manager %s: %v\n", volumeManagerCopy.Name, err)
 		return
 	}
 }
 
-// Add handles the addition of a new volume manager object
-func (h *VolumeManagerHooks) Add(obj interface{}) {
-	// A goroutine is spawned to handle the addition of a CR.
-	// This work-around is required as we wait for completion of sub-resource(s)
-	// for some data handlers before moving the custom resoure from Pending to
-	// Running. Ideally, this case should be handled in a reconciler or the
-	// controller should be modified to handle multiple additions simultaneously.
-	// See https://github.com/kubernetes/sample-controller/blob/master/controller.go#L171-L173
-	// for example.
-	// TODO(balajismaniam): Remove this goroutine.
-	go h.add(obj)
+// update handles the update of a volume manager object. It returns true if
+// the status of the volume manager was updated.
+func (h *VolumeManagerHooks) update(ctx context.Context, newVolumeManager *vckv1alpha1.VolumeManager) bool {
+	glog.V(4).Infof("Volume Manager update hook - got: %v", newVolumeManager)
+
+	switch newVolumeManager.Status.State {
+	case states.Failed:
+		// Delete all the sub-resources once the CR is in a failed state.
+		if isCleanedUp(newVolumeManager) {
+			return false
+		}
+		defer h.track(ctx, newVolumeManager, operationCleanup)()
+
+		volumeManagerCopy := newVolumeManager.DeepCopy()
+		prior := h.markDeleting(volumeManagerCopy)
+		err := h.delete(ctx, volumeManagerCopy)
+		restorePhases(volumeManagerCopy, prior)
+		if aborted(ctx, volumeManagerCopy) {
+			return true
+		}
+		if err != nil {
+			glog.Warningf("error cleaning up sub-resources of volume manager %s: %v", newVolumeManager.Name, err)
+			volumeManagerCopy.Status.SetCondition(vckv1alpha1.VolumeManagerCleanupFailed, corev1.ConditionTrue, "CleanupFailed", err.Error())
+			h.recorder.Eventf(volumeManagerCopy, corev1.EventTypeWarning, "CleanupFailed", "failed to clean up the sub-resources: %v", err)
+		} else {
+			volumeManagerCopy.Status.SetCondition(vckv1alpha1.VolumeManagerCleanupFailed, corev1.ConditionFalse, "CleanedUp", "")
+			h.recorder.Event(volumeManagerCopy, corev1.EventTypeNormal, "CleanedUp", "cleaned up the sub-resources of the failed volume manager")
+		}
+
+		if _, err := h.updateStatus(volumeManagerCopy); err != nil {
+			glog.Warningf("error updating status for volume manager %s: %v\n", volumeManagerCopy.Name, err)
+		}
+		return true
+	case states.Running:
+		return h.reconfigure(ctx, newVolumeManager)
+	}
+
+	return false
 }
 
-// Update handles the update of a volume manager object
-func (h *VolumeManagerHooks) Update(oldObj, newObj interface{}) {
-	newVolumeManager, ok := newObj.(*vckv1alpha1.VolumeManager)
-	if !ok {
-		glog.Errorf("object received is not of type VolumeManager %v", newObj)
-		return
+// reconfigure diffs the volume configs in the spec of a volume manager with
+// the ones recorded in the status of its volumes, by ID. Added volume configs
+// are provisioned, removed ones are deleted and changed ones are deleted and
+// provisioned again. The volumes are torn down first, then provisioned
+// concurrently. The status entries of the untouched volumes are left as
+// is. A volume which could not be deleted is kept in the status along with the
+// config it was provisioned from, so that its cleanup is retried. It returns
+// true if the status of the volume manager was updated.
+func (h *VolumeManagerHooks) reconfigure(ctx context.Context, volumeManager *vckv1alpha1.VolumeManager) bool {
+	volumeManagerCopy := volumeManager.DeepCopy()
+	controllerRef := metav1.NewControllerRef(volumeManagerCopy, vckv1alpha1.GVK)
+
+	// An invalid edit is rejected as a whole and the volumes are left as is.
+	if invalid := h.validate(volumeManagerCopy); len(invalid) != 0 {
+		message := fmt.Sprintf("rejected the volume configs, invalid volumes: %s", describeInvalid(invalid))
+		condition := volumeManagerCopy.Status.GetCondition(vckv1alpha1.VolumeManagerValidated)
+		if condition != nil && condition.Status == corev1.ConditionFalse && condition.Message == message {
+			return false
+		}
+
+		volumeManagerCopy.Status.SetCondition(vckv1alpha1.VolumeManagerValidated, corev1.ConditionFalse, "ValidationFailed", message)
+		h.recorder.Event(volumeManagerCopy, corev1.EventTypeWarning, "ValidationFailed", message)
+		if _, err := h.updateStatus(volumeManagerCopy); err != nil {
+			glog.Warningf("error updating status for volume manager %s: %v\n", volumeManagerCopy.Name, err)
+		}
+		return true
 	}
+	condition := volumeManagerCopy.Status.GetCondition(vckv1alpha1.VolumeManagerValidated)
+	revalidated := condition != nil && condition.Status == corev1.ConditionFalse
+	volumeManagerCopy.Status.SetCondition(vckv1alpha1.VolumeManagerValidated, corev1.ConditionTrue, "Validated", "")
 
-	oldVolumeManager, ok := oldObj.(*vckv1alpha1.VolumeManager)
-	if !ok {
-		glog.Errorf("object received is not of type VolumeManager %v", oldObj)
-		return
+	newVConfigs := map[string]vckv1alpha1.VolumeConfig{}
+	for _, vConfig := range volumeManagerCopy.Spec.VolumeConfigs {
+		newVConfigs[vConfig.ID] = vConfig
+	}
+
+	changed := []string{}
+	failed := []string{}
+	uncleaned := []string{}
+	vStatuses := []vckv1alpha1.Volume{}
+
+	// The phases of the volumes which are torn down or provisioned are
+	// reported in the status as they go.
+	progress := h.reportProgress(ctx, volumeManagerCopy)
+
+	// The reconfiguration is only tracked once it starts to change the
+	// volumes, a volume manager which is in sync is left untouched on
+	// shutdown.
+	var untrack func()
+	defer func() {
+		if untrack != nil {
+			untrack()
+		}
+	}()
+	start := func() {
+		if untrack == nil {
+			untrack = h.track(ctx, volumeManagerCopy, operationReconfigure)
+		}
+	}
+
+	// The volumes to be provisioned are provisioned concurrently once the
+	// teardown is done, keyed by the index of their entry in vStatuses.
+	provisioned := map[int]vckv1alpha1.VolumeConfig{}
+	provision := func(vConfig vckv1alpha1.VolumeConfig) {
+		if h.handlerFor(vConfig) == nil {
+			return
+		}
+
+		start()
+		provisioned[len(vStatuses)] = vConfig
+		vStatuses = append(vStatuses, vckv1alpha1.Volume{ID: vConfig.ID})
 	}
-	glog.V(4).Infof("Volume Manager update hook - got old: %v new: %v", oldVolumeManager, newVolumeManager)
-
-	controllerRef := metav1.NewControllerRef(newVolumeManager, vckv1alpha1.GVK)
-	// Delete all the sub-resources if the CR is in a failed state.
-	if newVolumeManager.Status.State == states.Failed {
-		// Delete all the sub-resources.
-		for _, handler := range h.dataHandlers {
-			for idx, vConfig := range newVolumeManager.Spec.VolumeConfigs {
-				if handler.GetSourceType() == vConfig.SourceType && len(newVolumeManager.Status.Volumes) > idx {
-					handler.OnDelete(newVolumeManager.Namespace, vConfig, newVolumeManager.Status.Volumes[idx], *controllerRef)
-				}
+
+	// Tear down the removed and changed volumes.
+	listed := map[string]bool{}
+	for _, vStatus := range volumeManagerCopy.Status.Volumes {
+		listed[vStatus.ID] = true
+
+		newVConfig, isConfigured := newVConfigs[vStatus.ID]
+		if isConfigured && (vStatus.Config == nil || sameConfig(*vStatus.Config, newVConfig)) {
+			// Volumes provisioned by earlier versions of the controller do
+			// not record their config and are compared with the spec.
+			vStatuses = append(vStatuses, vStatus)
+			continue
+		}
+
+		vConfig, handler, err := h.lookup(volumeManagerCopy, vStatus)
+		if err == nil && handler != nil {
+			start()
+			if vStatus.Phase != vckv1alpha1.VolumeDeleting {
+				progress.setPhase(vStatus.ID, vckv1alpha1.VolumeDeleting)
+			}
+			err = h.onDelete(ctx, handler, volumeManagerCopy, vConfig, vStatus, *controllerRef)
+		}
+		if err != nil {
+			glog.Warningf("error deleting volume %s of volume manager %s: %v", vStatus.ID, volumeManagerCopy.Name, err)
+			message := fmt.Sprintf("failed to clean up the sub-resources: %v", err)
+			uncleaned = append(uncleaned, vStatus.ID)
+			if vStatus.Reason != vckv1alpha1.VolumeReasonCleanupFailed || vStatus.Message != message {
+				changed = append(changed, vStatus.ID)
+				h.recorder.Eventf(volumeManagerCopy, corev1.EventTypeWarning, "CleanupFailed", "failed to delete volume %s: %v", vStatus.ID, err)
 			}
+			vStatus.Phase = vckv1alpha1.VolumeDeleting
+			vStatus.Reason = vckv1alpha1.VolumeReasonCleanupFailed
+			vStatus.Message = message
+			vStatuses = append(vStatuses, vStatus)
+			continue
+		}
+
+		changed = append(changed, vStatus.ID)
+		if isConfigured {
+			provision(newVConfig)
+		}
+	}
+
+	// Provision the added volumes.
+	for _, vConfig := range volumeManagerCopy.Spec.VolumeConfigs {
+		if listed[vConfig.ID] {
+			continue
+		}
+
+		changed = append(changed, vConfig.ID)
+		provision(vConfig)
+	}
+
+	var wg sync.WaitGroup
+	for idx, vConfig := range provisioned {
+		wg.Add(1)
+		go func(idx int, vConfig vckv1alpha1.VolumeConfig) {
+			defer wg.Done()
+			vStatuses[idx] = h.onAdd(ctx, h.handlerFor(vConfig), volumeManagerCopy, vConfig, *controllerRef, progress.phaseFunc(vConfig.ID))
+		}(idx, vConfig)
+	}
+	wg.Wait()
+	volumeManagerCopy.ResourceVersion = progress.stopReporting().ResourceVersion
+
+	for idx, vStatus := range vStatuses {
+		if _, ok := provisioned[idx]; ok && vStatus.Phase != vckv1alpha1.VolumeReady {
+			failed = append(failed, vStatus.ID)
+		}
+	}
+
+	if aborted(ctx, volumeManagerCopy) {
+		return true
+	}
+
+	if len(changed) == 0 {
+		if !revalidated {
+			return false
 		}
+
+		// A rejected edit has been reverted.
+		if _, err := h.updateStatus(volumeManagerCopy); err != nil {
+			glog.Warningf("error updating status for volume manager %s: %v\n", volumeManagerCopy.Name, err)
+		}
+		return true
+	}
+
+	volumeManagerCopy.Status.Volumes = vStatuses
+	if len(uncleaned) != 0 {
+		volumeManagerCopy.Status.SetCondition(vckv1alpha1.VolumeManagerCleanupFailed, corev1.ConditionTrue, "CleanupFailed",
+			fmt.Sprintf("failed to clean up the sub-resources of volumes: %s", strings.Join(uncleaned, ", ")))
+	} else if volumeManagerCopy.Status.IsConditionTrue(vckv1alpha1.VolumeManagerCleanupFailed) {
+		volumeManagerCopy.Status.SetCondition(vckv1alpha1.VolumeManagerCleanupFailed, corev1.ConditionFalse, "CleanedUp", "")
+	}
+
+	if len(failed) != 0 && volumeManagerCopy.Spec.ProvisioningPolicy == vckv1alpha1.ProvisioningPolicyPartialSuccess {
+		// Keep the other volumes and leave the CR running.
+		volumeManagerCopy.Status.Message = fmt.Sprintf("failed to deploy the sub-resources of volumes: %s", strings.Join(failed, ", "))
+		volumeManagerCopy.Status.SetCondition(vckv1alpha1.VolumeManagerReady, corev1.ConditionFalse, "PartiallyProvisioned", volumeManagerCopy.Status.Message)
+		h.recorder.Event(volumeManagerCopy, corev1.EventTypeWarning, "PartiallyProvisioned", volumeManagerCopy.Status.Message)
+	} else if len(failed) != 0 {
+		setState(volumeManagerCopy, states.Failed, fmt.Sprintf("failed to deploy the sub-resources of volumes: %s", strings.Join(failed, ", ")))
+		volumeManagerCopy.Status.SetCondition(vckv1alpha1.VolumeManagerReady, corev1.ConditionFalse, "ProvisioningFailed", volumeManagerCopy.Status.Message)
+		h.recorder.Event(volumeManagerCopy, corev1.EventTypeWarning, "ProvisioningFailed", volumeManagerCopy.Status.Message)
+
+		h.rollback(ctx, volumeManagerCopy, failed)
+		if aborted(ctx, volumeManagerCopy) {
+			return true
+		}
+	} else if len(uncleaned) != 0 {
+		// The volumes are retried with the next reconcile.
+		volumeManagerCopy.Status.Message = fmt.Sprintf("failed to clean up the sub-resources of volumes: %s", strings.Join(uncleaned, ", "))
+	} else {
+		volumeManagerCopy.Status.Message = fmt.Sprintf("successfully reconfigured volumes: %s", strings.Join(changed, ", "))
+		volumeManagerCopy.Status.SetCondition(vckv1alpha1.VolumeManagerReady, corev1.ConditionTrue, "Reconfigured", volumeManagerCopy.Status.Message)
+		h.recorder.Event(volumeManagerCopy, corev1.EventTypeNormal, "Reconfigured", volumeManagerCopy.Status.Message)
+	}
+
+	_, err := h.updateStatus(volumeManagerCopy)
+	if err != nil {
+		glog.Warningf("error updating status for volume manager %s: %v\n", volumeManagerCopy.Name, err)
 	}
+
+	return true
 }
 
-// Delete handles the deletion of a volume manager object
-func (h *VolumeManagerHooks) Delete(obj interface{}) {
-	volumeManager, ok := obj.(*vckv1alpha1.VolumeManager)
-	if !ok {
-		glog.Errorf("object received is not of type VolumeManager %v", obj)
+// reject marks a volume manager whose spec is invalid as Failed along with the
+// status of its invalid volumes.
+func (h *VolumeManagerHooks) reject(volumeManager *vckv1alpha1.VolumeManager, invalid []vckv1alpha1.Volume, message string) {
+	volumeManager.Status.Volumes = invalid
+	if !setState(volumeManager, states.Failed, message) {
 		return
 	}
+	volumeManager.Status.SetCondition(vckv1alpha1.VolumeManagerValidated, corev1.ConditionFalse, "ValidationFailed", message)
+	volumeManager.Status.SetCondition(vckv1alpha1.VolumeManagerReady, corev1.ConditionFalse, "ValidationFailed", message)
+	h.recorder.Event(volumeManager, corev1.EventTypeWarning, "ValidationFailed", message)
+
+	if _, err := h.updateStatus(volumeManager); err != nil {
+		glog.Warningf("error updating status for volume manager %s: %v\n", volumeManager.Name, err)
+	}
+}
+
+// rollback deletes the sub-resources and node labels of all the volumes of a
+// volume manager once some of them failed, so that none of the volumes which
+// were provisioned is left on the nodes. The outcome is recorded in the
+// CleanupFailed condition, which tells the update hook whether the cleanup of
+// the failed volume manager has to be retried.
+func (h *VolumeManagerHooks) rollback(ctx context.Context, volumeManager *vckv1alpha1.VolumeManager, failed []string) {
+	// The volumes which could not be cleaned up are marked by delete and are
+	// no longer Ready.
+	prior := h.markDeleting(volumeManager)
+	err := h.delete(ctx, volumeManager)
+	restorePhases(volumeManager, prior)
+	for idx, vStatus := range volumeManager.Status.Volumes {
+		if vStatus.Phase != vckv1alpha1.VolumeReady {
+			continue
+		}
+
+		volumeManager.Status.Volumes[idx] = vckv1alpha1.Volume{
+			ID:      vStatus.ID,
+			Phase:   vckv1alpha1.VolumeFailed,
+			Reason:  vckv1alpha1.VolumeReasonRolledBack,
+			Message: fmt.Sprintf("rolled back after the failure of volumes: %s", strings.Join(failed, ", ")),
+		}
+	}
+
+	if err != nil {
+		glog.Warningf("error rolling back sub-resources of volume manager %s: %v", volumeManager.Name, err)
+		volumeManager.Status.SetCondition(vckv1alpha1.VolumeManagerCleanupFailed, corev1.ConditionTrue, "RollbackFailed", err.Error())
+		h.recorder.Eventf(volumeManager, corev1.EventTypeWarning, "RollbackFailed", "failed to roll back the sub-resources: %v", err)
+		return
+	}
+
+	volumeManager.Status.SetCondition(vckv1alpha1.VolumeManagerCleanupFailed, corev1.ConditionFalse, "RolledBack", "")
+	h.recorder.Eventf(volumeManager, corev1.EventTypeNormal, "RolledBack", "rolled back the sub-resources after the failure of volumes: %s", strings.Join(failed, ", "))
+}
+
+// delete handles the deletion of a volume manager object. It returns an error
+// if any of the volumes could not be cleaned up, in which case the error, e.g.
+// the diagnostics of a failed cleanup pod, is also recorded in the status of
+// the affected volume.
+func (h *VolumeManagerHooks) delete(ctx context.Context, volumeManager *vckv1alpha1.VolumeManager) error {
 	glog.V(4).Infof("Volume Manager delete hook - got: %v", volumeManager)
 
 	controllerRef := metav1.NewControllerRef(volumeManager, vckv1alpha1.GVK)
-	for _, handler := range h.dataHandlers {
-		for idx, vConfig := range volumeManager.Spec.VolumeConfigs {
-			if handler.GetSourceType() == vConfig.SourceType && len(volumeManager.Status.Volumes) > idx {
-				handler.OnDelete(volumeManager.Namespace, vConfig, volumeManager.Status.Volumes[idx], *controllerRef)
+	errs := []error{}
+	for idx, vStatus := range volumeManager.Status.Volumes {
+		vConfig, handler, err := h.lookup(volumeManager, vStatus)
+		if err == nil && handler == nil {
+			continue
+		}
+		if err == nil {
+			err = h.onDelete(ctx, handler, volumeManager, vConfig, vStatus, *controllerRef)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("volume %s: %v", vStatus.ID, err))
+			volumeManager.Status.Volumes[idx].Phase = vckv1alpha1.VolumeDeleting
+			volumeManager.Status.Volumes[idx].Reason = vckv1alpha1.VolumeReasonCleanupFailed
+			volumeManager.Status.Volumes[idx].Message = fmt.Sprintf("failed to clean up the sub-resources: %v", err)
+		} else if vStatus.Reason == vckv1alpha1.VolumeReasonCleanupFailed {
+			// The earlier failure has been resolved.
+			volumeManager.Status.Volumes[idx].Reason = ""
+			volumeManager.Status.Volumes[idx].Message = ""
+		}
+	}
+
+	return utilerrors.NewAggregate(errs)
+}
+
+// repair checks every volume recorded in the status of a running volume
+// manager against the cluster, concurrently, and lets the data handlers repair
+// the affected replicas, node labels or sub-resources. A drift which cannot be
+// repaired marks the volume manager as degraded rather than failed, as its
+// volumes may still be usable, and is retried on the next check. The status is
+// only written if the outcome changed.
+func (h *VolumeManagerHooks) repair(ctx context.Context, volumeManager *vckv1alpha1.VolumeManager) error {
+	volumeManagerCopy := volumeManager.DeepCopy()
+	controllerRef := metav1.NewControllerRef(volumeManagerCopy, vckv1alpha1.GVK)
+	// The annotation has been validated when the CR was added.
+	priority, _ := annotatedPriority(volumeManagerCopy)
+
+	repaired := make([][]string, len(volumeManagerCopy.Status.Volumes))
+	errs := make([]error, len(volumeManagerCopy.Status.Volumes))
+	var wg sync.WaitGroup
+	for idx, vStatus := range volumeManagerCopy.Status.Volumes {
+		vConfig, handler, err := h.lookup(volumeManagerCopy, vStatus)
+		if err != nil {
+			errs[idx] = err
+			continue
+		}
+		if handler == nil {
+			continue
+		}
+
+		// The data handlers default the options in place.
+		vConfig = copyConfig(vConfig)
+		if vConfig.Priority == 0 {
+			vConfig.Priority = priority
+		}
+
+		wg.Add(1)
+		go func(idx int, handler handlers.DataHandler, vConfig vckv1alpha1.VolumeConfig, vStatus vckv1alpha1.Volume) {
+			defer wg.Done()
+			repaired[idx], errs[idx] = handler.OnRepair(ctx, volumeManagerCopy.Namespace, vConfig, vStatus, *controllerRef)
+		}(idx, handler, vConfig, vStatus)
+	}
+	// Repairing a volume may download its data again.
+	stopHeartbeats := reportHeartbeats(ctx)
+	wg.Wait()
+	stopHeartbeats()
+
+	if aborted(ctx, volumeManagerCopy) {
+		return nil
+	}
+
+	repairs := []string{}
+	failures := []string{}
+	for idx, vStatus := range volumeManagerCopy.Status.Volumes {
+		if len(repaired[idx]) != 0 {
+			repairs = append(repairs, fmt.Sprintf("%s: %s", vStatus.ID, strings.Join(repaired[idx], ", ")))
+		}
+		if errs[idx] != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", vStatus.ID, errs[idx]))
+		}
+	}
+
+	if len(repairs) != 0 {
+		message := fmt.Sprintf("repaired drifted volumes: %s", strings.Join(repairs, "; "))
+		glog.Infof("volume manager %s: %s", volumeManagerCopy.Name, message)
+		volumeManagerCopy.Status.SetCondition(vckv1alpha1.VolumeManagerDegraded, corev1.ConditionFalse, "Repaired", message)
+		h.recorder.Event(volumeManagerCopy, corev1.EventTypeNormal, "Repaired", message)
+	}
+
+	switch {
+	case len(failures) != 0:
+		message := fmt.Sprintf("failed to repair drifted volumes: %s", strings.Join(failures, "; "))
+		glog.Warningf("volume manager %s: %s", volumeManagerCopy.Name, message)
+		volumeManagerCopy.Status.SetCondition(vckv1alpha1.VolumeManagerDegraded, corev1.ConditionTrue, "RepairFailed", message)
+		h.recorder.Event(volumeManagerCopy, corev1.EventTypeWarning, "RepairFailed", message)
+	case len(repairs) == 0 && volumeManagerCopy.Status.IsConditionTrue(vckv1alpha1.VolumeManagerDegraded):
+		// The drift has been resolved in the meantime.
+		volumeManagerCopy.Status.SetCondition(vckv1alpha1.VolumeManagerDegraded, corev1.ConditionFalse, "InSync", "")
+		h.recorder.Event(volumeManagerCopy, corev1.EventTypeNormal, "InSync", "the sub-resources of all volumes are in sync")
+	}
+
+	if reflect.DeepEqual(volumeManager.Status, volumeManagerCopy.Status) {
+		return nil
+	}
+	_, err := h.updateStatus(volumeManagerCopy)
+	return err
+}
+
+// onAdd provisions a volume using the supplied data handler, which reports the
+// phases of the volume to setPhase if set. The outcome is recorded in the
+// metrics and as an event on the volume manager.
+func (h *VolumeManagerHooks) onAdd(ctx context.Context, handler handlers.DataHandler, volumeManager *vckv1alpha1.VolumeManager, vConfig vckv1alpha1.VolumeConfig, controllerRef metav1.OwnerReference, setPhase handlers.PhaseFunc) vckv1alpha1.Volume {
+	if setPhase == nil {
+		setPhase = func(vckv1alpha1.VolumePhase) {}
+	}
+
+	// The config is recorded as found in the spec, before the handler
+	// defaults it.
+	applied := copyConfig(vConfig)
+	vConfig = copyConfig(vConfig)
+	if vConfig.Priority == 0 {
+		// The annotation has been validated when the CR was added.
+		vConfig.Priority, _ = annotatedPriority(volumeManager)
+	}
+
+	start := time.Now()
+	vStatus := handler.OnAdd(ctx, volumeManager.Namespace, vConfig, controllerRef, setPhase)
+	vStatus.Config = &applied
+	metrics.ObserveHandler(handler.GetSourceType(), metrics.OperationAdd, start, vStatus.Phase != vckv1alpha1.VolumeReady)
+	if ctx.Err() != nil {
+		return vStatus
+	}
+
+	if vStatus.Phase == vckv1alpha1.VolumeReady {
+		h.recorder.Eventf(volumeManager, corev1.EventTypeNormal, string(vStatus.Reason), "volume %s is ready", vStatus.ID)
+	} else {
+		h.recorder.Eventf(volumeManager, corev1.EventTypeWarning, string(vStatus.Reason), "volume %s failed: %s", vStatus.ID, vStatus.Message)
+	}
+	return vStatus
+}
+
+// annotatedPriority returns the download priority set by the annotation of a
+// volume manager, 0 by default.
+func annotatedPriority(volumeManager *vckv1alpha1.VolumeManager) (int, error) {
+	value, ok := volumeManager.Annotations[vckv1alpha1.PriorityAnnotation]
+	if !ok {
+		return 0, nil
+	}
+
+	priority, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s annotation %q: it must be an integer", vckv1alpha1.PriorityAnnotation, value)
+	}
+	return priority, nil
+}
+
+// reportHeartbeats reports a heartbeat of the reconcile running with the
+// supplied context every queuePositionPeriod, until the returned function is
+// called.
+func reportHeartbeats(ctx context.Context) func() {
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(queuePositionPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				controller.Heartbeat(ctx)
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-stopped
+	}
+}
+
+// progress records the phases the volumes of a volume manager enter while
+// they are provisioned or torn down in its status, along with the position of
+// its downloads in the download queue. The status is written when a phase
+// changes and every queuePositionPeriod, until stop is called. Every tick is
+// also reported as a heartbeat of the reconcile, so that the controller is
+// live while the downloads take longer than its liveness timeout.
+type progress struct {
+	hooks   *VolumeManagerHooks
+	ctx     context.Context
+	key     string
+	changed chan struct{}
+	stop    chan struct{}
+	stopped chan struct{}
+	// latest is the last version of the volume manager which was written.
+	latest *vckv1alpha1.VolumeManager
+
+	lock   sync.Mutex
+	phases map[string]vckv1alpha1.VolumePhase
+	// order holds the IDs of the volumes in the order their phase was first
+	// set, so that the volumes missing from the status are appended in a
+	// stable order.
+	order []string
+}
+
+// reportProgress starts recording the progress of the supplied volume manager
+// in its status, for the reconcile running with the supplied context.
+func (h *VolumeManagerHooks) reportProgress(ctx context.Context, volumeManager *vckv1alpha1.VolumeManager) *progress {
+	p := &progress{
+		hooks:   h,
+		ctx:     ctx,
+		key:     volumeManager.Namespace + "/" + volumeManager.Name,
+		changed: make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+		latest:  volumeManager.DeepCopy(),
+		phases:  map[string]vckv1alpha1.VolumePhase{},
+	}
+	go p.run()
+	return p
+}
+
+// setPhase records the phase the supplied volume enters.
+func (p *progress) setPhase(id string, phase vckv1alpha1.VolumePhase) {
+	p.lock.Lock()
+	if _, ok := p.phases[id]; !ok {
+		p.order = append(p.order, id)
+	}
+	p.phases[id] = phase
+	p.lock.Unlock()
+
+	select {
+	case p.changed <- struct{}{}:
+	default:
+	}
+}
+
+// phaseFunc returns the function a data handler calls with the phases of the
+// supplied volume.
+func (p *progress) phaseFunc(id string) handlers.PhaseFunc {
+	return func(phase vckv1alpha1.VolumePhase) {
+		p.setPhase(id, phase)
+	}
+}
+
+// apply sets the recorded phases on the volumes in the status of the supplied
+// volume manager. The reason and message of a volume describe the outcome of
+// its previous phase and are cleared.
+func (p *progress) apply(volumeManager *vckv1alpha1.VolumeManager) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	listed := map[string]bool{}
+	for idx, vStatus := range volumeManager.Status.Volumes {
+		listed[vStatus.ID] = true
+		if phase, ok := p.phases[vStatus.ID]; ok && phase != vStatus.Phase {
+			volumeManager.Status.Volumes[idx].Phase = phase
+			volumeManager.Status.Volumes[idx].Reason = ""
+			volumeManager.Status.Volumes[idx].Message = ""
+		}
+	}
+	for _, id := range p.order {
+		if !listed[id] {
+			volumeManager.Status.Volumes = append(volumeManager.Status.Volumes, vckv1alpha1.Volume{
+				ID:    id,
+				Phase: p.phases[id],
+			})
+		}
+	}
+}
+
+func (p *progress) run() {
+	defer close(p.stopped)
+	ticker := time.NewTicker(queuePositionPeriod)
+	defer ticker.Stop()
+
+	pending := false
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-p.changed:
+			pending = true
+		case <-ticker.C:
+		}
+		controller.Heartbeat(p.ctx)
+
+		position := p.hooks.limiter.Position(p.key)
+		if !pending && position == p.latest.Status.QueuePosition {
+			continue
+		}
+
+		reported := p.latest.DeepCopy()
+		p.apply(reported)
+		reported.Status.QueuePosition = position
+		updated, err := p.hooks.updateStatus(reported)
+		if err != nil {
+			glog.Warningf("error updating the progress of volume manager %s: %v", p.key, err)
+			continue
+		}
+		p.latest = updated
+		pending = false
+	}
+}
+
+// stopReporting stops recording the progress and returns the last version of
+// the volume manager which was written.
+func (p *progress) stopReporting() *vckv1alpha1.VolumeManager {
+	close(p.stop)
+	<-p.stopped
+	return p.latest
+}
+
+// markDeleting records in the status of a volume manager that the volumes
+// which have sub-resources are being deleted, before their teardown starts.
+// It returns the volumes as they were, so that the phases of the volumes of a
+// volume manager which is kept can be restored once they are cleaned up.
+func (h *VolumeManagerHooks) markDeleting(volumeManager *vckv1alpha1.VolumeManager) []vckv1alpha1.Volume {
+	prior := make([]vckv1alpha1.Volume, len(volumeManager.Status.Volumes))
+	copy(prior, volumeManager.Status.Volumes)
+
+	marked := false
+	for idx, vStatus := range volumeManager.Status.Volumes {
+		if vStatus.Phase == vckv1alpha1.VolumeDeleting {
+			continue
+		}
+		if _, handler, err := h.lookup(volumeManager, vStatus); err == nil && handler == nil {
+			continue
+		}
+		volumeManager.Status.Volumes[idx].Phase = vckv1alpha1.VolumeDeleting
+		marked = true
+	}
+	if !marked {
+		return prior
+	}
+
+	updated, err := h.updateStatus(volumeManager.DeepCopy())
+	if err != nil {
+		glog.Warningf("error updating status for volume manager %s: %v\n", volumeManager.Name, err)
+		return prior
+	}
+	volumeManager.ResourceVersion = updated.ResourceVersion
+	return prior
+}
+
+// restorePhases restores the phases the volumes of a volume manager had before
+// markDeleting once they have been cleaned up. The volumes whose cleanup
+// failed are left as marked by delete. A volume whose earlier cleanup had
+// failed has no phase to go back to and stays Deleting.
+func restorePhases(volumeManager *vckv1alpha1.VolumeManager, prior []vckv1alpha1.Volume) {
+	for idx, vStatus := range volumeManager.Status.Volumes {
+		if vStatus.Phase != vckv1alpha1.VolumeDeleting || vStatus.Reason == vckv1alpha1.VolumeReasonCleanupFailed {
+			continue
+		}
+		if idx >= len(prior) || prior[idx].ID != vStatus.ID {
+			continue
+		}
+		if prior[idx].Reason != vckv1alpha1.VolumeReasonCleanupFailed {
+			volumeManager.Status.Volumes[idx].Phase = prior[idx].Phase
+		}
+	}
+}
+
+// onDelete deletes a volume using the supplied data handler. The outcome is
+// recorded in the metrics.
+func (h *VolumeManagerHooks) onDelete(ctx context.Context, handler handlers.DataHandler, volumeManager *vckv1alpha1.VolumeManager, vConfig vckv1alpha1.VolumeConfig, vStatus vckv1alpha1.Volume, controllerRef metav1.OwnerReference) error {
+	start := time.Now()
+	err := handler.OnDelete(ctx, volumeManager.Namespace, vConfig, vStatus, controllerRef)
+	metrics.ObserveHandler(handler.GetSourceType(), metrics.OperationDelete, start, err != nil)
+	return err
+}
+
+// validate checks all the volume configs of a volume manager before any of
+// them is provisioned. It returns the status of every invalid volume: a volume
+// with a duplicate ID, without a data handler for its source type or rejected
+// by its data handler.
+func (h *VolumeManagerHooks) validate(volumeManager *vckv1alpha1.VolumeManager) []vckv1alpha1.Volume {
+	invalid := []vckv1alpha1.Volume{}
+	ids := map[string]bool{}
+	for _, vConfig := range volumeManager.Spec.VolumeConfigs {
+		if ids[vConfig.ID] {
+			invalid = append(invalid, vckv1alpha1.Volume{
+				ID:      vConfig.ID,
+				Phase:   vckv1alpha1.VolumeFailed,
+				Reason:  vckv1alpha1.VolumeReasonInvalidOptions,
+				Message: fmt.Sprintf("volume ID %q is not unique", vConfig.ID),
+			})
+			continue
+		}
+		ids[vConfig.ID] = true
+
+		handler := h.handlerFor(vConfig)
+		if handler == nil {
+			invalid = append(invalid, vckv1alpha1.Volume{
+				ID:     vConfig.ID,
+				Phase:  vckv1alpha1.VolumeFailed,
+				Reason: vckv1alpha1.VolumeReasonUnsupportedSourceType,
+				Message: fmt.Sprintf("no data handler supports source type %q, supported source types: %s",
+					vConfig.SourceType, strings.Join(h.registry.SourceTypes(), ", ")),
+			})
+			continue
+		}
+
+		if err := handler.Validate(volumeManager.Namespace, vConfig); err != nil {
+			invalid = append(invalid, handlers.InvalidVolume(vConfig.ID, err))
+		}
+	}
+
+	return invalid
+}
+
+// describeInvalid returns a description of the supplied invalid volumes.
+func describeInvalid(invalid []vckv1alpha1.Volume) string {
+	descriptions := []string{}
+	for _, vStatus := range invalid {
+		descriptions = append(descriptions, fmt.Sprintf("%s (%s)", vStatus.ID, vStatus.Message))
+	}
+	return strings.Join(descriptions, ", ")
+}
+
+// lookup returns the volume config which the supplied volume in the status of
+// the volume manager was provisioned from and the data handler for its source
+// type. Volumes provisioned by earlier versions of the controller do not record
+// their config, the one with the same ID in the spec is used instead. The
+// handler is nil if the volume was rejected before anything was created for
+// it. An error is returned if the config or the handler cannot be found, as
+// the volume cannot be cleaned up then.
+func (h *VolumeManagerHooks) lookup(volumeManager *vckv1alpha1.VolumeManager, vStatus vckv1alpha1.Volume) (vckv1alpha1.VolumeConfig, handlers.DataHandler, error) {
+	if vStatus.Config == nil && vStatus.Phase == vckv1alpha1.VolumeFailed &&
+		(vStatus.Reason == vckv1alpha1.VolumeReasonInvalidOptions || vStatus.Reason == vckv1alpha1.VolumeReasonUnsupportedSourceType) {
+		return vckv1alpha1.VolumeConfig{}, nil, nil
+	}
+
+	vConfig, found := vckv1alpha1.VolumeConfig{}, false
+	if vStatus.Config != nil {
+		vConfig, found = *vStatus.Config, true
+	} else {
+		for _, specVConfig := range volumeManager.Spec.VolumeConfigs {
+			if specVConfig.ID == vStatus.ID {
+				vConfig, found = specVConfig, true
+				break
 			}
 		}
 	}
+	if !found {
+		return vckv1alpha1.VolumeConfig{}, nil, fmt.Errorf("the volume config volume %s was provisioned from is unknown", vStatus.ID)
+	}
+
+	handler := h.handlerFor(vConfig)
+	if handler == nil {
+		return vckv1alpha1.VolumeConfig{}, nil, fmt.Errorf("no data handler supports source type %q of volume %s", vConfig.SourceType, vStatus.ID)
+	}
+	return vConfig, handler, nil
+}
+
+// sameConfig returns true if the supplied volume configs are equal once
+// serialized, which is how they are stored in the spec and the status.
+func sameConfig(a, b vckv1alpha1.VolumeConfig) bool {
+	aJSON, aErr := json.Marshal(a)
+	bJSON, bErr := json.Marshal(b)
+	return aErr == nil && bErr == nil && bytes.Equal(aJSON, bJSON)
+}
+
+// copyConfig returns a copy of the supplied volume config which does not
+// share its labels and options with it, as the data handlers default the
+// options in place.
+func copyConfig(vConfig vckv1alpha1.VolumeConfig) vckv1alpha1.VolumeConfig {
+	vConfigCopy := vConfig
+	if vConfig.Labels != nil {
+		vConfigCopy.Labels = map[string]string{}
+		for key, val := range vConfig.Labels {
+			vConfigCopy.Labels[key] = val
+		}
+	}
+	if vConfig.Options != nil {
+		vConfigCopy.Options = map[string]string{}
+		for key, val := range vConfig.Options {
+			vConfigCopy.Options[key] = val
+		}
+	}
+	return vConfigCopy
+}
+
+// handlerFor returns the data handler for the source type of the supplied
+// volume config or nil if there is none.
+func (h *VolumeManagerHooks) handlerFor(vConfig vckv1alpha1.VolumeConfig) handlers.DataHandler {
+	return h.registry.Lookup(vConfig.SourceType)
 }
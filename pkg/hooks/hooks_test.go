@@ -19,34 +19,111 @@
 package hooks
 
 import (
+	"context"
+	"fmt"
 	vckv1alpha1 "github.com/IntelAI/vck/pkg/apis/vck/v1alpha1"
 	vckv1alpha1_fake "github.com/IntelAI/vck/pkg/client/clientset/versioned/fake"
+	"github.com/IntelAI/vck/pkg/controller"
 	"github.com/IntelAI/vck/pkg/handlers"
 	"github.com/IntelAI/vck/pkg/states"
 	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+	"sync"
 	"testing"
+	"time"
 )
 
 type testDataHandler struct {
+	// lock guards the fields recording the calls, as the volumes of a
+	// volume manager are provisioned concurrently.
+	lock         sync.Mutex
 	addCalled    bool
 	deleteCalled bool
 	sourceType   vckv1alpha1.DataSourceType
+	repaired     []string
+	repairErr    error
+	added        []string
+	deleted      []string
+	// The volume configs passed to OnDelete.
+	deletedConfigs []vckv1alpha1.VolumeConfig
+	deleteErr      error
+	addFailed      bool
+	validateErr    error
 }
 
-func (tdh *testDataHandler) OnAdd(namespace string, vc vckv1alpha1.VolumeConfig, controllerRef metav1.OwnerReference) vckv1alpha1.Volume {
+func (tdh *testDataHandler) Validate(namespace string, vc vckv1alpha1.VolumeConfig) error {
+	return tdh.validateErr
+}
+
+func (tdh *testDataHandler) OnAdd(ctx context.Context, namespace string, vc vckv1alpha1.VolumeConfig, controllerRef metav1.OwnerReference, setPhase handlers.PhaseFunc) vckv1alpha1.Volume {
+	tdh.lock.Lock()
+	defer tdh.lock.Unlock()
 	tdh.addCalled = true
-	return vckv1alpha1.Volume{}
+	tdh.added = append(tdh.added, vc.ID)
+	// Default an option in place as the data handlers do.
+	if vc.Options != nil {
+		vc.Options["defaulted"] = "true"
+	}
+	if tdh.addFailed {
+		return vckv1alpha1.Volume{
+			ID:      vc.ID,
+			Phase:   vckv1alpha1.VolumeFailed,
+			Reason:  vckv1alpha1.VolumeReasonInvalidOptions,
+			Message: "add failed",
+		}
+	}
+	return vckv1alpha1.Volume{
+		ID:     vc.ID,
+		Phase:  vckv1alpha1.VolumeReady,
+		Reason: vckv1alpha1.VolumeReasonProvisioned,
+	}
 }
 
-func (tdh *testDataHandler) OnDelete(namespace string, vc vckv1alpha1.VolumeConfig, vStatus vckv1alpha1.Volume, controllerRef metav1.OwnerReference) {
+func (tdh *testDataHandler) OnDelete(ctx context.Context, namespace string, vc vckv1alpha1.VolumeConfig, vStatus vckv1alpha1.Volume, controllerRef metav1.OwnerReference) error {
+	tdh.lock.Lock()
+	defer tdh.lock.Unlock()
 	tdh.deleteCalled = true
+	tdh.deleted = append(tdh.deleted, vc.ID)
+	tdh.deletedConfigs = append(tdh.deletedConfigs, vc)
+	return tdh.deleteErr
+}
+
+func (tdh *testDataHandler) OnRepair(ctx context.Context, namespace string, vc vckv1alpha1.VolumeConfig, vStatus vckv1alpha1.Volume, controllerRef metav1.OwnerReference) ([]string, error) {
+	return tdh.repaired, tdh.repairErr
 }
 
 func (tdh *testDataHandler) GetSourceType() vckv1alpha1.DataSourceType {
 	return tdh.sourceType
 }
 
+// registryOf returns a registry of the supplied data handlers.
+func registryOf(dataHandlers ...handlers.DataHandler) *handlers.Registry {
+	registry := handlers.NewRegistry()
+	for _, handler := range dataHandlers {
+		if err := registry.Register(handler); err != nil {
+			panic(err)
+		}
+	}
+	return registry
+}
+
+// events drains the events recorded so far by the supplied recorder.
+func events(recorder *record.FakeRecorder) []string {
+	recorded := []string{}
+	for {
+		select {
+		case event := <-recorder.Events:
+			recorded = append(recorded, event)
+		default:
+			return recorded
+		}
+	}
+}
+
 func TestHook(t *testing.T) {
 
 	// Create a fake CR client
@@ -59,7 +136,7 @@ func TestHook(t *testing.T) {
 	var s3SourceType vckv1alpha1.DataSourceType = "S3"
 	fakeDataHandler := &testDataHandler{sourceType: s3SourceType}
 
-	hook := NewVolumeManagerHooks(fakeClient.VckV1alpha1().VolumeManagers(namespace), []handlers.DataHandler{fakeDataHandler})
+	hook := NewVolumeManagerHooks(fakeClient.VckV1alpha1(), registryOf(fakeDataHandler), nil, &record.FakeRecorder{}, 0)
 
 	// Create a fake vck CR
 	volumeManager := &vckv1alpha1.VolumeManager{
@@ -86,34 +163,38 @@ func TestHook(t *testing.T) {
 	require.Nil(t, err)
 
 	// Add it
-	hook.add(volumeManager)
+	hook.add(context.Background(), volumeManager)
 
 	// Assert things.
 	require.True(t, fakeDataHandler.addCalled)
 	require.False(t, fakeDataHandler.deleteCalled)
 
 	// Test case 2: If a CR is created without a valid source type,
-	// the add/delete should not get called.
-	// TODO(ajay): should we error the CR in that case?
+	// the add/delete should not get called and the CR should fail.
 	s3SourceType = "foo"
 	fakeDataHandler = &testDataHandler{sourceType: s3SourceType}
 
-	hook = NewVolumeManagerHooks(fakeClient.VckV1alpha1().VolumeManagers(namespace), []handlers.DataHandler{fakeDataHandler})
+	hook = NewVolumeManagerHooks(fakeClient.VckV1alpha1(), registryOf(fakeDataHandler), nil, &record.FakeRecorder{}, 0)
 
 	// Add it
-	hook.add(volumeManager)
+	hook.add(context.Background(), volumeManager)
 
 	// Assert things.
 	require.False(t, fakeDataHandler.addCalled)
 	require.False(t, fakeDataHandler.deleteCalled)
 
+	volumeManager, err = fakeClient.VckV1alpha1().VolumeManagers(namespace).Get(volumeManager.Name, metav1.GetOptions{})
+	require.Nil(t, err)
+	require.Equal(t, states.Failed, volumeManager.Status.State)
+	require.Equal(t, vckv1alpha1.VolumeReasonUnsupportedSourceType, volumeManager.Status.Volumes[0].Reason)
+
 	// Test case 3: Create a CR with an invalid spec state
 	// It should not call any method in the handler
 	// The status of the CR should be set to Failed too
 	fakeClient = vckv1alpha1_fake.NewSimpleClientset()
 	s3SourceType = "s3"
 	fakeDataHandler = &testDataHandler{sourceType: s3SourceType}
-	hook = NewVolumeManagerHooks(fakeClient.VckV1alpha1().VolumeManagers(namespace), []handlers.DataHandler{fakeDataHandler})
+	hook = NewVolumeManagerHooks(fakeClient.VckV1alpha1(), registryOf(fakeDataHandler), nil, &record.FakeRecorder{}, 0)
 
 	volumeManager.Spec.State = states.Failed
 
@@ -122,7 +203,7 @@ func TestHook(t *testing.T) {
 	require.NotNil(t, volumeManager)
 	require.Nil(t, err)
 
-	hook.add(volumeManager)
+	hook.add(context.Background(), volumeManager)
 
 	// Assert things.
 	require.False(t, fakeDataHandler.addCalled)
@@ -134,4 +215,1015 @@ func TestHook(t *testing.T) {
 	require.Nil(t, err)
 
 	require.Equal(t, states.Failed, volumeManager.Status.State)
+
+	// Test case 4: a failed volume leaves the CR in a Failed state.
+	fakeClient = vckv1alpha1_fake.NewSimpleClientset()
+	fakeDataHandler = &testDataHandler{sourceType: volumeManager.Spec.VolumeConfigs[0].SourceType, addFailed: true}
+	hook = NewVolumeManagerHooks(fakeClient.VckV1alpha1(), registryOf(fakeDataHandler), nil, &record.FakeRecorder{}, 0)
+
+	volumeManager.Spec.State = states.Running
+	volumeManager.Status = vckv1alpha1.VolumeManagerStatus{}
+	volumeManager, err = fakeClient.VckV1alpha1().VolumeManagers(namespace).Create(volumeManager)
+	require.Nil(t, err)
+
+	hook.add(context.Background(), volumeManager)
+	require.True(t, fakeDataHandler.addCalled)
+
+	volumeManager, err = fakeClient.VckV1alpha1().VolumeManagers(namespace).Get(volumeManager.Name, metav1.GetOptions{})
+	require.Nil(t, err)
+	require.Equal(t, states.Failed, volumeManager.Status.State)
+	require.Equal(t, "failed to deploy all the sub-resources", volumeManager.Status.Message)
+}
+
+func TestValidate(t *testing.T) {
+	namespace := "test"
+	var s3SourceType vckv1alpha1.DataSourceType = "S3"
+
+	testCases := map[string]struct {
+		volumeConfigs   []vckv1alpha1.VolumeConfig
+		validateErr     error
+		expectedInvalid []vckv1alpha1.Volume
+	}{
+		"valid volume configs": {
+			volumeConfigs: []vckv1alpha1.VolumeConfig{
+				{ID: "vol1", SourceType: s3SourceType},
+				{ID: "vol2", SourceType: "s3"},
+			},
+			expectedInvalid: []vckv1alpha1.Volume{},
+		},
+		"duplicate ID and unknown source type": {
+			volumeConfigs: []vckv1alpha1.VolumeConfig{
+				{ID: "vol1", SourceType: s3SourceType},
+				{ID: "vol1", SourceType: s3SourceType},
+				{ID: "vol2", SourceType: "foo"},
+			},
+			expectedInvalid: []vckv1alpha1.Volume{
+				{ID: "vol1", Phase: vckv1alpha1.VolumeFailed, Reason: vckv1alpha1.VolumeReasonInvalidOptions, Message: `volume ID "vol1" is not unique`},
+				{ID: "vol2", Phase: vckv1alpha1.VolumeFailed, Reason: vckv1alpha1.VolumeReasonUnsupportedSourceType, Message: `no data handler supports source type "foo", supported source types: S3`},
+			},
+		},
+		"rejected by the data handler": {
+			volumeConfigs: []vckv1alpha1.VolumeConfig{
+				{ID: "vol1", SourceType: s3SourceType},
+			},
+			validateErr: fmt.Errorf("sourceURL has to be set in options"),
+			expectedInvalid: []vckv1alpha1.Volume{
+				{ID: "vol1", Phase: vckv1alpha1.VolumeFailed, Reason: vckv1alpha1.VolumeReasonInvalidOptions, Message: "sourceURL has to be set in options"},
+			},
+		},
+	}
+
+	for key, tc := range testCases {
+		t.Logf("Testing for: %v", key)
+		fakeClient := vckv1alpha1_fake.NewSimpleClientset()
+		fakeDataHandler := &testDataHandler{sourceType: s3SourceType, validateErr: tc.validateErr}
+		recorder := record.NewFakeRecorder(10)
+		hook := NewVolumeManagerHooks(fakeClient.VckV1alpha1(), registryOf(fakeDataHandler), nil, recorder, 0)
+
+		volumeManager, err := fakeClient.VckV1alpha1().VolumeManagers(namespace).Create(&vckv1alpha1.VolumeManager{
+			ObjectMeta: metav1.ObjectMeta{Name: "volumeManager"},
+			Spec: vckv1alpha1.VolumeManagerSpec{
+				VolumeConfigs: tc.volumeConfigs,
+				State:         states.Running,
+			},
+		})
+		require.Nil(t, err)
+		require.Equal(t, tc.expectedInvalid, hook.validate(volumeManager))
+
+		hook.add(context.Background(), volumeManager)
+		volumeManager, err = fakeClient.VckV1alpha1().VolumeManagers(namespace).Get(volumeManager.Name, metav1.GetOptions{})
+		require.Nil(t, err)
+		if len(tc.expectedInvalid) == 0 {
+			require.True(t, fakeDataHandler.addCalled)
+			require.True(t, volumeManager.Status.IsConditionTrue(vckv1alpha1.VolumeManagerValidated))
+			continue
+		}
+
+		// Nothing is created for a CR with any invalid volume config.
+		require.False(t, fakeDataHandler.addCalled)
+		require.Equal(t, states.Failed, volumeManager.Status.State)
+		require.Equal(t, tc.expectedInvalid, volumeManager.Status.Volumes)
+		require.False(t, volumeManager.Status.IsConditionTrue(vckv1alpha1.VolumeManagerValidated))
+		require.Contains(t, events(recorder), "Warning ValidationFailed "+volumeManager.Status.Message)
+	}
+
+	// An invalid edit of a running CR is rejected without touching its volumes.
+	fakeClient := vckv1alpha1_fake.NewSimpleClientset()
+	fakeDataHandler := &testDataHandler{sourceType: s3SourceType}
+	hook := NewVolumeManagerHooks(fakeClient.VckV1alpha1(), registryOf(fakeDataHandler), nil, record.NewFakeRecorder(10), 0)
+
+	oldVolumeManager, err := fakeClient.VckV1alpha1().VolumeManagers(namespace).Create(&vckv1alpha1.VolumeManager{
+		ObjectMeta: metav1.ObjectMeta{Name: "volumeManager"},
+		Spec: vckv1alpha1.VolumeManagerSpec{
+			VolumeConfigs: []vckv1alpha1.VolumeConfig{{ID: "vol1", SourceType: s3SourceType}},
+			State:         states.Running,
+		},
+		Status: vckv1alpha1.VolumeManagerStatus{
+			Volumes: []vckv1alpha1.Volume{{ID: "vol1", Phase: vckv1alpha1.VolumeReady}},
+			State:   states.Running,
+		},
+	})
+	require.Nil(t, err)
+
+	newVolumeManager := oldVolumeManager.DeepCopy()
+	newVolumeManager.Spec.VolumeConfigs = append(newVolumeManager.Spec.VolumeConfigs, vckv1alpha1.VolumeConfig{ID: "vol1", SourceType: s3SourceType})
+	require.True(t, hook.update(context.Background(), newVolumeManager))
+	require.False(t, fakeDataHandler.addCalled)
+	require.False(t, fakeDataHandler.deleteCalled)
+
+	newVolumeManager, err = fakeClient.VckV1alpha1().VolumeManagers(namespace).Get(newVolumeManager.Name, metav1.GetOptions{})
+	require.Nil(t, err)
+	require.Equal(t, states.Running, newVolumeManager.Status.State)
+	require.False(t, newVolumeManager.Status.IsConditionTrue(vckv1alpha1.VolumeManagerValidated))
+
+	// Reverting the edit clears the condition.
+	revertedVolumeManager := newVolumeManager.DeepCopy()
+	revertedVolumeManager.Spec = oldVolumeManager.Spec
+	require.True(t, hook.update(context.Background(), revertedVolumeManager))
+	require.False(t, fakeDataHandler.addCalled)
+
+	revertedVolumeManager, err = fakeClient.VckV1alpha1().VolumeManagers(namespace).Get(revertedVolumeManager.Name, metav1.GetOptions{})
+	require.Nil(t, err)
+	require.True(t, revertedVolumeManager.Status.IsConditionTrue(vckv1alpha1.VolumeManagerValidated))
+}
+
+// barrierDataHandler only provisions a volume once all the volumes it expects
+// are being provisioned at the same time.
+type barrierDataHandler struct {
+	*testDataHandler
+	barrier *sync.WaitGroup
+}
+
+func (bdh *barrierDataHandler) OnAdd(ctx context.Context, namespace string, vc vckv1alpha1.VolumeConfig, controllerRef metav1.OwnerReference, setPhase handlers.PhaseFunc) vckv1alpha1.Volume {
+	bdh.barrier.Done()
+	done := make(chan struct{})
+	go func() {
+		bdh.barrier.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return bdh.testDataHandler.OnAdd(ctx, namespace, vc, controllerRef, setPhase)
+	case <-time.After(5 * time.Second):
+		return vckv1alpha1.Volume{ID: vc.ID, Phase: vckv1alpha1.VolumeFailed, Message: "not provisioned concurrently"}
+	}
+}
+
+func TestAddConcurrently(t *testing.T) {
+	fakeClient := vckv1alpha1_fake.NewSimpleClientset()
+	namespace := "test"
+
+	barrier := &sync.WaitGroup{}
+	barrier.Add(3)
+	fakeDataHandler := &barrierDataHandler{testDataHandler: &testDataHandler{sourceType: "S3"}, barrier: barrier}
+	hook := NewVolumeManagerHooks(fakeClient.VckV1alpha1(), registryOf(fakeDataHandler), nil, record.NewFakeRecorder(10), 0)
+
+	volumeManager, err := fakeClient.VckV1alpha1().VolumeManagers(namespace).Create(&vckv1alpha1.VolumeManager{
+		ObjectMeta: metav1.ObjectMeta{Name: "volumeManager"},
+		Spec: vckv1alpha1.VolumeManagerSpec{
+			VolumeConfigs: []vckv1alpha1.VolumeConfig{
+				{ID: "vol1", SourceType: "S3"},
+				{ID: "vol2", SourceType: "S3"},
+				{ID: "vol3", SourceType: "S3"},
+			},
+			State: states.Running,
+		},
+	})
+	require.Nil(t, err)
+
+	hook.add(context.Background(), volumeManager)
+
+	// The statuses are recorded in the order of the volume configs.
+	volumeManager, err = fakeClient.VckV1alpha1().VolumeManagers(namespace).Get(volumeManager.Name, metav1.GetOptions{})
+	require.Nil(t, err)
+	require.Equal(t, states.Running, volumeManager.Status.State)
+	for idx, id := range []string{"vol1", "vol2", "vol3"} {
+		require.Equal(t, id, volumeManager.Status.Volumes[idx].ID)
+		require.Equal(t, vckv1alpha1.VolumeReady, volumeManager.Status.Volumes[idx].Phase)
+	}
+}
+
+// queueingDataHandler waits for a free download slot before provisioning a
+// volume.
+type queueingDataHandler struct {
+	*testDataHandler
+	limiter    *handlers.DownloadLimiter
+	priorities chan int
+}
+
+func (qdh *queueingDataHandler) OnAdd(ctx context.Context, namespace string, vc vckv1alpha1.VolumeConfig, controllerRef metav1.OwnerReference, setPhase handlers.PhaseFunc) vckv1alpha1.Volume {
+	setPhase(vckv1alpha1.VolumeDownloading)
+	qdh.priorities <- vc.Priority
+	if err := qdh.limiter.Acquire(ctx, namespace+"/"+controllerRef.Name, vc.Priority); err != nil {
+		return vckv1alpha1.Volume{ID: vc.ID, Phase: vckv1alpha1.VolumeFailed, Message: err.Error()}
+	}
+	defer qdh.limiter.Release()
+	return qdh.testDataHandler.OnAdd(ctx, namespace, vc, controllerRef, setPhase)
+}
+
+func TestQueuePosition(t *testing.T) {
+	defer func(period time.Duration) {
+		queuePositionPeriod = period
+	}(queuePositionPeriod)
+	queuePositionPeriod = 10 * time.Millisecond
+
+	fakeClient := vckv1alpha1_fake.NewSimpleClientset()
+	namespace := "test"
+
+	// Another volume manager holds the only download slot.
+	limiter := handlers.NewDownloadLimiter(1, 0)
+	require.Nil(t, limiter.Acquire(context.Background(), "test/other", 0))
+
+	fakeDataHandler := &queueingDataHandler{testDataHandler: &testDataHandler{sourceType: "S3"}, limiter: limiter, priorities: make(chan int, 2)}
+	hook := NewVolumeManagerHooks(fakeClient.VckV1alpha1(), registryOf(fakeDataHandler), limiter, record.NewFakeRecorder(10), 0)
+
+	volumeManager, err := fakeClient.VckV1alpha1().VolumeManagers(namespace).Create(&vckv1alpha1.VolumeManager{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "volumeManager",
+			Annotations: map[string]string{vckv1alpha1.PriorityAnnotation: "7"},
+		},
+		Spec: vckv1alpha1.VolumeManagerSpec{
+			VolumeConfigs: []vckv1alpha1.VolumeConfig{
+				{ID: "vol1", SourceType: "S3"},
+				{ID: "vol2", SourceType: "S3", Priority: 10},
+			},
+			State: states.Running,
+		},
+	})
+	require.Nil(t, err)
+
+	// The reconcile reports heartbeats to the controller while it waits.
+	heartbeats := make(chan struct{}, 1)
+	ctx := controller.WithHeartbeat(context.Background(), func() {
+		select {
+		case heartbeats <- struct{}{}:
+		default:
+		}
+	})
+	done := make(chan struct{})
+	go func() {
+		hook.add(ctx, volumeManager)
+		close(done)
+	}()
+
+	// The volume config priority takes precedence over the annotation.
+	priorities := []int{<-fakeDataHandler.priorities, <-fakeDataHandler.priorities}
+	require.ElementsMatch(t, []int{7, 10}, priorities)
+
+	// The position of the first download of the CR is reported while it
+	// waits for the slot, along with the phase of its volumes.
+	require.Nil(t, wait.Poll(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		volumeManager, err := fakeClient.VckV1alpha1().VolumeManagers(namespace).Get(volumeManager.Name, metav1.GetOptions{})
+		if err != nil || volumeManager.Status.QueuePosition != 1 {
+			return false, err
+		}
+		for _, vStatus := range volumeManager.Status.Volumes {
+			if vStatus.Phase != vckv1alpha1.VolumeDownloading {
+				return false, nil
+			}
+		}
+		return true, nil
+	}))
+	<-heartbeats
+
+	limiter.Release()
+	<-done
+
+	volumeManager, err = fakeClient.VckV1alpha1().VolumeManagers(namespace).Get(volumeManager.Name, metav1.GetOptions{})
+	require.Nil(t, err)
+	require.Equal(t, states.Running, volumeManager.Status.State)
+	require.Equal(t, 0, volumeManager.Status.QueuePosition)
+
+	// An invalid priority annotation is rejected.
+	volumeManager, err = fakeClient.VckV1alpha1().VolumeManagers(namespace).Create(&vckv1alpha1.VolumeManager{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "invalid",
+			Annotations: map[string]string{vckv1alpha1.PriorityAnnotation: "high"},
+		},
+		Spec: vckv1alpha1.VolumeManagerSpec{
+			VolumeConfigs: []vckv1alpha1.VolumeConfig{{ID: "vol1", SourceType: "S3"}},
+			State:         states.Running,
+		},
+	})
+	require.Nil(t, err)
+
+	hook.add(context.Background(), volumeManager)
+	volumeManager, err = fakeClient.VckV1alpha1().VolumeManagers(namespace).Get(volumeManager.Name, metav1.GetOptions{})
+	require.Nil(t, err)
+	require.Equal(t, states.Failed, volumeManager.Status.State)
+	require.Contains(t, volumeManager.Status.Message, "invalid vck.intelai.org/priority annotation")
+}
+
+// steppingDataHandler reports the phases of a volume as the data handlers do
+// and waits for the test before moving on to the next one.
+type steppingDataHandler struct {
+	*testDataHandler
+	steps chan struct{}
+}
+
+func (sdh *steppingDataHandler) OnAdd(ctx context.Context, namespace string, vc vckv1alpha1.VolumeConfig, controllerRef metav1.OwnerReference, setPhase handlers.PhaseFunc) vckv1alpha1.Volume {
+	setPhase(vckv1alpha1.VolumeDownloading)
+	<-sdh.steps
+	setPhase(vckv1alpha1.VolumeLabeling)
+	<-sdh.steps
+	return sdh.testDataHandler.OnAdd(ctx, namespace, vc, controllerRef, setPhase)
+}
+
+// writtenPhases returns the phases of a volume in the statuses written so far,
+// without repeating the unchanged ones.
+func writtenPhases(fakeClient *vckv1alpha1_fake.Clientset, id string) []vckv1alpha1.VolumePhase {
+	phases := []vckv1alpha1.VolumePhase{}
+	for _, action := range fakeClient.Actions() {
+		update, ok := action.(k8stesting.UpdateAction)
+		if !ok || update.GetSubresource() != "status" {
+			continue
+		}
+		for _, vStatus := range update.GetObject().(*vckv1alpha1.VolumeManager).Status.Volumes {
+			if vStatus.ID == id && (len(phases) == 0 || phases[len(phases)-1] != vStatus.Phase) {
+				phases = append(phases, vStatus.Phase)
+			}
+		}
+	}
+	return phases
+}
+
+func TestVolumePhases(t *testing.T) {
+	fakeClient := vckv1alpha1_fake.NewSimpleClientset()
+	namespace := "test"
+
+	fakeDataHandler := &steppingDataHandler{testDataHandler: &testDataHandler{sourceType: "S3"}, steps: make(chan struct{})}
+	hook := NewVolumeManagerHooks(fakeClient.VckV1alpha1(), registryOf(fakeDataHandler), nil, record.NewFakeRecorder(100), 0)
+
+	volumeManager, err := fakeClient.VckV1alpha1().VolumeManagers(namespace).Create(&vckv1alpha1.VolumeManager{
+		ObjectMeta: metav1.ObjectMeta{Name: "volumeManager"},
+		Spec: vckv1alpha1.VolumeManagerSpec{
+			VolumeConfigs: []vckv1alpha1.VolumeConfig{
+				{ID: "vol1", SourceType: "S3"},
+			},
+			State: states.Running,
+		},
+	})
+	require.Nil(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		hook.add(context.Background(), volumeManager)
+		close(done)
+	}()
+
+	// Each phase is written as the data handler enters it.
+	for _, phase := range []vckv1alpha1.VolumePhase{vckv1alpha1.VolumeDownloading, vckv1alpha1.VolumeLabeling} {
+		require.Nil(t, wait.Poll(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+			phases := writtenPhases(fakeClient, "vol1")
+			return phases[len(phases)-1] == phase, nil
+		}))
+		fakeDataHandler.steps <- struct{}{}
+	}
+	<-done
+	require.Equal(t, []vckv1alpha1.VolumePhase{
+		vckv1alpha1.VolumeValidating,
+		vckv1alpha1.VolumeDownloading,
+		vckv1alpha1.VolumeLabeling,
+		vckv1alpha1.VolumeReady,
+	}, writtenPhases(fakeClient, "vol1"))
+
+	volumeManager, err = fakeClient.VckV1alpha1().VolumeManagers(namespace).Get(volumeManager.Name, metav1.GetOptions{})
+	require.Nil(t, err)
+	require.Equal(t, vckv1alpha1.VolumeReady, volumeManager.Status.Volumes[0].Phase)
+	require.Empty(t, volumeManager.Status.Volumes[0].Message)
+
+	// The volume is marked as Deleting before its teardown starts, and goes
+	// back to its phase once a completed volume manager is cleaned up.
+	require.Nil(t, hook.complete(context.Background(), volumeManager))
+	phases := writtenPhases(fakeClient, "vol1")
+	require.Equal(t, []vckv1alpha1.VolumePhase{vckv1alpha1.VolumeDeleting, vckv1alpha1.VolumeReady}, phases[len(phases)-2:])
+	require.Equal(t, []string{"vol1"}, fakeDataHandler.deleted)
+}
+
+func TestRollback(t *testing.T) {
+	namespace := "test"
+
+	testCases := map[string]struct {
+		policy              vckv1alpha1.ProvisioningPolicy
+		deleteErr           error
+		expectedState       states.State
+		expectedDeleted     []string
+		expectedPhase       vckv1alpha1.VolumePhase
+		expectedReason      vckv1alpha1.VolumeReason
+		expectedCleanupDone bool
+	}{
+		"all or nothing by default": {
+			expectedState:       states.Failed,
+			expectedDeleted:     []string{"ok"},
+			expectedPhase:       vckv1alpha1.VolumeFailed,
+			expectedReason:      vckv1alpha1.VolumeReasonRolledBack,
+			expectedCleanupDone: true,
+		},
+		"failed rollback": {
+			policy:          vckv1alpha1.ProvisioningPolicyAllOrNothing,
+			deleteErr:       fmt.Errorf("delete failed"),
+			expectedState:   states.Failed,
+			expectedDeleted: []string{"ok"},
+			expectedPhase:   vckv1alpha1.VolumeDeleting,
+			expectedReason:  vckv1alpha1.VolumeReasonCleanupFailed,
+		},
+		"partial success": {
+			policy:          vckv1alpha1.ProvisioningPolicyPartialSuccess,
+			expectedState:   states.Running,
+			expectedDeleted: nil,
+			expectedPhase:   vckv1alpha1.VolumeReady,
+			expectedReason:  vckv1alpha1.VolumeReasonProvisioned,
+		},
+	}
+
+	for key, tc := range testCases {
+		t.Logf("Testing for: %v", key)
+		fakeClient := vckv1alpha1_fake.NewSimpleClientset()
+		okDataHandler := &testDataHandler{sourceType: "S3", deleteErr: tc.deleteErr}
+		failedDataHandler := &testDataHandler{sourceType: "NFS", addFailed: true}
+		hook := NewVolumeManagerHooks(fakeClient.VckV1alpha1(), registryOf(okDataHandler, failedDataHandler), nil, record.NewFakeRecorder(10), 0)
+
+		volumeManager, err := fakeClient.VckV1alpha1().VolumeManagers(namespace).Create(&vckv1alpha1.VolumeManager{
+			ObjectMeta: metav1.ObjectMeta{Name: "volumeManager"},
+			Spec: vckv1alpha1.VolumeManagerSpec{
+				VolumeConfigs: []vckv1alpha1.VolumeConfig{
+					{ID: "ok", SourceType: "S3"},
+					{ID: "failed", SourceType: "NFS"},
+				},
+				State:              states.Running,
+				ProvisioningPolicy: tc.policy,
+			},
+		})
+		require.Nil(t, err)
+
+		hook.add(context.Background(), volumeManager)
+		require.Equal(t, tc.expectedDeleted, okDataHandler.deleted)
+
+		volumeManager, err = fakeClient.VckV1alpha1().VolumeManagers(namespace).Get(volumeManager.Name, metav1.GetOptions{})
+		require.Nil(t, err)
+		require.Equal(t, tc.expectedState, volumeManager.Status.State)
+		require.Equal(t, "ok", volumeManager.Status.Volumes[0].ID)
+		require.Equal(t, tc.expectedPhase, volumeManager.Status.Volumes[0].Phase)
+		require.Equal(t, tc.expectedReason, volumeManager.Status.Volumes[0].Reason)
+		require.Equal(t, vckv1alpha1.VolumeFailed, volumeManager.Status.Volumes[1].Phase)
+		require.False(t, volumeManager.Status.IsConditionTrue(vckv1alpha1.VolumeManagerReady))
+
+		// The cleanup of a failed CR is only retried if the rollback failed.
+		okDataHandler.deleted = nil
+		hook.update(context.Background(), volumeManager)
+		if tc.expectedState == states.Failed && !tc.expectedCleanupDone {
+			require.Equal(t, []string{"ok"}, okDataHandler.deleted)
+		} else {
+			require.Empty(t, okDataHandler.deleted)
+		}
+	}
+
+	// An unknown policy is rejected before anything is created.
+	fakeClient := vckv1alpha1_fake.NewSimpleClientset()
+	fakeDataHandler := &testDataHandler{sourceType: "S3"}
+	hook := NewVolumeManagerHooks(fakeClient.VckV1alpha1(), registryOf(fakeDataHandler), nil, record.NewFakeRecorder(10), 0)
+
+	volumeManager, err := fakeClient.VckV1alpha1().VolumeManagers(namespace).Create(&vckv1alpha1.VolumeManager{
+		ObjectMeta: metav1.ObjectMeta{Name: "volumeManager"},
+		Spec: vckv1alpha1.VolumeManagerSpec{
+			VolumeConfigs:      []vckv1alpha1.VolumeConfig{{ID: "vol1", SourceType: "S3"}},
+			State:              states.Running,
+			ProvisioningPolicy: "foo",
+		},
+	})
+	require.Nil(t, err)
+
+	hook.add(context.Background(), volumeManager)
+	require.False(t, fakeDataHandler.addCalled)
+
+	volumeManager, err = fakeClient.VckV1alpha1().VolumeManagers(namespace).Get(volumeManager.Name, metav1.GetOptions{})
+	require.Nil(t, err)
+	require.Equal(t, states.Failed, volumeManager.Status.State)
+	require.Equal(t, `unknown provisioning policy "foo"`, volumeManager.Status.Message)
+}
+
+func TestReconcile(t *testing.T) {
+	fakeClient := vckv1alpha1_fake.NewSimpleClientset()
+	namespace := "test"
+
+	var s3SourceType vckv1alpha1.DataSourceType = "S3"
+	fakeDataHandler := &testDataHandler{sourceType: s3SourceType}
+	recorder := record.NewFakeRecorder(100)
+	hook := NewVolumeManagerHooks(fakeClient.VckV1alpha1(), registryOf(fakeDataHandler), nil, recorder, time.Nanosecond)
+
+	volumeManager, err := fakeClient.VckV1alpha1().VolumeManagers(namespace).Create(&vckv1alpha1.VolumeManager{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:       "volumeManager",
+			Generation: 2,
+		},
+		Spec: vckv1alpha1.VolumeManagerSpec{
+			VolumeConfigs: []vckv1alpha1.VolumeConfig{
+				{
+					SourceType: s3SourceType,
+				},
+			},
+			State: states.Running,
+		},
+	})
+	require.Nil(t, err)
+
+	// Test case 1: a CR without a status is provisioned.
+	require.Nil(t, hook.Reconcile(context.Background(), "test/volumeManager"))
+	require.True(t, fakeDataHandler.addCalled)
+	require.False(t, fakeDataHandler.deleteCalled)
+
+	volumeManager, err = fakeClient.VckV1alpha1().VolumeManagers(namespace).Get(volumeManager.Name, metav1.GetOptions{})
+	require.Nil(t, err)
+	require.NotEqual(t, states.State(""), volumeManager.Status.State)
+	require.Equal(t, []string{vckv1alpha1.CleanupFinalizer}, volumeManager.Finalizers)
+	require.Equal(t, int64(2), volumeManager.Status.ObservedGeneration)
+	require.True(t, volumeManager.Status.IsConditionTrue(vckv1alpha1.VolumeManagerValidated))
+	require.True(t, volumeManager.Status.IsConditionTrue(vckv1alpha1.VolumeManagerReady))
+	require.False(t, volumeManager.Status.IsConditionTrue(vckv1alpha1.VolumeManagerProvisioning))
+	require.Equal(t, []string{
+		"Normal ProvisioningStarted beginning sub-resource deployment",
+		"Normal Provisioned volume  is ready",
+		"Normal Provisioned successfully deployed all sub-resources",
+	}, events(recorder))
+
+	// Test case 2: reconciling an unchanged CR does not provision it again,
+	// and only starts the period of the drift checks.
+	fakeDataHandler.addCalled = false
+	fakeDataHandler.repaired = []string{"recreated"}
+	require.Nil(t, hook.Reconcile(context.Background(), "test/volumeManager"))
+	require.False(t, fakeDataHandler.addCalled)
+	require.Empty(t, events(recorder))
+
+	// Test case 3: a repaired drift is recorded in the Degraded condition,
+	// without provisioning the volume again.
+	require.Nil(t, hook.Reconcile(context.Background(), "test/volumeManager"))
+	require.False(t, fakeDataHandler.addCalled)
+	require.False(t, fakeDataHandler.deleteCalled)
+
+	volumeManager, err = fakeClient.VckV1alpha1().VolumeManagers(namespace).Get(volumeManager.Name, metav1.GetOptions{})
+	require.Nil(t, err)
+	require.Equal(t, states.Running, volumeManager.Status.State)
+	degraded := volumeManager.Status.GetCondition(vckv1alpha1.VolumeManagerDegraded)
+	require.Equal(t, corev1.ConditionFalse, degraded.Status)
+	require.Equal(t, "Repaired", degraded.Reason)
+	require.Equal(t, "repaired drifted volumes: : recreated", degraded.Message)
+	require.Equal(t, []string{"Normal Repaired repaired drifted volumes: : recreated"}, events(recorder))
+
+	// Test case 4: a drift which cannot be repaired degrades the CR without
+	// failing it, until it is resolved.
+	fakeDataHandler.repaired = nil
+	fakeDataHandler.repairErr = fmt.Errorf("data missing")
+	require.Nil(t, hook.Reconcile(context.Background(), "test/volumeManager"))
+
+	volumeManager, err = fakeClient.VckV1alpha1().VolumeManagers(namespace).Get(volumeManager.Name, metav1.GetOptions{})
+	require.Nil(t, err)
+	require.Equal(t, states.Running, volumeManager.Status.State)
+	require.True(t, volumeManager.Status.IsConditionTrue(vckv1alpha1.VolumeManagerReady))
+	degraded = volumeManager.Status.GetCondition(vckv1alpha1.VolumeManagerDegraded)
+	require.Equal(t, corev1.ConditionTrue, degraded.Status)
+	require.Equal(t, "RepairFailed", degraded.Reason)
+	require.Equal(t, "failed to repair drifted volumes: : data missing", degraded.Message)
+	require.Equal(t, []string{"Warning RepairFailed failed to repair drifted volumes: : data missing"}, events(recorder))
+
+	fakeDataHandler.repairErr = nil
+	require.Nil(t, hook.Reconcile(context.Background(), "test/volumeManager"))
+
+	volumeManager, err = fakeClient.VckV1alpha1().VolumeManagers(namespace).Get(volumeManager.Name, metav1.GetOptions{})
+	require.Nil(t, err)
+	degraded = volumeManager.Status.GetCondition(vckv1alpha1.VolumeManagerDegraded)
+	require.Equal(t, corev1.ConditionFalse, degraded.Status)
+	require.Equal(t, "InSync", degraded.Reason)
+	require.Equal(t, []string{"Normal InSync the sub-resources of all volumes are in sync"}, events(recorder))
+
+	// Test case 5: the finalizer is kept until the cleanup succeeds.
+	fakeDataHandler.deleteErr = fmt.Errorf("delete failed")
+	deletionTimestamp := metav1.Now()
+	volumeManager.DeletionTimestamp = &deletionTimestamp
+	volumeManager, err = fakeClient.VckV1alpha1().VolumeManagers(namespace).Update(volumeManager)
+	require.Nil(t, err)
+	require.NotNil(t, hook.Reconcile(context.Background(), "test/volumeManager"))
+
+	volumeManager, err = fakeClient.VckV1alpha1().VolumeManagers(namespace).Get(volumeManager.Name, metav1.GetOptions{})
+	require.Nil(t, err)
+	require.Equal(t, []string{vckv1alpha1.CleanupFinalizer}, volumeManager.Finalizers)
+	require.Contains(t, volumeManager.Status.Message, "delete failed")
+	require.True(t, volumeManager.Status.IsConditionTrue(vckv1alpha1.VolumeManagerCleanupFailed))
+	require.Equal(t, vckv1alpha1.VolumeDeleting, volumeManager.Status.Volumes[0].Phase)
+	require.Equal(t, vckv1alpha1.VolumeReasonCleanupFailed, volumeManager.Status.Volumes[0].Reason)
+	require.Equal(t, "failed to clean up the sub-resources: delete failed", volumeManager.Status.Volumes[0].Message)
+	require.Contains(t, events(recorder), "Warning CleanupFailed failed to clean up the sub-resources: volume : delete failed")
+
+	fakeDataHandler.deleteErr = nil
+	require.Nil(t, hook.Reconcile(context.Background(), "test/volumeManager"))
+
+	volumeManager, err = fakeClient.VckV1alpha1().VolumeManagers(namespace).Get(volumeManager.Name, metav1.GetOptions{})
+	require.Nil(t, err)
+	require.Empty(t, volumeManager.Finalizers)
+	require.Equal(t, "successfully cleaned up all sub-resources", volumeManager.Status.Message)
+
+	// Test case 6: a CR which is gone without being finalized is cleaned up
+	// using its last seen version.
+	volumeManager.DeletionTimestamp = nil
+	volumeManager.Finalizers = []string{vckv1alpha1.CleanupFinalizer}
+	volumeManager, err = fakeClient.VckV1alpha1().VolumeManagers(namespace).Update(volumeManager)
+	require.Nil(t, err)
+	require.Nil(t, hook.Reconcile(context.Background(), "test/volumeManager"))
+	fakeDataHandler.deleteCalled = false
+	err = fakeClient.VckV1alpha1().VolumeManagers(namespace).Delete(volumeManager.Name, &metav1.DeleteOptions{})
+	require.Nil(t, err)
+	require.Nil(t, hook.Reconcile(context.Background(), "test/volumeManager"))
+	require.True(t, fakeDataHandler.deleteCalled)
+
+	// Test case 7: an invalid key is dropped without an error.
+	require.Nil(t, hook.Reconcile(context.Background(), "a/b/c"))
+}
+
+func TestResume(t *testing.T) {
+	fakeClient := vckv1alpha1_fake.NewSimpleClientset()
+	namespace := "test"
+
+	var s3SourceType vckv1alpha1.DataSourceType = "S3"
+	fakeDataHandler := &testDataHandler{sourceType: s3SourceType}
+	hook := NewVolumeManagerHooks(fakeClient.VckV1alpha1(), registryOf(fakeDataHandler), nil, &record.FakeRecorder{}, 0)
+
+	// A CR left pending by a controller which went away during provisioning.
+	volumeManager, err := fakeClient.VckV1alpha1().VolumeManagers(namespace).Create(&vckv1alpha1.VolumeManager{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:       "volumeManager",
+			Finalizers: []string{vckv1alpha1.CleanupFinalizer},
+		},
+		Spec: vckv1alpha1.VolumeManagerSpec{
+			VolumeConfigs: []vckv1alpha1.VolumeConfig{
+				{
+					ID:         "vol1",
+					SourceType: s3SourceType,
+				},
+			},
+			State: states.Running,
+		},
+		Status: vckv1alpha1.VolumeManagerStatus{
+			State: states.Pending,
+			Volumes: []vckv1alpha1.Volume{
+				{
+					ID:    "vol1",
+					Phase: vckv1alpha1.VolumeValidating,
+				},
+			},
+		},
+	})
+	require.Nil(t, err)
+
+	// The volumes are provisioned again without cleaning up the sub-resources
+	// created before, which the handlers adopt.
+	require.Nil(t, hook.Reconcile(context.Background(), "test/volumeManager"))
+	require.Empty(t, fakeDataHandler.deleted)
+	require.Equal(t, []string{"vol1"}, fakeDataHandler.added)
+
+	volumeManager, err = fakeClient.VckV1alpha1().VolumeManagers(namespace).Get(volumeManager.Name, metav1.GetOptions{})
+	require.Nil(t, err)
+	require.Equal(t, states.Running, volumeManager.Status.State)
+	require.Equal(t, vckv1alpha1.VolumeReady, volumeManager.Status.Volumes[0].Phase)
+}
+
+func TestUpdate(t *testing.T) {
+	fakeClient := vckv1alpha1_fake.NewSimpleClientset()
+	namespace := "test"
+
+	var s3SourceType vckv1alpha1.DataSourceType = "S3"
+	fakeDataHandler := &testDataHandler{sourceType: s3SourceType}
+	hook := NewVolumeManagerHooks(fakeClient.VckV1alpha1(), registryOf(fakeDataHandler), nil, &record.FakeRecorder{}, 0)
+
+	removed := vckv1alpha1.VolumeConfig{ID: "removed", SourceType: s3SourceType}
+	changed := vckv1alpha1.VolumeConfig{ID: "changed", SourceType: s3SourceType, Replicas: 1}
+	untouched := vckv1alpha1.VolumeConfig{ID: "untouched", SourceType: s3SourceType, Options: map[string]string{}}
+	legacy := vckv1alpha1.VolumeConfig{ID: "legacy", SourceType: s3SourceType}
+	oldVolumeManager, err := fakeClient.VckV1alpha1().VolumeManagers(namespace).Create(&vckv1alpha1.VolumeManager{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "volumeManager",
+		},
+		Spec: vckv1alpha1.VolumeManagerSpec{
+			VolumeConfigs: []vckv1alpha1.VolumeConfig{removed, changed, untouched, legacy},
+			State:         states.Running,
+		},
+		Status: vckv1alpha1.VolumeManagerStatus{
+			// The volume provisioned by an earlier version of the
+			// controller does not record its config.
+			Volumes: []vckv1alpha1.Volume{
+				{ID: "removed", Config: &removed},
+				{ID: "changed", Config: &changed},
+				{ID: "untouched", Phase: vckv1alpha1.VolumeReady, Message: "untouched", Config: &untouched},
+				{ID: "legacy", Phase: vckv1alpha1.VolumeReady},
+			},
+			State: states.Running,
+		},
+	})
+	require.Nil(t, err)
+
+	// Test case 1: a spec matching the configs recorded in the status does
+	// not touch any volume.
+	volumeManager := oldVolumeManager.DeepCopy()
+	require.False(t, hook.update(context.Background(), volumeManager))
+	require.False(t, fakeDataHandler.addCalled)
+	require.False(t, fakeDataHandler.deleteCalled)
+
+	// Test case 2: volume configs are added, removed and changed by ID. The
+	// removed and changed volumes are deleted using the config they were
+	// provisioned from, the config of a provisioned volume is recorded as
+	// found in the spec.
+	newVolumeManager := oldVolumeManager.DeepCopy()
+	addedConfig := vckv1alpha1.VolumeConfig{ID: "added", SourceType: s3SourceType, Options: map[string]string{"foo": "bar"}}
+	changedConfig := vckv1alpha1.VolumeConfig{ID: "changed", SourceType: s3SourceType, Replicas: 2}
+	newVolumeManager.Spec.VolumeConfigs = []vckv1alpha1.VolumeConfig{addedConfig, untouched, changedConfig, legacy}
+	require.True(t, hook.update(context.Background(), newVolumeManager))
+	require.Equal(t, []string{"removed", "changed"}, fakeDataHandler.deleted)
+	require.Equal(t, []vckv1alpha1.VolumeConfig{removed, changed}, fakeDataHandler.deletedConfigs)
+	// The volumes are provisioned concurrently.
+	require.ElementsMatch(t, []string{"changed", "added"}, fakeDataHandler.added)
+
+	volumeManager, err = fakeClient.VckV1alpha1().VolumeManagers(namespace).Get(newVolumeManager.Name, metav1.GetOptions{})
+	require.Nil(t, err)
+	require.Equal(t, states.Running, volumeManager.Status.State)
+	require.Equal(t, []vckv1alpha1.Volume{
+		{ID: "changed", Phase: vckv1alpha1.VolumeReady, Reason: vckv1alpha1.VolumeReasonProvisioned, Config: &changedConfig},
+		{ID: "untouched", Phase: vckv1alpha1.VolumeReady, Message: "untouched", Config: &untouched},
+		{ID: "legacy", Phase: vckv1alpha1.VolumeReady},
+		{ID: "added", Phase: vckv1alpha1.VolumeReady, Reason: vckv1alpha1.VolumeReasonProvisioned, Config: &addedConfig},
+	}, volumeManager.Status.Volumes)
+
+	// Test case 3: the diff does not depend on the versions seen before, e.g.
+	// after a restart of the controller.
+	fakeDataHandler.added = nil
+	fakeDataHandler.deleted = nil
+	fakeDataHandler.deletedConfigs = nil
+	restartedHook := NewVolumeManagerHooks(fakeClient.VckV1alpha1(), registryOf(fakeDataHandler), nil, &record.FakeRecorder{}, 0)
+	require.False(t, restartedHook.update(context.Background(), volumeManager))
+	require.Empty(t, fakeDataHandler.added)
+	require.Empty(t, fakeDataHandler.deleted)
+
+	// Test case 4: a removed volume which could not be deleted is kept in the
+	// status along with its config until its cleanup succeeds.
+	fakeDataHandler.deleteErr = fmt.Errorf("delete failed")
+	volumeManager.Spec.VolumeConfigs = []vckv1alpha1.VolumeConfig{addedConfig, changedConfig, legacy}
+	require.True(t, restartedHook.update(context.Background(), volumeManager))
+	require.Equal(t, []string{"untouched"}, fakeDataHandler.deleted)
+
+	volumeManager, err = fakeClient.VckV1alpha1().VolumeManagers(namespace).Get(newVolumeManager.Name, metav1.GetOptions{})
+	require.Nil(t, err)
+	require.Equal(t, states.Running, volumeManager.Status.State)
+	require.True(t, volumeManager.Status.IsConditionTrue(vckv1alpha1.VolumeManagerCleanupFailed))
+	require.Equal(t, vckv1alpha1.Volume{
+		ID:      "untouched",
+		Phase:   vckv1alpha1.VolumeDeleting,
+		Reason:  vckv1alpha1.VolumeReasonCleanupFailed,
+		Message: "failed to clean up the sub-resources: delete failed",
+		Config:  &untouched,
+	}, volumeManager.Status.Volumes[1])
+
+	fakeDataHandler.deleteErr = nil
+	require.True(t, restartedHook.update(context.Background(), volumeManager))
+	require.Equal(t, []string{"untouched", "untouched"}, fakeDataHandler.deleted)
+
+	volumeManager, err = fakeClient.VckV1alpha1().VolumeManagers(namespace).Get(newVolumeManager.Name, metav1.GetOptions{})
+	require.Nil(t, err)
+	require.Len(t, volumeManager.Status.Volumes, 3)
+	require.False(t, volumeManager.Status.IsConditionTrue(vckv1alpha1.VolumeManagerCleanupFailed))
+
+	// Test case 5: all the volumes are deleted when the CR fails. A volume
+	// whose config is neither recorded nor in the spec cannot be cleaned up.
+	fakeDataHandler.added = nil
+	fakeDataHandler.deleted = nil
+	failedVolumeManager := volumeManager.DeepCopy()
+	failedVolumeManager.Status.State = states.Failed
+	failedVolumeManager.Status.Conditions = nil
+	failedVolumeManager.Spec.VolumeConfigs = failedVolumeManager.Spec.VolumeConfigs[:2]
+	require.True(t, hook.update(context.Background(), failedVolumeManager))
+	require.Equal(t, []string{"changed", "added"}, fakeDataHandler.deleted)
+	require.Empty(t, fakeDataHandler.added)
+
+	failedVolumeManager, err = fakeClient.VckV1alpha1().VolumeManagers(namespace).Get(newVolumeManager.Name, metav1.GetOptions{})
+	require.Nil(t, err)
+	require.True(t, failedVolumeManager.Status.IsConditionTrue(vckv1alpha1.VolumeManagerCleanupFailed))
+	require.Equal(t, vckv1alpha1.VolumeReasonCleanupFailed, failedVolumeManager.Status.Volumes[1].Reason)
+	require.Contains(t, failedVolumeManager.Status.Volumes[1].Message, "the volume config volume legacy was provisioned from is unknown")
+
+	// Test case 6: the volumes of a failed CR are only deleted once.
+	fakeDataHandler.deleted = nil
+	failedVolumeManager.Spec.VolumeConfigs = volumeManager.Spec.VolumeConfigs
+	failedVolumeManager, err = fakeClient.VckV1alpha1().VolumeManagers(namespace).Update(failedVolumeManager)
+	require.Nil(t, err)
+	require.True(t, hook.update(context.Background(), failedVolumeManager))
+	failedVolumeManager, err = fakeClient.VckV1alpha1().VolumeManagers(namespace).Get(newVolumeManager.Name, metav1.GetOptions{})
+	require.Nil(t, err)
+	fakeDataHandler.deleted = nil
+	require.False(t, hook.update(context.Background(), failedVolumeManager))
+	require.Empty(t, fakeDataHandler.deleted)
+}
+
+func TestComplete(t *testing.T) {
+	fakeClient := vckv1alpha1_fake.NewSimpleClientset()
+	namespace := "test"
+
+	var s3SourceType vckv1alpha1.DataSourceType = "S3"
+	fakeDataHandler := &testDataHandler{sourceType: s3SourceType}
+	hook := NewVolumeManagerHooks(fakeClient.VckV1alpha1(), registryOf(fakeDataHandler), nil, &record.FakeRecorder{}, 0)
+
+	_, err := fakeClient.VckV1alpha1().VolumeManagers(namespace).Create(&vckv1alpha1.VolumeManager{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "volumeManager",
+		},
+		Spec: vckv1alpha1.VolumeManagerSpec{
+			VolumeConfigs: []vckv1alpha1.VolumeConfig{
+				{ID: "vol1", SourceType: s3SourceType},
+			},
+			State: states.Running,
+		},
+	})
+	require.Nil(t, err)
+	require.Nil(t, hook.Reconcile(context.Background(), "test/volumeManager"))
+
+	// Test case 1: a desired state of Completed deletes the volumes and keeps
+	// the CR along with its volumes.
+	volumeManager, err := fakeClient.VckV1alpha1().VolumeManagers(namespace).Get("volumeManager", metav1.GetOptions{})
+	require.Nil(t, err)
+	volumeManager.Spec.State = states.Completed
+	_, err = fakeClient.VckV1alpha1().VolumeManagers(namespace).Update(volumeManager)
+	require.Nil(t, err)
+
+	require.Nil(t, hook.Reconcile(context.Background(), "test/volumeManager"))
+	require.Equal(t, []string{"vol1"}, fakeDataHandler.deleted)
+
+	volumeManager, err = fakeClient.VckV1alpha1().VolumeManagers(namespace).Get("volumeManager", metav1.GetOptions{})
+	require.Nil(t, err)
+	require.Equal(t, states.Completed, volumeManager.Status.State)
+	require.Len(t, volumeManager.Status.Volumes, 1)
+	require.False(t, volumeManager.Status.IsConditionTrue(vckv1alpha1.VolumeManagerReady))
+
+	// Test case 2: a completed CR is neither cleaned up nor repaired again,
+	// even when it is deleted.
+	fakeDataHandler.repairErr = fmt.Errorf("gone")
+	require.Nil(t, hook.Reconcile(context.Background(), "test/volumeManager"))
+
+	deletionTimestamp := metav1.Now()
+	volumeManager.DeletionTimestamp = &deletionTimestamp
+	_, err = fakeClient.VckV1alpha1().VolumeManagers(namespace).Update(volumeManager)
+	require.Nil(t, err)
+	require.Nil(t, hook.Reconcile(context.Background(), "test/volumeManager"))
+
+	require.Equal(t, []string{"vol1"}, fakeDataHandler.deleted)
+	require.Equal(t, []string{"vol1"}, fakeDataHandler.added)
+
+	// Test case 3: a CR added as completed is not provisioned.
+	_, err = fakeClient.VckV1alpha1().VolumeManagers(namespace).Create(&vckv1alpha1.VolumeManager{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "addedAsCompleted",
+		},
+		Spec: vckv1alpha1.VolumeManagerSpec{
+			VolumeConfigs: []vckv1alpha1.VolumeConfig{
+				{ID: "vol2", SourceType: s3SourceType},
+			},
+			State: states.Completed,
+		},
+	})
+	require.Nil(t, err)
+	require.Nil(t, hook.Reconcile(context.Background(), "test/addedAsCompleted"))
+
+	volumeManager, err = fakeClient.VckV1alpha1().VolumeManagers(namespace).Get("addedAsCompleted", metav1.GetOptions{})
+	require.Nil(t, err)
+	require.Equal(t, states.Completed, volumeManager.Status.State)
+	require.Empty(t, volumeManager.Status.Volumes)
+	require.Equal(t, []string{"vol1"}, fakeDataHandler.added)
+
+	// Test case 4: a CR completed while its provisioning was interrupted is
+	// cleaned up instead of being provisioned again.
+	_, err = fakeClient.VckV1alpha1().VolumeManagers(namespace).Create(&vckv1alpha1.VolumeManager{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "completedWhilePending",
+		},
+		Spec: vckv1alpha1.VolumeManagerSpec{
+			VolumeConfigs: []vckv1alpha1.VolumeConfig{
+				{ID: "vol3", SourceType: s3SourceType},
+			},
+			State: states.Completed,
+		},
+		Status: vckv1alpha1.VolumeManagerStatus{
+			State: states.Pending,
+			Volumes: []vckv1alpha1.Volume{
+				{ID: "vol3", Phase: vckv1alpha1.VolumeDownloading},
+			},
+		},
+	})
+	require.Nil(t, err)
+	require.Nil(t, hook.Reconcile(context.Background(), "test/completedWhilePending"))
+
+	volumeManager, err = fakeClient.VckV1alpha1().VolumeManagers(namespace).Get("completedWhilePending", metav1.GetOptions{})
+	require.Nil(t, err)
+	require.Equal(t, states.Completed, volumeManager.Status.State)
+	require.Equal(t, []string{"vol1", "vol3"}, fakeDataHandler.deleted)
+	require.Equal(t, []string{"vol1"}, fakeDataHandler.added)
+}
+
+func TestInterrupt(t *testing.T) {
+	fakeClient := vckv1alpha1_fake.NewSimpleClientset()
+	namespace := "test"
+	recorder := record.NewFakeRecorder(10)
+	hook := NewVolumeManagerHooks(fakeClient.VckV1alpha1(), registryOf(), nil, recorder, 0)
+
+	for name, state := range map[string]states.State{"provisioning": states.Pending, "reconfiguring": states.Running, "completing": states.Running, "checking": states.Running} {
+		spec := vckv1alpha1.VolumeManagerSpec{State: states.Running}
+		if name == "completing" {
+			spec.State = states.Completed
+		}
+		_, err := fakeClient.VckV1alpha1().VolumeManagers(namespace).Create(&vckv1alpha1.VolumeManager{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec:       spec,
+			Status:     vckv1alpha1.VolumeManagerStatus{State: state},
+		})
+		require.Nil(t, err)
+	}
+
+	// Test case 1: only the mutating operations are tracked, and only the
+	// aborted ones are kept once they return.
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	untracks := []func(){}
+	for name, op := range map[string]operation{"provisioning": operationProvisioning, "reconfiguring": operationReconfigure, "completing": operationCleanup, "gone": operationProvisioning} {
+		untracks = append(untracks, hook.track(ctx, &vckv1alpha1.VolumeManager{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace}}, op))
+	}
+	untrack := hook.track(context.Background(), &vckv1alpha1.VolumeManager{ObjectMeta: metav1.ObjectMeta{Name: "done", Namespace: namespace}}, operationProvisioning)
+	untrack()
+
+	// A reconcile which only checks a volume manager in sync is not tracked.
+	require.Nil(t, hook.Reconcile(ctx, "test/checking"))
+
+	cancelFunc()
+	for _, untrack := range untracks {
+		untrack()
+	}
+	require.Len(t, hook.operations, 4)
+
+	// Test case 2: the interrupted operations are recorded in the status.
+	require.Nil(t, hook.Interrupt())
+
+	expected := map[string]states.State{"provisioning": states.Pending, "reconfiguring": states.Running, "completing": states.Running, "checking": states.Running}
+	for name, state := range expected {
+		volumeManager, err := fakeClient.VckV1alpha1().VolumeManagers(namespace).Get(name, metav1.GetOptions{})
+		require.Nil(t, err)
+		require.Equal(t, state, volumeManager.Status.State, name)
+
+		switch name {
+		case "provisioning":
+			require.Equal(t, "Interrupted", volumeManager.Status.GetCondition(vckv1alpha1.VolumeManagerProvisioning).Reason)
+			require.Equal(t, "provisioning interrupted by the controller shutdown, to be resumed", volumeManager.Status.Message)
+		case "reconfiguring":
+			require.Nil(t, volumeManager.Status.GetCondition(vckv1alpha1.VolumeManagerProvisioning))
+			require.Equal(t, "reconfiguration interrupted by the controller shutdown, to be retried", volumeManager.Status.Message)
+		case "completing":
+			require.Equal(t, "cleanup interrupted by the controller shutdown, to be retried", volumeManager.Status.Message)
+		case "checking":
+			require.Empty(t, volumeManager.Status.Message)
+		}
+	}
+	require.Len(t, events(recorder), 3)
+
+	// Test case 3: a new reconcile of a volume manager takes over from its
+	// aborted operation.
+	require.Nil(t, hook.Reconcile(context.Background(), "test/reconfiguring"))
+	require.NotContains(t, hook.operations, "test/reconfiguring")
+}
+
+func TestReconcileAborted(t *testing.T) {
+	fakeClient := vckv1alpha1_fake.NewSimpleClientset()
+	namespace := "test"
+
+	var s3SourceType vckv1alpha1.DataSourceType = "S3"
+	fakeDataHandler := &testDataHandler{sourceType: s3SourceType, addFailed: true}
+	hook := NewVolumeManagerHooks(fakeClient.VckV1alpha1(), registryOf(fakeDataHandler), nil, &record.FakeRecorder{}, 0)
+
+	_, err := fakeClient.VckV1alpha1().VolumeManagers(namespace).Create(&vckv1alpha1.VolumeManager{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:       "volumeManager",
+			Finalizers: []string{vckv1alpha1.CleanupFinalizer},
+		},
+		Spec: vckv1alpha1.VolumeManagerSpec{
+			VolumeConfigs: []vckv1alpha1.VolumeConfig{
+				{
+					ID:         "vol1",
+					SourceType: s3SourceType,
+				},
+			},
+			State: states.Running,
+		},
+	})
+	require.Nil(t, err)
+
+	// The volume manager is deleted during its provisioning, the outcome of
+	// the aborted provisioning is not recorded.
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	cancelFunc()
+	require.Nil(t, hook.Reconcile(ctx, "test/volumeManager"))
+	require.Equal(t, []string{"vol1"}, fakeDataHandler.added)
+
+	volumeManager, err := fakeClient.VckV1alpha1().VolumeManagers(namespace).Get("volumeManager", metav1.GetOptions{})
+	require.Nil(t, err)
+	require.Equal(t, states.Pending, volumeManager.Status.State)
 }
@@ -0,0 +1,201 @@
+//
+// Copyright (c) 2018 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: EPL-2.0
+//
+
+package metrics
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	vckv1alpha1 "github.com/IntelAI/vck/pkg/apis/vck/v1alpha1"
+	"github.com/IntelAI/vck/pkg/states"
+)
+
+const (
+	namespace = "vck"
+
+	// The operations of a data handler.
+	OperationAdd    = "add"
+	OperationDelete = "delete"
+)
+
+var (
+	// ReconcileTotal counts the reconciles of volume managers by result.
+	ReconcileTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "reconcile_total",
+		Help:      "Number of volume manager reconciles by result.",
+	}, []string{"result"})
+
+	// ReconcileDuration observes the duration of the reconciles of volume
+	// managers.
+	ReconcileDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "reconcile_duration_seconds",
+		Help:      "Duration of volume manager reconciles.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 4, 10),
+	})
+
+	// HandlerDuration observes the duration of the operations of the data
+	// handlers by source type.
+	HandlerDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "handler_duration_seconds",
+		Help:      "Duration of data handler operations by source type.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 4, 10),
+	}, []string{"source_type", "operation"})
+
+	// HandlerErrors counts the failed operations of the data handlers by
+	// source type.
+	HandlerErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "handler_errors_total",
+		Help:      "Number of failed data handler operations by source type.",
+	}, []string{"source_type", "operation"})
+
+	// DownloadPodDuration observes how long the download pods ran by source
+	// type.
+	DownloadPodDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "download_pod_duration_seconds",
+		Help:      "Duration of the data download pods by source type.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 14),
+	}, []string{"source_type"})
+
+	// ProvisionedBytes reports the size of the data provisioned for a volume,
+	// summed over its replicas.
+	ProvisionedBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "volume_provisioned_bytes",
+		Help:      "Size of the data provisioned for a volume, summed over its replicas.",
+	}, []string{"namespace", "volume_manager", "volume"})
+)
+
+func init() {
+	prometheus.MustRegister(ReconcileTotal, ReconcileDuration, HandlerDuration, HandlerErrors, DownloadPodDuration, ProvisionedBytes)
+}
+
+// ObserveReconcile records the outcome of a reconcile which started at start.
+func ObserveReconcile(start time.Time, err error) {
+	ReconcileDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		ReconcileTotal.WithLabelValues("error").Inc()
+		return
+	}
+	ReconcileTotal.WithLabelValues("success").Inc()
+}
+
+// ObserveHandler records the outcome of a data handler operation which started
+// at start.
+func ObserveHandler(sourceType vckv1alpha1.DataSourceType, operation string, start time.Time, failed bool) {
+	HandlerDuration.WithLabelValues(string(sourceType), operation).Observe(time.Since(start).Seconds())
+	if failed {
+		HandlerErrors.WithLabelValues(string(sourceType), operation).Inc()
+	}
+}
+
+var (
+	volumeManagersDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "volume_managers"),
+		"Number of volume managers by state.",
+		[]string{"state"}, nil)
+
+	nodeLabelsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "node_labels"),
+		"Number of node labels managed by the controller.",
+		nil, nil)
+)
+
+// clusterCollector reports the metrics which are read from the shared
+// informers of the volume managers and the nodes when they are scraped, so
+// that they are accurate regardless of restarts of the controller.
+type clusterCollector struct {
+	volumeManagers cache.SharedInformer
+	nodes          cache.SharedInformer
+}
+
+// NewClusterCollector returns a collector reporting the number of volume
+// managers by state and the number of node labels managed by the controller.
+// A metric is not reported until its informer has been synced, e.g. the volume
+// managers on a standby replica.
+func NewClusterCollector(volumeManagers, nodes cache.SharedInformer) prometheus.Collector {
+	return &clusterCollector{
+		volumeManagers: volumeManagers,
+		nodes:          nodes,
+	}
+}
+
+func (c *clusterCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- volumeManagersDesc
+	ch <- nodeLabelsDesc
+}
+
+func (c *clusterCollector) Collect(ch chan<- prometheus.Metric) {
+	if c.volumeManagers.HasSynced() {
+		counts := map[states.State]int{
+			states.Initial:   0,
+			states.Pending:   0,
+			states.Running:   0,
+			states.Completed: 0,
+			states.Failed:    0,
+		}
+		for _, obj := range c.volumeManagers.GetStore().List() {
+			volumeManager, ok := obj.(*vckv1alpha1.VolumeManager)
+			if !ok {
+				continue
+			}
+			counts[volumeManager.Status.State]++
+		}
+		for state, count := range counts {
+			label := string(state)
+			if state == states.Initial {
+				label = "Initial"
+			}
+			ch <- prometheus.MustNewConstMetric(volumeManagersDesc, prometheus.GaugeValue, float64(count), label)
+		}
+	}
+
+	if !c.nodes.HasSynced() {
+		return
+	}
+	labels := 0
+	for _, obj := range c.nodes.GetStore().List() {
+		node, ok := obj.(*corev1.Node)
+		if !ok {
+			continue
+		}
+		for key := range node.Labels {
+			if strings.HasPrefix(key, vckv1alpha1.GroupName+"/") {
+				labels++
+			}
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(nodeLabelsDesc, prometheus.GaugeValue, float64(labels))
+}
+
+// Handler returns an http handler serving the registered metrics.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
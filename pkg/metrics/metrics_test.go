@@ -0,0 +1,140 @@
+//
+// Copyright (c) 2018 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: EPL-2.0
+//
+
+package metrics
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+
+	vckv1alpha1 "github.com/IntelAI/vck/pkg/apis/vck/v1alpha1"
+	vckv1alpha1_fake "github.com/IntelAI/vck/pkg/client/clientset/versioned/fake"
+	vckv1alpha1_informer "github.com/IntelAI/vck/pkg/client/informers/externalversions"
+	"github.com/IntelAI/vck/pkg/states"
+)
+
+// gather returns the values of the metrics collected by the supplied
+// collector, keyed by name and label values.
+func gather(t *testing.T, collector prometheus.Collector) map[string]float64 {
+	registry := prometheus.NewRegistry()
+	require.Nil(t, registry.Register(collector))
+
+	families, err := registry.Gather()
+	require.Nil(t, err)
+
+	values := map[string]float64{}
+	for _, family := range families {
+		for _, metric := range family.Metric {
+			key := family.GetName()
+			for _, label := range metric.Label {
+				key = fmt.Sprintf("%s{%s=%s}", key, label.GetName(), label.GetValue())
+			}
+			values[key] = value(metric)
+		}
+	}
+	return values
+}
+
+func value(metric *dto.Metric) float64 {
+	switch {
+	case metric.Gauge != nil:
+		return metric.Gauge.GetValue()
+	case metric.Counter != nil:
+		return metric.Counter.GetValue()
+	case metric.Histogram != nil:
+		return float64(metric.Histogram.GetSampleCount())
+	}
+	return 0
+}
+
+func TestClusterCollector(t *testing.T) {
+	namespace := "test"
+	k8sClient := fake.NewSimpleClientset(
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1", Labels: map[string]string{
+			vckv1alpha1.GroupName + "/test-vm1-vol1": "true",
+			vckv1alpha1.GroupName + "/test-vm2-vol1": "true",
+			"kubernetes.io/hostname":                 "node1",
+		}}},
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node2", Labels: map[string]string{
+			vckv1alpha1.GroupName + "/test-vm1-vol1": "true",
+		}}},
+	)
+	crdClient := vckv1alpha1_fake.NewSimpleClientset()
+	for name, state := range map[string]states.State{"vm1": states.Running, "vm2": states.Running, "vm3": states.Failed, "vm4": states.Initial} {
+		_, err := crdClient.VckV1alpha1().VolumeManagers(namespace).Create(&vckv1alpha1.VolumeManager{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Status:     vckv1alpha1.VolumeManagerStatus{State: state},
+		})
+		require.Nil(t, err)
+	}
+
+	volumeManagers := vckv1alpha1_informer.NewFilteredSharedInformerFactory(crdClient, 0, namespace, nil).Vck().V1alpha1().VolumeManagers().Informer()
+	nodes := informers.NewSharedInformerFactory(k8sClient, 0).Core().V1().Nodes().Informer()
+
+	// Nothing is reported until the informers have been synced.
+	values := gather(t, NewClusterCollector(volumeManagers, nodes))
+	require.Empty(t, values)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go volumeManagers.Run(stopCh)
+	go nodes.Run(stopCh)
+	require.True(t, cache.WaitForCacheSync(stopCh, volumeManagers.HasSynced, nodes.HasSynced))
+
+	values = gather(t, NewClusterCollector(volumeManagers, nodes))
+	require.Equal(t, map[string]float64{
+		"vck_volume_managers{state=Initial}":   1,
+		"vck_volume_managers{state=Pending}":   0,
+		"vck_volume_managers{state=Running}":   2,
+		"vck_volume_managers{state=Completed}": 0,
+		"vck_volume_managers{state=Failed}":    1,
+		"vck_node_labels":                      3,
+	}, values)
+}
+
+func TestObserve(t *testing.T) {
+	ReconcileTotal.Reset()
+	ObserveReconcile(time.Now(), nil)
+	ObserveReconcile(time.Now(), fmt.Errorf("failed"))
+	ObserveReconcile(time.Now(), nil)
+
+	values := gather(t, ReconcileTotal)
+	require.Equal(t, float64(2), values["vck_reconcile_total{result=success}"])
+	require.Equal(t, float64(1), values["vck_reconcile_total{result=error}"])
+
+	HandlerErrors.Reset()
+	HandlerDuration.Reset()
+	ObserveHandler("S3", OperationAdd, time.Now(), false)
+	ObserveHandler("S3", OperationDelete, time.Now(), true)
+
+	values = gather(t, HandlerErrors)
+	require.Equal(t, map[string]float64{"vck_handler_errors_total{operation=delete}{source_type=S3}": 1}, values)
+	values = gather(t, HandlerDuration)
+	require.Equal(t, float64(1), values["vck_handler_duration_seconds{operation=add}{source_type=S3}"])
+	require.Equal(t, float64(1), values["vck_handler_duration_seconds{operation=delete}{source_type=S3}"])
+}
@@ -0,0 +1,311 @@
+//
+// Copyright (c) 2018 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: EPL-2.0
+//
+
+package resource
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// ManagedLabel is set to "true" by the templates on every sub-resource
+	// created by the controller, so that only those are held in the cache.
+	ManagedLabel = "vck.intelai.org/managed"
+	// VolumeManagerUIDLabel is set to the UID of the owning volume manager by
+	// the templates on every sub-resource created by the controller.
+	VolumeManagerUIDLabel = "vck.intelai.org/volume-manager-uid"
+)
+
+// cachedResource is the informer of a resource held in the cache.
+type cachedResource struct {
+	informer   cache.SharedIndexInformer
+	namespaced bool
+}
+
+// Cache holds shared informers for the pods, persistent volumes and persistent
+// volume claims managed by the controller, as well as for all the nodes of the
+// cluster which the replicas are placed on. Clients returned by
+// NewCachedClient read from the cache and wait for the changes of objects
+// using its watch events instead of polling the API server.
+type Cache struct {
+	factories []informers.SharedInformerFactory
+	resources map[string]cachedResource
+
+	lock sync.Mutex
+	// waiters holds the channels notified of the changes of an object, keyed
+	// by plural/namespace/name.
+	waiters map[string]map[chan struct{}]bool
+}
+
+// NewCache returns a cache of the sub-resources managed by the controller in
+// the supplied namespace, or in all the namespaces if it is empty.
+func NewCache(k8sClientset kubernetes.Interface, namespace string, resyncPeriod time.Duration) *Cache {
+	managed := informers.NewFilteredSharedInformerFactory(k8sClientset, resyncPeriod, namespace, func(options *metav1.ListOptions) {
+		options.LabelSelector = labels.SelectorFromSet(labels.Set{ManagedLabel: "true"}).String()
+	})
+	// The nodes are not created by the controller, all of them are needed to
+	// place the replicas.
+	nodes := informers.NewSharedInformerFactory(k8sClientset, resyncPeriod)
+
+	c := &Cache{
+		factories: []informers.SharedInformerFactory{managed, nodes},
+		resources: map[string]cachedResource{
+			"pods":                   {informer: managed.Core().V1().Pods().Informer(), namespaced: true},
+			"persistentvolumes":      {informer: managed.Core().V1().PersistentVolumes().Informer()},
+			"persistentvolumeclaims": {informer: managed.Core().V1().PersistentVolumeClaims().Informer(), namespaced: true},
+			"nodes":                  {informer: nodes.Core().V1().Nodes().Informer()},
+		},
+		waiters: map[string]map[chan struct{}]bool{},
+	}
+
+	for plural, resource := range c.resources {
+		plural := plural
+		notify := func(obj interface{}) {
+			key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+			if err != nil {
+				glog.Warningf("[cache] could not get key for %s %v: %v", plural, obj, err)
+				return
+			}
+			c.notify(plural + "/" + key)
+		}
+		resource.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc: notify,
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				notify(newObj)
+			},
+			DeleteFunc: notify,
+		})
+	}
+
+	return c
+}
+
+// Start starts the informers of the cache until the supplied channel is
+// closed.
+func (c *Cache) Start(stopCh <-chan struct{}) {
+	for _, factory := range c.factories {
+		factory.Start(stopCh)
+	}
+}
+
+// WaitForSync blocks until all the informers of the cache have been synced.
+// It returns false if the supplied channel is closed first.
+func (c *Cache) WaitForSync(stopCh <-chan struct{}) bool {
+	return cache.WaitForCacheSync(stopCh, c.hasSynced()...)
+}
+
+// Synced returns an error if any of the informers of the cache has not been
+// synced yet.
+func (c *Cache) Synced() error {
+	for plural, resource := range c.resources {
+		if !resource.informer.HasSynced() {
+			return fmt.Errorf("the %s cache has not been synced", plural)
+		}
+	}
+	return nil
+}
+
+// Informer returns the informer of the supplied resource, e.g. nodes, or nil
+// if the resource is not cached.
+func (c *Cache) Informer(plural string) cache.SharedIndexInformer {
+	resource, ok := c.resources[plural]
+	if !ok {
+		return nil
+	}
+	return resource.informer
+}
+
+func (c *Cache) hasSynced() []cache.InformerSynced {
+	hasSynced := []cache.InformerSynced{}
+	for _, resource := range c.resources {
+		hasSynced = append(hasSynced, resource.informer.HasSynced)
+	}
+	return hasSynced
+}
+
+// subscribe returns a channel which receives a value whenever the object
+// identified by key changes. The channel has to be unsubscribed once done.
+func (c *Cache) subscribe(key string) chan struct{} {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// A single pending notification is enough to read the object again.
+	ch := make(chan struct{}, 1)
+	if c.waiters[key] == nil {
+		c.waiters[key] = map[chan struct{}]bool{}
+	}
+	c.waiters[key][ch] = true
+	return ch
+}
+
+func (c *Cache) unsubscribe(key string, ch chan struct{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	delete(c.waiters[key], ch)
+	if len(c.waiters[key]) == 0 {
+		delete(c.waiters, key)
+	}
+}
+
+func (c *Cache) notify(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for ch := range c.waiters[key] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// cachedClient is a client which reads objects from the cache and writes them
+// through the API server.
+type cachedClient struct {
+	Client
+	cache    *Cache
+	resource cachedResource
+}
+
+// NewCachedClient returns a client reading the objects of the resource of the
+// supplied client from the cache. The client is returned as is if the cache
+// does not hold its resource.
+func NewCachedClient(client Client, c *Cache) Client {
+	resource, ok := c.resources[client.Plural()]
+	if !ok {
+		return client
+	}
+
+	return &cachedClient{
+		Client:   client,
+		cache:    c,
+		resource: resource,
+	}
+}
+
+// key returns the key of an object in the cache.
+func (c *cachedClient) key(namespace, name string) string {
+	if !c.resource.namespaced || namespace == "" {
+		return name
+	}
+	return namespace + "/" + name
+}
+
+// Get retrieves the object from the cache. Objects missing from the cache,
+// e.g. which have just been created or which were created by an earlier
+// version of the controller without the managed label, are retrieved from the
+// API server.
+func (c *cachedClient) Get(ctx context.Context, namespace, name string) (runtime.Object, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	obj, exists, err := c.resource.informer.GetIndexer().GetByKey(c.key(namespace, name))
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return c.Client.Get(ctx, namespace, name)
+	}
+	return obj.(runtime.Object).DeepCopyObject(), nil
+}
+
+// List lists the objects from the cache, in the order of their keys. Field
+// selectors are not supported by the cache, such lists are sent to the API
+// server.
+func (c *cachedClient) List(ctx context.Context, namespace string, options ListOptions) ([]metav1.Object, error) {
+	if err := ctx.Err(); err != nil {
+		return []metav1.Object{}, err
+	}
+	if len(options.Fields) != 0 {
+		return c.Client.List(ctx, namespace, options)
+	}
+
+	indexer := c.resource.informer.GetIndexer()
+	objs := indexer.List()
+	if c.resource.namespaced && namespace != "" {
+		var err error
+		objs, err = indexer.ByIndex(cache.NamespaceIndex, namespace)
+		if err != nil {
+			return []metav1.Object{}, err
+		}
+	}
+
+	selector := labels.SelectorFromSet(options.Labels)
+	result := []metav1.Object{}
+	for _, obj := range objs {
+		object := obj.(runtime.Object).DeepCopyObject().(metav1.Object)
+		if selector.Matches(labels.Set(object.GetLabels())) {
+			result = append(result, object)
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return c.key(result[i].GetNamespace(), result[i].GetName()) < c.key(result[j].GetNamespace(), result[j].GetName())
+	})
+	return result, nil
+}
+
+// Watch calls changed with the object from the cache, then again on every
+// watch event of the object.
+func (c *cachedClient) Watch(ctx context.Context, namespace, name string, changed func(runtime.Object) (bool, error)) error {
+	key := c.key(namespace, name)
+
+	// Subscribe before reading the object so that no change is missed.
+	ch := c.cache.subscribe(c.Plural() + "/" + key)
+	defer c.cache.unsubscribe(c.Plural()+"/"+key, ch)
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		obj, exists, err := c.resource.informer.GetIndexer().GetByKey(key)
+		if err != nil {
+			return err
+		}
+
+		var object runtime.Object
+		if exists {
+			object = obj.(runtime.Object).DeepCopyObject()
+		}
+		done, err := changed(object)
+		if err != nil || done {
+			return err
+		}
+
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -19,25 +19,52 @@
 package resource
 
 import (
+	"context"
+
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 )
 
-// Client manipulates Kubernetes API resources backed by template files.
+// Client manipulates Kubernetes API resources backed by template files. The
+// calls return the error of the supplied context without reaching the API
+// server once the context is done.
 type Client interface {
 	// Reify returns the raw request body given the supplied template values.
 	Reify(templateValues interface{}) ([]byte, error)
 	// Create creates a new object using the supplied data object for
-	// template expansion.
-	Create(namespace string, templateValues interface{}) error
+	// template expansion. An existing object with the same name and the same
+	// controller is adopted instead.
+	Create(ctx context.Context, namespace string, templateValues interface{}) error
 	// Delete deletes the object.
-	Delete(namespace string, name string) error
+	Delete(ctx context.Context, namespace string, name string) error
 	// Get retrieves the object.
-	Get(namespace, name string) (runtime.Object, error)
-	// List lists objects based on group, version and kind.
-	List(namespace string, labels map[string]string) ([]metav1.Object, error)
+	Get(ctx context.Context, namespace, name string) (runtime.Object, error)
+	// List lists the objects of the resource in the namespace, or in all the
+	// namespaces if it is empty, which match the supplied options.
+	List(ctx context.Context, namespace string, options ListOptions) ([]metav1.Object, error)
 	// Update updates the object
-	Update(object runtime.Object) (runtime.Object, error)
+	Update(ctx context.Context, object runtime.Object) (runtime.Object, error)
+	// Patch applies a patch of the supplied type, e.g. a JSON merge or a
+	// strategic merge patch, to the object. The patch is retried when it
+	// conflicts with a concurrent update of the object, e.g. when it
+	// carries a resource version.
+	Patch(ctx context.Context, namespace, name string, patchType types.PatchType, data []byte) (runtime.Object, error)
+	// Watch calls changed with the object, or with nil if it does not exist,
+	// then again whenever the object changes until changed returns true or
+	// an error. It returns the error of the supplied context if the context
+	// is done first.
+	Watch(ctx context.Context, namespace, name string, changed func(runtime.Object) (bool, error)) error
 	// Plural returns the plural form of the resource.
 	Plural() string
 }
+
+// ListOptions selects the objects returned by List. The selectors are sent to
+// the API server rather than applied to the listed objects.
+type ListOptions struct {
+	// Labels selects the objects carrying all of the labels.
+	Labels map[string]string
+	// Fields selects the objects whose fields have all of the values, e.g.
+	// spec.nodeName for pods.
+	Fields map[string]string
+}
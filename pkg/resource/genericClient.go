@@ -19,38 +19,66 @@
 package resource
 
 import (
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
 
+	"context"
 	"encoding/json"
+	"fmt"
+	"time"
+
 	"github.com/IntelAI/vck/pkg/resource/reify"
 	"github.com/golang/glog"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	// The time to wait for an existing object which is being deleted to go
+	// away before it is created again.
+	timeoutForDeletion = 1 * time.Minute
+
+	// The interval at which objects are polled when waiting for them to
+	// change.
+	pollInterval = 1 * time.Second
+
+	// The number of objects retrieved per request when listing.
+	defaultPageSize = 500
 )
 
 type genericClient struct {
-	resource           dynamic.ResourceInterface
-	resourcePluralForm string
-	namespace          string
-	templateFileName   string
-	scheme             *runtime.Scheme
-	groupversion       runtime.GroupVersioner
-	reify              reify.ReifyInterface
+	client           dynamic.Interface
+	apiResource      *metav1.APIResource
+	templateFileName string
+	scheme           *runtime.Scheme
+	groupversion     runtime.GroupVersioner
+	reify            reify.ReifyInterface
 }
 
-// NewGenericClient returns a new horizontal pod autoscaler client.
-func NewGenericClient(resource dynamic.ResourceInterface, templateFileName string, resourcePluralForm string, scheme *runtime.Scheme, groupversion runtime.GroupVersioner, reify reify.ReifyInterface) Client {
+// NewGenericClient returns a new client for the supplied API resource.
+func NewGenericClient(client dynamic.Interface, apiResource *metav1.APIResource, templateFileName string, scheme *runtime.Scheme, groupversion runtime.GroupVersioner, reify reify.ReifyInterface) Client {
 	return &genericClient{
-		resource:           resource,
-		resourcePluralForm: resourcePluralForm,
-		templateFileName:   templateFileName,
-		scheme:             scheme,
-		groupversion:       groupversion,
-		reify:              reify,
+		client:           client,
+		apiResource:      apiResource,
+		templateFileName: templateFileName,
+		scheme:           scheme,
+		groupversion:     groupversion,
+		reify:            reify,
 	}
 }
 
+// resource returns the interface to the resource in the supplied namespace.
+// The namespace is ignored if the resource is not namespaced.
+func (c *genericClient) resource(namespace string) dynamic.ResourceInterface {
+	return c.client.Resource(c.apiResource, namespace)
+}
+
 func (c *genericClient) Reify(templateValues interface{}) ([]byte, error) {
 	result, err := c.reify.Reify(c.templateFileName, templateValues)
 	if err != nil {
@@ -59,7 +87,11 @@ func (c *genericClient) Reify(templateValues interface{}) ([]byte, error) {
 	return result, nil
 }
 
-func (c *genericClient) Create(namespace string, templateValues interface{}) error {
+func (c *genericClient) Create(ctx context.Context, namespace string, templateValues interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	resourceBody, err := c.Reify(templateValues)
 	if err != nil {
 		return err
@@ -72,20 +104,76 @@ func (c *genericClient) Create(namespace string, templateValues interface{}) err
 		return err
 	}
 
-	_, err = c.resource.Create(object)
-	if err != nil {
-		return err
+	resource := c.resource(namespace)
+	_, err = resource.Create(object)
+	if errors.IsAlreadyExists(err) {
+		return c.adopt(ctx, resource, object)
 	}
 
-	return nil
+	return err
 }
 
-func (c *genericClient) Delete(namespace, name string) error {
-	return c.resource.Delete(name, &metav1.DeleteOptions{})
+// adopt takes over an existing object with the same name as the supplied one
+// if both have the same controller, which makes creating the sub-resources of
+// a volume again safe. An existing object which is being deleted cannot be
+// adopted, it is created again once it is gone.
+func (c *genericClient) adopt(ctx context.Context, resource dynamic.ResourceInterface, object *unstructured.Unstructured) error {
+	err := wait.PollImmediate(1*time.Second, timeoutForDeletion, func() (bool, error) {
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+
+		existing, err := resource.Get(object.GetName(), metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			_, err = resource.Create(object)
+			if errors.IsAlreadyExists(err) {
+				return false, nil
+			}
+			return err == nil, err
+		}
+		if err != nil {
+			return false, err
+		}
+
+		controllerRef, existingControllerRef := metav1.GetControllerOf(object), metav1.GetControllerOf(existing)
+		if controllerRef == nil || existingControllerRef == nil {
+			if controllerRef != existingControllerRef {
+				return false, fmt.Errorf("%s %s already exists with a different controller", c.apiResource.Name, object.GetName())
+			}
+		} else if controllerRef.UID != existingControllerRef.UID {
+			return false, fmt.Errorf("%s %s already exists with a different controller", c.apiResource.Name, object.GetName())
+		}
+
+		if existing.GetDeletionTimestamp() == nil {
+			glog.V(4).Infof("[generic_client] adopting existing %s %s", c.apiResource.Name, object.GetName())
+			return true, nil
+		}
+		return false, nil
+	})
+
+	if err == wait.ErrWaitTimeout {
+		return fmt.Errorf("timed out waiting for %s %s to be deleted", c.apiResource.Name, object.GetName())
+	}
+	return err
+}
+
+func (c *genericClient) Delete(ctx context.Context, namespace, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return c.resource(namespace).Delete(name, &metav1.DeleteOptions{})
 }
 
-func (c *genericClient) Get(namespace, name string) (result runtime.Object, err error) {
-	res, err := c.resource.Get(name, metav1.GetOptions{})
+func (c *genericClient) Get(ctx context.Context, namespace, name string) (result runtime.Object, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	res, err := c.resource(namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
 	result, err = c.scheme.ConvertToVersion(res, c.groupversion)
 	if err != nil {
 		return nil, err
@@ -93,39 +181,101 @@ func (c *genericClient) Get(namespace, name string) (result runtime.Object, err
 	return
 }
 
-func (c *genericClient) List(namespace string, labels map[string]string) (result []metav1.Object, err error) {
-	opts := metav1.ListOptions{}
-
-	list, err := c.resource.List(opts)
-	if err != nil {
-		glog.Infof("[generic_client] Got err while listing: %v", err)
-		return []metav1.Object{}, err
+func (c *genericClient) List(ctx context.Context, namespace string, options ListOptions) (result []metav1.Object, err error) {
+	opts := metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(options.Labels).String(),
+		FieldSelector: fields.SelectorFromSet(options.Fields).String(),
+		Limit:         defaultPageSize,
 	}
 
-	object := list.(*unstructured.UnstructuredList)
+	// Retrieve the objects one page at a time until the server does not
+	// return a continue token anymore.
+	for {
+		if err := ctx.Err(); err != nil {
+			return []metav1.Object{}, err
+		}
 
-	for _, item := range object.Items {
-		// We need a copy of the item here because item has function scope whereas the copy below has a local scope.
-		// Ex: When we iterate through items, the result list will only contain multiple copies of the last item in the list.
-		itemCopy := item
-		result = append(result, &itemCopy)
-	}
+		list, err := c.resource(namespace).List(opts)
+		if err != nil {
+			glog.Infof("[generic_client] Got err while listing: %v", err)
+			return []metav1.Object{}, err
+		}
 
-	return
+		object := list.(*unstructured.UnstructuredList)
+
+		for _, item := range object.Items {
+			// We need a copy of the item here because item has function scope whereas the copy below has a local scope.
+			// Ex: When we iterate through items, the result list will only contain multiple copies of the last item in the list.
+			itemCopy := item
+			result = append(result, &itemCopy)
+		}
+
+		opts.Continue = object.GetContinue()
+		if opts.Continue == "" {
+			return result, nil
+		}
+	}
 }
 
 // Plural returns the plural form of the resource.
 func (c *genericClient) Plural() string {
-	return c.resourcePluralForm
+	return c.apiResource.Name
 }
 
-func (c *genericClient) Update(object runtime.Object) (result runtime.Object, err error) {
+func (c *genericClient) Update(ctx context.Context, object runtime.Object) (result runtime.Object, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
 	convertedObject := &unstructured.Unstructured{}
-	err = c.scheme.Convert(object, convertedObject, c.resource)
+	err = c.scheme.Convert(object, convertedObject, nil)
 	if err != nil {
 		return
 	}
-	result, err = c.resource.Update(convertedObject)
+	result, err = c.resource(convertedObject.GetNamespace()).Update(convertedObject)
+	return
+}
+
+func (c *genericClient) Patch(ctx context.Context, namespace, name string, patchType types.PatchType, data []byte) (result runtime.Object, err error) {
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		res, err := c.resource(namespace).Patch(name, patchType, data)
+		if err != nil {
+			return err
+		}
+		result, err = c.scheme.ConvertToVersion(res, c.groupversion)
+		return err
+	})
 	return
 }
+
+// Watch polls the object from the API server every pollInterval as the
+// client does not hold a cache of the resource.
+func (c *genericClient) Watch(ctx context.Context, namespace, name string, changed func(runtime.Object) (bool, error)) error {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		object, err := c.Get(ctx, namespace, name)
+		if errors.IsNotFound(err) {
+			object, err = nil, nil
+		}
+		if err != nil {
+			return err
+		}
+
+		done, err := changed(object)
+		if err != nil || done {
+			return err
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
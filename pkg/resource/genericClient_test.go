@@ -20,6 +20,7 @@ package resource
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/stretchr/testify/require"
@@ -29,13 +30,18 @@ import (
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/dynamic"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
 	restclient "k8s.io/client-go/rest"
+	k8stesting "k8s.io/client-go/testing"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
 type fakeReify struct {
@@ -176,23 +182,20 @@ func TestGenericClient(t *testing.T) {
 		require.NotNil(t, server)
 		require.Nil(t, err)
 
-		// Get resource
-		resourceClient := client.Resource(test.apiResource, namespace)
-
 		// Create the generic client
-		genericClient := NewGenericClient(resourceClient, "", test.apiResource.Name, corev1Scheme, corev1.SchemeGroupVersion, &fakeReify{podJson: resourceJson})
+		genericClient := NewGenericClient(client, test.apiResource, "", corev1Scheme, corev1.SchemeGroupVersion, &fakeReify{podJson: resourceJson})
 
 		// Test Create
-		err = genericClient.Create(namespace, nil)
+		err = genericClient.Create(context.Background(), namespace, nil)
 		require.Nil(t, err)
 
 		// Test Get
-		obj, err := genericClient.Get(namespace, test.resourceName)
+		obj, err := genericClient.Get(context.Background(), namespace, test.resourceName)
 		require.NotNil(t, obj)
 		require.Nil(t, err)
 
 		// Test List
-		list, err := genericClient.List(namespace, map[string]string{})
+		list, err := genericClient.List(context.Background(), namespace, ListOptions{})
 		require.NotNil(t, list)
 		require.Nil(t, err)
 		require.Equal(t, 1, len(list))
@@ -202,11 +205,384 @@ func TestGenericClient(t *testing.T) {
 		compareJson(t, toCompareJson, resourceJson)
 
 		// Test Delete
-		err = genericClient.Delete(namespace, test.resourceName)
+		err = genericClient.Delete(context.Background(), namespace, test.resourceName)
 		require.Nil(t, err)
 
+		// A done context fails the calls without reaching the server.
+		ctx, cancelFunc := context.WithCancel(context.Background())
+		cancelFunc()
+		_, err = genericClient.Get(ctx, namespace, test.resourceName)
+		require.Equal(t, context.Canceled, err)
+
 		// Close the server
 		server.Close()
 	}
 
 }
+
+func getOwnedJSON(name, controllerUID string, deleting bool) []byte {
+	deletionTimestamp := ""
+	if deleting {
+		deletionTimestamp = `, "deletionTimestamp": "2018-01-01T00:00:00Z"`
+	}
+	return []byte(fmt.Sprintf(`{"apiVersion": "v1", "kind": "Pod", "metadata": {"name": %q, "ownerReferences": [{"apiVersion": "vck.intelai.org/v1alpha1", "kind": "VolumeManager", "name": "vm", "uid": %q, "controller": true}]%s}}`,
+		name, controllerUID, deletionTimestamp))
+}
+
+func writeStatus(w http.ResponseWriter, code int32, reason metav1.StatusReason) {
+	w.WriteHeader(int(code))
+	unstructured.UnstructuredJSONScheme.Encode(&metav1.Status{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Status"},
+		Status:   metav1.StatusFailure,
+		Reason:   reason,
+		Code:     code,
+	}, w)
+}
+
+func TestGenericClientAdopt(t *testing.T) {
+	namespace := "test"
+	corev1Scheme := runtime.NewScheme()
+	corev1Scheme.AddKnownTypes(corev1.SchemeGroupVersion, &corev1.Pod{})
+	apiResource := &metav1.APIResource{
+		Kind:       "Pod",
+		Name:       "pods",
+		Version:    "v1",
+		Namespaced: true,
+	}
+
+	testCases := map[string]struct {
+		// The versions of the existing pod returned by consecutive gets.
+		existing    [][]byte
+		expectedErr bool
+		created     int
+	}{
+		"same controller": {
+			existing: [][]byte{getOwnedJSON("pod1", "uid1", false)},
+			created:  1,
+		},
+		"different controller": {
+			existing:    [][]byte{getOwnedJSON("pod1", "uid2", false)},
+			expectedErr: true,
+			created:     1,
+		},
+		"being deleted": {
+			existing: [][]byte{getOwnedJSON("pod1", "uid1", true), nil},
+			created:  2,
+		},
+	}
+
+	for key, test := range testCases {
+		t.Logf("Testing for %v", key)
+		created := 0
+		gets := 0
+		client, server, err := getClientServer(&corev1.SchemeGroupVersion, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", runtime.ContentTypeJSON)
+			switch r.Method {
+			case "GET":
+				existing := test.existing[gets]
+				if gets < len(test.existing)-1 {
+					gets++
+				}
+				if existing == nil {
+					writeStatus(w, http.StatusNotFound, metav1.StatusReasonNotFound)
+					return
+				}
+				w.Write(existing)
+			case "POST":
+				created++
+				if created == 1 {
+					writeStatus(w, http.StatusConflict, metav1.StatusReasonAlreadyExists)
+					return
+				}
+				data, err := ioutil.ReadAll(r.Body)
+				require.Nil(t, err)
+				w.Write(data)
+			}
+		})
+		require.Nil(t, err)
+
+		genericClient := NewGenericClient(client, apiResource, "", corev1Scheme, corev1.SchemeGroupVersion, &fakeReify{podJson: getOwnedJSON("pod1", "uid1", false)})
+
+		err = genericClient.Create(context.Background(), namespace, nil)
+		if test.expectedErr {
+			require.NotNil(t, err)
+		} else {
+			require.Nil(t, err)
+		}
+		require.Equal(t, test.created, created)
+
+		server.Close()
+	}
+}
+
+func getPageJSON(continueToken string, items ...[]byte) []byte {
+	json := fmt.Sprintf(`{"apiVersion": "v1", "kind": "PodList", "metadata": {"continue": %q}, "items": [%s]}`,
+		continueToken, bytes.Join(items, []byte(",")))
+	return []byte(json)
+}
+
+func TestGenericClientList(t *testing.T) {
+	corev1Scheme := runtime.NewScheme()
+	corev1Scheme.AddKnownTypes(corev1.SchemeGroupVersion, &corev1.Pod{})
+	apiResource := &metav1.APIResource{
+		Kind:       "Pod",
+		Name:       "pods",
+		Version:    "v1",
+		Namespaced: true,
+	}
+
+	testCases := map[string]struct {
+		namespace             string
+		options               ListOptions
+		expectedPath          string
+		expectedLabelSelector string
+		expectedFieldSelector string
+	}{
+		"no selectors": {
+			namespace:    "test",
+			expectedPath: "/api/v1/namespaces/test/pods",
+		},
+		"selectors": {
+			namespace: "other",
+			options: ListOptions{
+				Labels: map[string]string{"foo": "bar", "app": "vck"},
+				Fields: map[string]string{"spec.nodeName": "node1"},
+			},
+			expectedPath:          "/api/v1/namespaces/other/pods",
+			expectedLabelSelector: "app=vck,foo=bar",
+			expectedFieldSelector: "spec.nodeName=node1",
+		},
+		"all namespaces": {
+			expectedPath: "/api/v1/pods",
+		},
+	}
+
+	// The pages served for the consecutive continue tokens.
+	pages := map[string][]byte{
+		"":      getPageJSON("page2", getJSON("v1", "Pod", "pod1"), getJSON("v1", "Pod", "pod2")),
+		"page2": getPageJSON("", getJSON("v1", "Pod", "pod3")),
+	}
+
+	for key, test := range testCases {
+		t.Logf("Testing for %v", key)
+		continueTokens := []string{}
+		client, server, err := getClientServer(&corev1.SchemeGroupVersion, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", runtime.ContentTypeJSON)
+			query := r.URL.Query()
+			if r.URL.Path != test.expectedPath ||
+				query.Get("labelSelector") != test.expectedLabelSelector ||
+				query.Get("fieldSelector") != test.expectedFieldSelector ||
+				query.Get("limit") != "500" {
+				writeStatus(w, http.StatusBadRequest, metav1.StatusReasonBadRequest)
+				return
+			}
+			continueTokens = append(continueTokens, query.Get("continue"))
+			w.Write(pages[query.Get("continue")])
+		})
+		require.Nil(t, err)
+
+		genericClient := NewGenericClient(client, apiResource, "", corev1Scheme, corev1.SchemeGroupVersion, &fakeReify{})
+		list, err := genericClient.List(context.Background(), test.namespace, test.options)
+		require.Nil(t, err)
+
+		// Every page is retrieved.
+		require.Equal(t, []string{"", "page2"}, continueTokens)
+		names := []string{}
+		for _, object := range list {
+			names = append(names, object.GetName())
+		}
+		require.Equal(t, []string{"pod1", "pod2", "pod3"}, names)
+
+		server.Close()
+	}
+}
+
+func TestGenericClientPatch(t *testing.T) {
+	corev1Scheme := runtime.NewScheme()
+	corev1Scheme.AddKnownTypes(corev1.SchemeGroupVersion, &corev1.Node{})
+	apiResource := &metav1.APIResource{
+		Kind:       "Node",
+		Name:       "nodes",
+		Version:    "v1",
+		Namespaced: false,
+	}
+	patch := []byte(`{"metadata":{"labels":{"foo":"true"}}}`)
+
+	testCases := map[string]struct {
+		// The number of conflicts returned before the patch is applied.
+		conflicts int
+		// The status returned instead of the patched object, if any.
+		status      int32
+		reason      metav1.StatusReason
+		expectedErr bool
+		patched     int
+	}{
+		"applied": {
+			patched: 1,
+		},
+		"retried on conflict": {
+			conflicts: 2,
+			patched:   3,
+		},
+		"too many conflicts": {
+			conflicts:   10,
+			expectedErr: true,
+			patched:     5,
+		},
+		"node not found": {
+			status:      http.StatusNotFound,
+			reason:      metav1.StatusReasonNotFound,
+			expectedErr: true,
+			patched:     1,
+		},
+	}
+
+	for key, test := range testCases {
+		t.Logf("Testing for %v", key)
+		patched := 0
+		client, server, err := getClientServer(&corev1.SchemeGroupVersion, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", runtime.ContentTypeJSON)
+			require.Equal(t, "PATCH", r.Method)
+			require.Equal(t, "/api/v1/nodes/node1", r.URL.Path)
+			require.Equal(t, string(types.StrategicMergePatchType), r.Header.Get("Content-Type"))
+			data, err := ioutil.ReadAll(r.Body)
+			require.Nil(t, err)
+			require.Equal(t, patch, data)
+
+			patched++
+			if patched <= test.conflicts {
+				writeStatus(w, http.StatusConflict, metav1.StatusReasonConflict)
+				return
+			}
+			if test.status != 0 {
+				writeStatus(w, test.status, test.reason)
+				return
+			}
+			w.Write(getJSON("v1", "Node", "node1"))
+		})
+		require.Nil(t, err)
+
+		genericClient := NewGenericClient(client, apiResource, "", corev1Scheme, corev1.SchemeGroupVersion, &fakeReify{})
+		obj, err := genericClient.Patch(context.Background(), "", "node1", types.StrategicMergePatchType, patch)
+		if test.expectedErr {
+			require.NotNil(t, err)
+		} else {
+			require.Nil(t, err)
+			require.Equal(t, "node1", obj.(*corev1.Node).Name)
+		}
+		require.Equal(t, test.patched, patched)
+
+		server.Close()
+	}
+}
+
+// apiClient stands for the API server behind a cached client and counts the
+// requests which reach it.
+type apiClient struct {
+	Client
+	plural   string
+	requests int
+}
+
+func (c *apiClient) Get(ctx context.Context, namespace, name string) (runtime.Object, error) {
+	c.requests++
+	return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace}}, nil
+}
+
+func (c *apiClient) List(ctx context.Context, namespace string, options ListOptions) ([]metav1.Object, error) {
+	c.requests++
+	return []metav1.Object{}, nil
+}
+
+func (c *apiClient) Plural() string {
+	return c.plural
+}
+
+func TestCache(t *testing.T) {
+	managed := map[string]string{ManagedLabel: "true"}
+	pod1 := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod1", Namespace: "test", Labels: managed}}
+	k8sClientset := k8sfake.NewSimpleClientset(
+		pod1,
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod2", Namespace: "test"}},
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod3", Namespace: "other", Labels: managed}},
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node2"}},
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1", Labels: map[string]string{"foo": "bar"}}},
+	)
+	podWatcher := watch.NewFake()
+	k8sClientset.PrependWatchReactor("pods", k8stesting.DefaultWatchReactor(podWatcher, nil))
+
+	resourceCache := NewCache(k8sClientset, "", time.Hour)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	require.NotNil(t, resourceCache.Synced())
+	resourceCache.Start(stopCh)
+	require.True(t, resourceCache.WaitForSync(stopCh))
+	require.Nil(t, resourceCache.Synced())
+
+	podAPI := &apiClient{plural: "pods"}
+	nodeAPI := &apiClient{plural: "nodes"}
+	podClient := NewCachedClient(podAPI, resourceCache)
+	nodeClient := NewCachedClient(nodeAPI, resourceCache)
+
+	// A resource which is not cached is read from the API server.
+	storageClassAPI := &apiClient{plural: "storageclasses"}
+	require.Equal(t, storageClassAPI, NewCachedClient(storageClassAPI, resourceCache))
+
+	names := func(objects []metav1.Object) []string {
+		result := []string{}
+		for _, object := range objects {
+			result = append(result, object.GetName())
+		}
+		return result
+	}
+
+	// Only the managed pods are cached, all the nodes are.
+	pods, err := podClient.List(context.Background(), "test", ListOptions{})
+	require.Nil(t, err)
+	require.Equal(t, []string{"pod1"}, names(pods))
+	pods, err = podClient.List(context.Background(), "", ListOptions{})
+	require.Nil(t, err)
+	require.Equal(t, []string{"pod3", "pod1"}, names(pods))
+	nodes, err := nodeClient.List(context.Background(), "", ListOptions{})
+	require.Nil(t, err)
+	require.Equal(t, []string{"node1", "node2"}, names(nodes))
+	nodes, err = nodeClient.List(context.Background(), "", ListOptions{Labels: map[string]string{"foo": "bar"}})
+	require.Nil(t, err)
+	require.Equal(t, []string{"node1"}, names(nodes))
+	obj, err := podClient.Get(context.Background(), "test", "pod1")
+	require.Nil(t, err)
+	require.Equal(t, pod1, obj)
+	require.Equal(t, 0, podAPI.requests+nodeAPI.requests)
+
+	// Objects missing from the cache and field selectors go to the server.
+	_, err = podClient.Get(context.Background(), "test", "pod2")
+	require.Nil(t, err)
+	_, err = podClient.List(context.Background(), "test", ListOptions{Fields: map[string]string{"spec.nodeName": "node1"}})
+	require.Nil(t, err)
+	require.Equal(t, 2, podAPI.requests)
+
+	// Watch returns once the pod has been observed to succeed.
+	done := make(chan error)
+	go func() {
+		done <- podClient.Watch(context.Background(), "test", "pod1", func(obj runtime.Object) (bool, error) {
+			return obj != nil && obj.(*corev1.Pod).Status.Phase == corev1.PodSucceeded, nil
+		})
+	}()
+	succeeded := pod1.DeepCopy()
+	succeeded.Status.Phase = corev1.PodSucceeded
+	podWatcher.Modify(succeeded)
+	select {
+	case err := <-done:
+		require.Nil(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timed out waiting for the watch of pod1")
+	}
+
+	// Watch returns the error of the context once it is done.
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	cancelFunc()
+	err = podClient.Watch(ctx, "test", "pod1", func(obj runtime.Object) (bool, error) {
+		return false, nil
+	})
+	require.Equal(t, context.Canceled, err)
+}
@@ -34,9 +34,20 @@ type ReifyInterface interface {
 	Reify(templateFileName string, templateValues interface{}) (json []byte, err error)
 }
 
-// Reify returns the resulting JSON by expanding the template using the
-// supplied data.
-func (r *Reify) Reify(templateFileName string, templateValues interface{}) (json []byte, err error) {
+// Validate returns an error if any of the supplied template files cannot be
+// loaded and parsed.
+func Validate(templateFileNames ...string) error {
+	for _, templateFileName := range templateFileNames {
+		if _, err := parse(templateFileName); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// parse loads and parses the template file.
+func parse(templateFileName string) (*template.Template, error) {
 	// Due to a weird quirk of go templates, we must pass the base name of the
 	// template file to template.New otherwise execute can fail!
 	baseFileName := filepath.Base(templateFileName)
@@ -45,7 +56,13 @@ func (r *Reify) Reify(templateFileName string, templateValues interface{}) (json
 			return (&r).String()
 		},
 	})
-	tmpl, err = tmpl.ParseFiles(templateFileName)
+	return tmpl.ParseFiles(templateFileName)
+}
+
+// Reify returns the resulting JSON by expanding the template using the
+// supplied data.
+func (r *Reify) Reify(templateFileName string, templateValues interface{}) (json []byte, err error) {
+	tmpl, err := parse(templateFileName)
 	if err != nil {
 		glog.Warningf("[reify] error parsing template file: %v", err)
 		return nil, err
@@ -122,3 +122,29 @@ func TestReify(t *testing.T) {
 		}
 	}
 }
+
+func TestValidate(t *testing.T) {
+	validFile, err := ioutil.TempFile("", "TestValidate-valid")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.Remove(validFile.Name())
+	validFile.WriteString(`a: {{ .X }}`)
+
+	invalidFile, err := ioutil.TempFile("", "TestValidate-invalid")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.Remove(invalidFile.Name())
+	invalidFile.WriteString(`a: {{ .X }"`)
+
+	if err := Validate(validFile.Name()); err != nil {
+		t.Errorf("expected no error but got [%v]", err)
+	}
+	if err := Validate(validFile.Name(), invalidFile.Name()); err == nil {
+		t.Errorf("expected an error for an invalid template")
+	}
+	if err := Validate(validFile.Name() + "-missing"); err == nil {
+		t.Errorf("expected an error for a missing template")
+	}
+}
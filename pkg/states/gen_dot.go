@@ -0,0 +1,36 @@
+//
+// Copyright (c) 2018 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: EPL-2.0
+//
+
+//go:build ignore
+// +build ignore
+
+// gen_dot writes the state diagram of the transition table to states.dot.
+package main
+
+import (
+	"io/ioutil"
+	"log"
+
+	"github.com/IntelAI/vck/pkg/states"
+)
+
+func main() {
+	if err := ioutil.WriteFile("states.dot", states.Dot(), 0644); err != nil {
+		log.Fatalf("error writing states.dot: %v", err)
+	}
+}
@@ -16,12 +16,22 @@
 // SPDX-License-Identifier: EPL-2.0
 //
 
+//go:generate go run gen_dot.go
+
 package states
 
+import (
+	"bytes"
+	"fmt"
+)
+
 // The State type's inhabitants comprise a VolumeManager's state space.
 type State string
 
 const (
+	// Initial - The state of a VolumeManager CR which has not been handled by the controller yet.
+	Initial State = ""
+
 	// Pending - In this state, the VolumeManager CR has been created, but its sub-resources are pending.
 	Pending State = "Pending"
 
@@ -35,3 +45,85 @@ const (
 	// Failed - VolumeManager CR is in a `Failed` state if an error has caused it to no longer be running as expected.
 	Failed State = "Failed"
 )
+
+// transition is an edge of the state machine, labeled with the event causing
+// it.
+type transition struct {
+	from  State
+	to    State
+	label string
+}
+
+// transitions is the table of the allowed state transitions. The state
+// diagram in states.dot is generated from it and can be rendered using
+// graphviz, e.g. dot -Tpng states.dot -o states.png.
+var transitions = []transition{
+	{Initial, Pending, "add"},
+	{Initial, Failed, "added as failed"},
+	{Initial, Completed, "added as completed"},
+	{Pending, Running, "deploy complete"},
+	{Pending, Failed, "deploy failed"},
+	{Running, Completed, "undeploy"},
+	{Pending, Completed, "undeploy"},
+	{Running, Failed, "errored"},
+	{Running, Pending, "detect recoverable error"},
+}
+
+// Transition returns an error if a VolumeManager CR is not allowed to move
+// from one state to the other. Staying in the same state is always allowed.
+func Transition(from, to State) error {
+	if from == to {
+		return nil
+	}
+
+	for _, t := range transitions {
+		if t.from == from && t.to == to {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("illegal state transition from [%s] to [%s]", name(from), name(to))
+}
+
+// IsTerminal returns true if there is no transition out of the state.
+func IsTerminal(state State) bool {
+	for _, t := range transitions {
+		if t.from == state {
+			return false
+		}
+	}
+	return true
+}
+
+// Dot returns the state diagram of the transition table in the graphviz dot
+// format.
+func Dot() []byte {
+	var buf bytes.Buffer
+
+	buf.WriteString("digraph JobStates {\n\n")
+	buf.WriteString("    rankdir = LR;\n\n")
+	buf.WriteString("    node [shape = point]; init;\n")
+	buf.WriteString("    node [shape = ellipse];\n\n")
+
+	for _, state := range []State{Pending, Running, Completed, Failed} {
+		if IsTerminal(state) {
+			fmt.Fprintf(&buf, "    %s [shape = doublecircle];\n", state)
+		}
+	}
+	buf.WriteString("\n")
+
+	for _, t := range transitions {
+		fmt.Fprintf(&buf, "    %s -> %s [label = %q];\n", name(t.from), name(t.to), t.label)
+	}
+	buf.WriteString("}\n")
+
+	return buf.Bytes()
+}
+
+// name returns the name of the state in the diagram.
+func name(state State) string {
+	if state == Initial {
+		return "init"
+	}
+	return string(state)
+}
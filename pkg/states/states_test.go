@@ -0,0 +1,62 @@
+//
+// Copyright (c) 2018 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: EPL-2.0
+//
+
+package states
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransition(t *testing.T) {
+	testCases := map[string]struct {
+		from        State
+		to          State
+		expectedErr bool
+	}{
+		"add":                      {from: Initial, to: Pending},
+		"added as completed":       {from: Initial, to: Completed},
+		"deploy complete":          {from: Pending, to: Running},
+		"deploy failed":            {from: Pending, to: Failed},
+		"errored":                  {from: Running, to: Failed},
+		"unchanged":                {from: Running, to: Running},
+		"running after failure":    {from: Failed, to: Running, expectedErr: true},
+		"running without pending":  {from: Initial, to: Running, expectedErr: true},
+		"pending after completion": {from: Completed, to: Pending, expectedErr: true},
+	}
+
+	for key, tc := range testCases {
+		t.Logf("Testing for: %v", key)
+		err := Transition(tc.from, tc.to)
+		if tc.expectedErr {
+			require.NotNil(t, err)
+			continue
+		}
+		require.Nil(t, err)
+	}
+}
+
+// TestDot makes sure that the checked in state diagram is generated from the
+// transition table. Run go generate to update it.
+func TestDot(t *testing.T) {
+	dot, err := ioutil.ReadFile("states.dot")
+	require.Nil(t, err)
+	require.Equal(t, string(Dot()), string(dot))
+}
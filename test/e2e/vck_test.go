@@ -644,7 +644,8 @@ func TestVolumeManager(t *testing.T) {
 			require.Equal(t, states.Running, volman.Status.State)
 
 			for _, vol := range volman.Status.Volumes {
-				require.Equal(t, crv1alpha1.SuccessfulVolumeStatusMessage, vol.Message)
+				require.Equal(t, crv1alpha1.VolumeReady, vol.Phase)
+				require.Equal(t, crv1alpha1.VolumeReasonProvisioned, vol.Reason)
 			}
 
 			if testCase.expHP {